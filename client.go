@@ -7,20 +7,51 @@
 package framework
 
 import (
+	"errors"
+	"sync"
+
 	"github.com/openchirp/framework/pubsub"
 	"github.com/openchirp/framework/rest"
+	"github.com/sirupsen/logrus"
 )
 
 // MQTTBridgeClient sets whether the MQTT client will identify itself as a
-// bridge to the broker
+// bridge to the broker. When using MQTT v5, this is accomplished by using the
+// standard noLocal subscription option instead.
 var MQTTBridgeClient = false
 
+// MQTTVersion5 sets whether the MQTT client will use the MQTT v5 protocol
+// instead of MQTT v3.1.1. MQTT v5 support is only built with the mqtt5 build
+// tag, otherwise starting a client returns ErrMQTT5Unsupported.
+var MQTTVersion5 = false
+
+var ErrMQTT5Unsupported = errors.New("MQTT v5 support requires building with the mqtt5 tag")
+
+// MQTTTransport sets the TLS config, WebSocket handshake headers, and proxy
+// used to connect to the broker. WebSocket brokers are selected by using a
+// ws:// or wss:// broker URI, which may include the endpoint path.
+var MQTTTransport pubsub.MQTTTransport
+
 const (
 	mqttAutoReconnect                = true
 	mqttQoS           pubsub.MQTTQoS = pubsub.QoSExactlyOnce
 	mqttRetained                     = false
+	// rpcSubtopic is the subtopic under which RPC responses are received
+	rpcSubtopic = "rpc"
 )
 
+// mqttClient is the set of pubsub methods the clients rely on, which is
+// implemented by both the MQTT v3.1.1 and v5 pubsub clients
+type mqttClient interface {
+	pubsub.HandlerPubSub
+	SubscribeQoS(topic string, qos pubsub.MQTTQoS, callback func(topic string, payload []byte)) error
+	SubscribeHandlerQoS(topic string, qos pubsub.MQTTQoS, callback func(topic string, payload []byte)) (pubsub.SubscriptionID, error)
+	SubscribeShared(group, topic string, qos pubsub.MQTTQoS, callback func(topic string, payload []byte)) (pubsub.SubscriptionID, error)
+	PublishOpts(topic string, payload interface{}, qos pubsub.MQTTQoS, retained bool) error
+	ClearRetained(topics ...string) error
+	Disconnect()
+}
+
 // ClientTopicHandler is a function prototype for a subscribed topic callback
 type ClientTopicHandler func(topic string, payload []byte)
 
@@ -31,7 +62,26 @@ type Client struct {
 	host        rest.Host
 	willTopic   string
 	willPayload []byte
-	mqtt        *pubsub.MQTTClient
+	brokerURI   string
+	mqtt        mqttClient
+	rpcLock     sync.Mutex
+	rpc         *pubsub.RPC
+	log         *logrus.Logger // see SetLogger
+}
+
+// SetLogger sets the logger the client reports problems to, which defaults
+// to the logrus standard logger. It should be called before the client is
+// used from other goroutines.
+func (c *Client) SetLogger(log *logrus.Logger) {
+	c.log = log
+}
+
+// logger returns the logger set by SetLogger
+func (c *Client) logger() *logrus.Logger {
+	if c.log == nil {
+		return logrus.StandardLogger()
+	}
+	return c.log
 }
 
 // setAuth sets basic client authentication parameters
@@ -42,9 +92,7 @@ func (c *Client) setAuth(id, token string) {
 
 func (c *Client) startREST(frameworkURI string) error {
 	c.host = rest.NewHost(frameworkURI)
-	if err := c.host.Login(c.id, c.token); err != nil {
-		return err
-	}
+	c.host.SetCredentials(c.id, c.token)
 	return nil
 }
 
@@ -103,16 +151,35 @@ func (c *Client) setWill(topic string, payload []byte) {
 func (c *Client) startMQTT(brokerURI string) error {
 	/* Connect the MQTT connection */
 	pubsub.AutoReconnect = mqttAutoReconnect
+	c.brokerURI = brokerURI
 
-	var err error
-	var mqtt *pubsub.MQTTClient
-	if MQTTBridgeClient {
-		mqtt, err = pubsub.NewMQTTWillBridgeClient(brokerURI, c.id, c.token, mqttQoS, mqttRetained, c.willTopic, c.willPayload)
-	} else {
-		mqtt, err = pubsub.NewMQTTWillClient(brokerURI, c.id, c.token, mqttQoS, mqttRetained, c.willTopic, c.willPayload)
+	mqtt, err := c.connectMQTT(pubsub.MQTTOptions{
+		WillTopic:   c.willTopic,
+		WillPayload: c.willPayload,
+		Bridge:      MQTTBridgeClient,
+	}, mqttRetained)
+	if err != nil {
+		return err
 	}
 	c.mqtt = mqtt
-	return err
+	return nil
+}
+
+// connectMQTT opens a new connection to the client's broker using the
+// selected MQTT protocol version and transport. The retained setting is the
+// default for publishes and the will message.
+func (c *Client) connectMQTT(opts pubsub.MQTTOptions, retained bool) (mqttClient, error) {
+	opts.Transport = MQTTTransport
+
+	if MQTTVersion5 {
+		return c.connectMQTT5(opts, retained)
+	}
+
+	mqtt, err := pubsub.NewMQTTClientWithOptions(c.brokerURI, c.id, c.token, mqttQoS, retained, opts)
+	if err != nil {
+		return nil, err
+	}
+	return mqtt, nil
 }
 
 // startClient sets auth, starts REST, and starts MQTT
@@ -131,24 +198,80 @@ func (c *Client) startClient(frameworkURI, brokerURI, id, token string) error {
 
 // stopService shuts down a started client
 func (c *Client) stopClient() {
+	c.rpcLock.Lock()
+	if c.rpc != nil {
+		c.rpc.Close()
+		c.rpc = nil
+	}
+	c.rpcLock.Unlock()
 	c.mqtt.Disconnect()
 }
 
+// getRPC returns the client's RPC helper, which is created on first use and
+// receives responses under replyPrefix
+func (c *Client) getRPC(replyPrefix string) (*pubsub.RPC, error) {
+	c.rpcLock.Lock()
+	defer c.rpcLock.Unlock()
+
+	if c.rpc == nil {
+		rpc, err := pubsub.NewRPC(c.mqtt, replyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		c.rpc = rpc
+	}
+	return c.rpc, nil
+}
+
 // subscribe registers a callback for a receiving a given mqtt topic payload
 func (c *Client) subscribe(topic string, callback ClientTopicHandler) error {
 	return c.mqtt.Subscribe(topic, callback)
 }
 
+// subscribeQoS registers a callback for a receiving a given mqtt topic payload
+// using the specified QoS
+func (c *Client) subscribeQoS(topic string, qos pubsub.MQTTQoS, callback ClientTopicHandler) error {
+	return c.mqtt.SubscribeQoS(topic, qos, callback)
+}
+
+// subscribeHandler registers a callback for a receiving a given mqtt topic
+// payload and returns an id that can be used to deregister only this callback
+func (c *Client) subscribeHandler(topic string, qos pubsub.MQTTQoS, callback ClientTopicHandler) (pubsub.SubscriptionID, error) {
+	return c.mqtt.SubscribeHandlerQoS(topic, qos, callback)
+}
+
+// subscribeShared registers a callback on a shared subscription of a given
+// mqtt topic, which load balances messages across all clients in group
+func (c *Client) subscribeShared(group, topic string, qos pubsub.MQTTQoS, callback ClientTopicHandler) (pubsub.SubscriptionID, error) {
+	return c.mqtt.SubscribeShared(group, topic, qos, callback)
+}
+
 // unsubscribe deregisters a callback for a given mqtt topics
 func (c *Client) unsubscribe(topics ...string) error {
 	return c.mqtt.Unsubscribe(topics...)
 }
 
+// unsubscribeHandler deregisters the callbacks identified by ids
+func (c *Client) unsubscribeHandler(ids ...pubsub.SubscriptionID) error {
+	return c.mqtt.UnsubscribeHandler(ids...)
+}
+
 // publish publishes a payload to a given mqtt topic
 func (c *Client) publish(topic string, payload interface{}) error {
 	return c.mqtt.Publish(topic, payload)
 }
 
+// publishOpts publishes a payload to a given mqtt topic using the specified
+// QoS and retained flag
+func (c *Client) publishOpts(topic string, payload interface{}, qos pubsub.MQTTQoS, retained bool) error {
+	return c.mqtt.PublishOpts(topic, payload, qos, retained)
+}
+
+// clearRetained clears the retained messages for the given mqtt topics
+func (c *Client) clearRetained(topics ...string) error {
+	return c.mqtt.ClearRetained(topics...)
+}
+
 // FetchDeviceInfo requests and fetches device information from the REST interface
 func (c *Client) FetchDeviceInfo(deviceID string) (rest.DeviceNode, error) {
 	d, err := c.host.RequestDeviceInfo(deviceID)
@@ -167,3 +290,10 @@ func (c *Client) FetchLocationDevices(locationID string, recursive bool) ([]rest
 	devices, err := c.host.RequestLocationDevices(locationID, recursive)
 	return devices, err
 }
+
+// FetchLocationTree fetches the tree of locations below and including
+// locationID, along with the devices at each location.
+// If locationID is blank, the tree starts at the root location.
+func (c *Client) FetchLocationTree(locationID string) (*rest.LocationTree, error) {
+	return c.host.LocationTree(locationID)
+}
@@ -0,0 +1,28 @@
+//go:build mqtt5
+// +build mqtt5
+
+package framework
+
+import (
+	"github.com/openchirp/framework/pubsub"
+)
+
+// connectMQTT5 opens a new MQTT v5 connection to the client's broker.
+// The bridge setting is carried out using the noLocal subscription option.
+func (c *Client) connectMQTT5(opts pubsub.MQTTOptions, retained bool) (mqttClient, error) {
+	opts5 := pubsub.MQTT5Options{
+		ClientIDPrefix: opts.ClientIDPrefix,
+		WillTopic:      opts.WillTopic,
+		WillPayload:    opts.WillPayload,
+		NoLocal:        opts.Bridge,
+		Transport:      opts.Transport,
+	}
+	if opts.Bridge && opts5.ClientIDPrefix == "" {
+		opts5.ClientIDPrefix = "bridge"
+	}
+	mqtt, err := pubsub.NewMQTT5Client(c.brokerURI, c.id, c.token, mqttQoS, retained, opts5)
+	if err != nil {
+		return nil, err
+	}
+	return mqtt, nil
+}
@@ -0,0 +1,13 @@
+//go:build !mqtt5
+// +build !mqtt5
+
+package framework
+
+import (
+	"github.com/openchirp/framework/pubsub"
+)
+
+// connectMQTT5 fails, since MQTT v5 support was not built in
+func (c *Client) connectMQTT5(opts pubsub.MQTTOptions, retained bool) (mqttClient, error) {
+	return nil, ErrMQTT5Unsupported
+}
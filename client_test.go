@@ -0,0 +1,223 @@
+package framework
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/openchirp/framework/pubsub"
+)
+
+// publishCall is a publish recorded by recordMQTT
+type publishCall struct {
+	topic    string
+	payload  string
+	qos      pubsub.MQTTQoS
+	retained bool
+}
+
+// recordMQTT is an mqttClient that records the QoS and retained flags of
+// publishes and subscriptions along with the topics cleared of retained
+// values
+type recordMQTT struct {
+	mqttClient
+	lock       sync.Mutex
+	nextID     pubsub.SubscriptionID
+	publishes  []publishCall
+	subscribed map[string]pubsub.MQTTQoS
+	cleared    []string
+	publishErr error // returned by PublishOpts, if set
+}
+
+func newRecordMQTT() *recordMQTT {
+	return &recordMQTT{subscribed: make(map[string]pubsub.MQTTQoS)}
+}
+
+func (c *recordMQTT) SubscribeQoS(topic string, qos pubsub.MQTTQoS, callback func(topic string, payload []byte)) error {
+	_, err := c.SubscribeHandlerQoS(topic, qos, callback)
+	return err
+}
+
+func (c *recordMQTT) SubscribeHandlerQoS(topic string, qos pubsub.MQTTQoS, callback func(topic string, payload []byte)) (pubsub.SubscriptionID, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.subscribed[topic] = qos
+	c.nextID++
+	return c.nextID, nil
+}
+
+func (c *recordMQTT) UnsubscribeHandler(ids ...pubsub.SubscriptionID) error {
+	return nil
+}
+
+func (c *recordMQTT) Publish(topic string, payload interface{}) error {
+	return c.PublishOpts(topic, payload, mqttQoS, mqttRetained)
+}
+
+func (c *recordMQTT) PublishOpts(topic string, payload interface{}, qos pubsub.MQTTQoS, retained bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var str string
+	switch p := payload.(type) {
+	case []byte:
+		str = string(p)
+	case string:
+		str = p
+	}
+	if c.publishErr != nil {
+		return c.publishErr
+	}
+	c.publishes = append(c.publishes, publishCall{topic, str, qos, retained})
+	return nil
+}
+
+func (c *recordMQTT) ClearRetained(topics ...string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cleared = append(c.cleared, topics...)
+	return nil
+}
+
+// lastPublish returns the most recent publish on topic
+func (c *recordMQTT) lastPublish(t *testing.T, topic string) publishCall {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := len(c.publishes) - 1; i >= 0; i-- {
+		if c.publishes[i].topic == topic {
+			return c.publishes[i]
+		}
+	}
+	t.Fatalf("No publish on %s", topic)
+	return publishCall{}
+}
+
+func TestDeviceClient_QoSAndRetain(t *testing.T) {
+	mqtt := newRecordMQTT()
+	c := new(DeviceClient)
+	c.mqtt = mqtt
+	c.node.Pubsub.Topic = "openchirp/device/dev1"
+
+	if err := c.PublishOpts("temperature", "21.5", pubsub.QoSAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	expected := publishCall{"openchirp/device/dev1/temperature", "21.5", pubsub.QoSAtLeastOnce, true}
+	if p := mqtt.lastPublish(t, expected.topic); p != expected {
+		t.Fatalf("Expected publish %+v, got %+v", expected, p)
+	}
+
+	if err := c.SubscribeQoS("relay", pubsub.QoSAtMostOnce, func(topic string, payload []byte) {}); err != nil {
+		t.Fatal(err)
+	}
+	if qos, ok := mqtt.subscribed["openchirp/device/dev1/relay"]; !ok || qos != pubsub.QoSAtMostOnce {
+		t.Fatalf("Expected a QoS 0 subscription, got %v, %v", qos, ok)
+	}
+}
+
+func TestDeviceControl_QoSAndRetain(t *testing.T) {
+	mqtt := newRecordMQTT()
+	c := new(ServiceClient)
+	c.mqtt = mqtt
+	m, err := newServiceManager(c, func() Device { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	dState := &deviceState{
+		id:       "dev1",
+		topic:    "openchirp/device/dev1",
+		subs:     make(map[string]deviceSubscription),
+		retained: make(map[string]bool),
+	}
+	ctrl := &DeviceControl{manager: m, dState: dState}
+
+	ctrl.PublishOpts("temperature", "21.5", pubsub.QoSAtMostOnce, false)
+	expected := publishCall{"openchirp/device/dev1/temperature", "21.5", pubsub.QoSAtMostOnce, false}
+	if p := mqtt.lastPublish(t, expected.topic); p != expected {
+		t.Fatalf("Expected publish %+v, got %+v", expected, p)
+	}
+	ctrl.Publish("humidity", "40")
+	expected = publishCall{"openchirp/device/dev1/humidity", "40", mqttQoS, mqttRetained}
+	if p := mqtt.lastPublish(t, expected.topic); p != expected {
+		t.Fatalf("Expected default publish %+v, got %+v", expected, p)
+	}
+
+	ctrl.SubscribeQoS("rawrx", nil, pubsub.QoSAtLeastOnce)
+	if qos, ok := mqtt.subscribed["openchirp/device/dev1/rawrx"]; !ok || qos != pubsub.QoSAtLeastOnce {
+		t.Fatalf("Expected a QoS 1 subscription, got %v, %v", qos, ok)
+	}
+}
+
+// retainingDevice publishes a retained value when linked
+type retainingDevice struct{}
+
+func (d retainingDevice) ProcessLink(ctrl *DeviceControl) string {
+	ctrl.PublishRetained("temperature", "21.5")
+	ctrl.PublishRetained("humidity", "40")
+	return "Linked"
+}
+
+func (d retainingDevice) ProcessUnlink(ctrl *DeviceControl) {}
+
+func (d retainingDevice) ProcessConfigChange(ctrl *DeviceControl, cchanges, coriginal map[string]string) (string, bool) {
+	return "", true
+}
+
+func (d retainingDevice) ProcessMessage(ctrl *DeviceControl, msg Message) {}
+
+func TestDeviceClient_PublishRetained(t *testing.T) {
+	mqtt := newRecordMQTT()
+	c := new(DeviceClient)
+	c.mqtt = mqtt
+	c.node.Pubsub.Topic = "openchirp/device/dev1"
+
+	if err := c.PublishRetained("temperature", "21.5"); err != nil {
+		t.Fatal(err)
+	}
+	expected := publishCall{"openchirp/device/dev1/temperature", "21.5", mqttQoS, true}
+	if p := mqtt.lastPublish(t, expected.topic); p != expected {
+		t.Fatalf("Expected retained publish %+v, got %+v", expected, p)
+	}
+	if err := c.ClearRetained("temperature"); err != nil {
+		t.Fatal(err)
+	}
+	if !equalStringSlices(mqtt.cleared, []string{"openchirp/device/dev1/temperature"}) {
+		t.Fatalf("Expected the temperature value to be cleared, got %v", mqtt.cleared)
+	}
+}
+
+func TestServiceManager_RemoveDeviceClearsRetained(t *testing.T) {
+	mqtt := newRecordMQTT()
+	c := new(ServiceClient)
+	c.mqtt = mqtt
+	m, err := newServiceManager(c, func() Device { return retainingDevice{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.addUpdateDevice("dev1", "openchirp/device/dev1", map[string]string{})
+	expected := publishCall{"openchirp/device/dev1/temperature", "21.5", mqttQoS, true}
+	if p := mqtt.lastPublish(t, expected.topic); p != expected {
+		t.Fatalf("Expected retained publish %+v, got %+v", expected, p)
+	}
+
+	// Values cleared by the device are no longer tracked
+	ctrl := m.deviceCtrlsCacheProvide(m.devices["dev1"])
+	ctrl.ClearRetained("humidity")
+	if !equalStringSlices(mqtt.cleared, []string{"openchirp/device/dev1/humidity"}) {
+		t.Fatalf("Expected the humidity value to be cleared, got %v", mqtt.cleared)
+	}
+
+	// Values that failed to publish are not tracked
+	mqtt.lock.Lock()
+	mqtt.publishErr = errors.New("not connected")
+	mqtt.lock.Unlock()
+	ctrl.PublishRetained("pressure", "1013")
+	mqtt.lock.Lock()
+	mqtt.publishErr = nil
+	mqtt.lock.Unlock()
+
+	mqtt.cleared = nil
+	m.removeDevice("dev1")
+	if !equalStringSlices(mqtt.cleared, []string{"openchirp/device/dev1/temperature"}) {
+		t.Fatalf("Expected the remaining retained value to be cleared on unlink, got %v", mqtt.cleared)
+	}
+}
@@ -0,0 +1,75 @@
+// Command deadletter-replay reinjects dead letters, written by a managed
+// service's dead letter file, by republishing each message to the topic it
+// was originally received on.
+//
+// Usage:
+//
+//	deadletter-replay -broker tcp://localhost:1883 -user <id> -pass <token> deadletters.jsonl
+//
+// Dead letters are read from standard input when no file is given.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/openchirp/framework"
+	"github.com/openchirp/framework/pubsub"
+)
+
+func main() {
+	brokerURI := flag.String("broker", "tcp://localhost:1883", "MQTT broker URI")
+	user := flag.String("user", "", "MQTT username, such as a user, device, or service id")
+	pass := flag.String("pass", "", "MQTT password, such as the matching token")
+	device := flag.String("device", "", "Only replay dead letters of this device id")
+	dryRun := flag.Bool("dry-run", false, "Print the dead letters instead of replaying them")
+	flag.Parse()
+
+	var in io.Reader = os.Stdin
+	if flag.NArg() > 0 {
+		file, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open dead letters: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	letters, err := framework.ReadDeadLetters(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read dead letters: %v\n", err)
+		os.Exit(1)
+	}
+	if *device != "" {
+		filtered := letters[:0]
+		for _, letter := range letters {
+			if letter.DeviceID == *device {
+				filtered = append(filtered, letter)
+			}
+		}
+		letters = filtered
+	}
+
+	if *dryRun {
+		for _, letter := range letters {
+			fmt.Printf("%s %s %s: %q\n", letter.Time, letter.Topic, letter.Error, letter.Payload)
+		}
+		return
+	}
+
+	mqtt, err := pubsub.NewMQTTClient(*brokerURI, *user, *pass, pubsub.QoSExactlyOnce, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to broker: %v\n", err)
+		os.Exit(1)
+	}
+	defer mqtt.Disconnect()
+
+	if err := framework.ReplayDeadLetters(mqtt, letters...); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to replay dead letters: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Replayed %d dead letters\n", len(letters))
+}
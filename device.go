@@ -1,13 +1,32 @@
 package framework
 
 import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/openchirp/framework/pubsub"
 	"github.com/openchirp/framework/rest"
 )
 
+var ErrCommandNotFound = errors.New("Device command not found")
+var ErrTransducerNotFound = errors.New("Device transducer not found")
+
+// CommandHandler handles an invocation of a device command, which carries the
+// command's value
+type CommandHandler func(value string) error
+
 // DeviceClient represents the context for a single user device session
 type DeviceClient struct {
 	Client
-	node rest.DeviceNode
+	node        rest.DeviceNode
+	commandLock sync.Mutex
+	// refreshed is the device info fetched after a command's transducer was
+	// not found in node, guarded by commandLock
+	refreshed *rest.DeviceNode
+	// command handlers by transducer topic and then by command value
+	commands map[string]map[string]CommandHandler
 }
 
 // StartDeviceClient starts the device client management layer
@@ -37,6 +56,12 @@ func (c *DeviceClient) Subscribe(subtopic string, callback ClientTopicHandler) e
 	return c.subscribe(c.node.Pubsub.Topic+"/"+subtopic, callback)
 }
 
+// SubscribeQoS registers a callback for receiving on a device subtopic using
+// the specified QoS
+func (c *DeviceClient) SubscribeQoS(subtopic string, qos pubsub.MQTTQoS, callback ClientTopicHandler) error {
+	return c.subscribeQoS(c.node.Pubsub.Topic+"/"+subtopic, qos, callback)
+}
+
 // Unsubscribe deregisters a callback for a given mqtt topics
 func (c *DeviceClient) Unsubscribe(subtopics ...string) error {
 	for i, subtopic := range subtopics {
@@ -49,3 +74,147 @@ func (c *DeviceClient) Unsubscribe(subtopics ...string) error {
 func (c *DeviceClient) Publish(subtopic string, payload interface{}) error {
 	return c.publish(c.node.Pubsub.Topic+"/"+subtopic, payload)
 }
+
+// PublishOpts publishes a payload to a given device subtopic using the
+// specified QoS and retained flag
+func (c *DeviceClient) PublishOpts(subtopic string, payload interface{}, qos pubsub.MQTTQoS, retained bool) error {
+	return c.publishOpts(c.node.Pubsub.Topic+"/"+subtopic, payload, qos, retained)
+}
+
+// PublishRetained publishes a payload to a given device subtopic and asks the
+// broker to retain it, so that late subscribers receive the last value
+func (c *DeviceClient) PublishRetained(subtopic string, payload interface{}) error {
+	return c.publishOpts(c.node.Pubsub.Topic+"/"+subtopic, payload, mqttQoS, true)
+}
+
+// ClearRetained clears the retained values held by the broker for the given
+// device subtopics
+func (c *DeviceClient) ClearRetained(subtopics ...string) error {
+	topics := make([]string, len(subtopics))
+	for i, subtopic := range subtopics {
+		topics[i] = c.node.Pubsub.Topic + "/" + subtopic
+	}
+	return c.clearRetained(topics...)
+}
+
+// Request publishes payload as a request to a device subtopic and waits for
+// the response. If ctx has no deadline, pubsub.DefaultRPCTimeout is used.
+// See pubsub.RPC for details.
+func (c *DeviceClient) Request(ctx context.Context, subtopic string, payload []byte) ([]byte, error) {
+	rpc, err := c.getRPC(c.node.Pubsub.Topic + "/" + rpcSubtopic)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.Request(ctx, c.node.Pubsub.Topic+"/"+subtopic, payload)
+}
+
+// HandleRequests serves requests received on a device subtopic using handler
+func (c *DeviceClient) HandleRequests(subtopic string, handler pubsub.RPCHandler) error {
+	rpc, err := c.getRPC(c.node.Pubsub.Topic + "/" + rpcSubtopic)
+	if err != nil {
+		return err
+	}
+	return rpc.HandleRequests(c.node.Pubsub.Topic+"/"+subtopic, handler)
+}
+
+// StopHandlingRequests stops serving requests on the given device subtopics
+func (c *DeviceClient) StopHandlingRequests(subtopics ...string) error {
+	rpc, err := c.getRPC(c.node.Pubsub.Topic + "/" + rpcSubtopic)
+	if err != nil {
+		return err
+	}
+	topics := make([]string, len(subtopics))
+	for i, subtopic := range subtopics {
+		topics[i] = c.node.Pubsub.Topic + "/" + subtopic
+	}
+	return rpc.StopHandlingRequests(topics...)
+}
+
+// HandleCommand calls handler whenever the device command named name is
+// executed. Executing a command publishes its value to the command's
+// transducer topic, so commands that share a transducer are told apart by
+// their values. Errors returned by handler are logged.
+func (c *DeviceClient) HandleCommand(name string, handler CommandHandler) error {
+	commands, err := c.host.DeviceCommandList(c.id)
+	if err != nil {
+		return err
+	}
+	var command *rest.DeviceCommand
+	for i := range commands {
+		if commands[i].Name == name {
+			command = &commands[i]
+			break
+		}
+	}
+	if command == nil {
+		return ErrCommandNotFound
+	}
+
+	// Resolve the command's topic without holding commandLock during
+	// requests, which would stall the dispatch of commands
+	c.commandLock.Lock()
+	transducer, ok := c.findTransducer(command.TransducerID)
+	c.commandLock.Unlock()
+	if !ok {
+		// The transducer may have been added after we started
+		node, err := c.host.RequestDeviceInfo(c.id)
+		if err != nil {
+			return err
+		}
+		c.commandLock.Lock()
+		c.refreshed = &node
+		transducer, ok = c.findTransducer(command.TransducerID)
+		c.commandLock.Unlock()
+		if !ok {
+			return ErrTransducerNotFound
+		}
+	}
+
+	topic := c.node.Pubsub.Topic + "/" + strings.ToLower(transducer.Name)
+	c.commandLock.Lock()
+	if c.commands == nil {
+		c.commands = make(map[string]map[string]CommandHandler)
+	}
+	if handlers, ok := c.commands[topic]; ok {
+		handlers[command.Value] = handler
+		c.commandLock.Unlock()
+		return nil
+	}
+	c.commands[topic] = map[string]CommandHandler{command.Value: handler}
+	c.commandLock.Unlock()
+
+	err = c.subscribe(topic, func(topic string, payload []byte) {
+		c.commandLock.Lock()
+		handler, ok := c.commands[topic][string(payload)]
+		c.commandLock.Unlock()
+		if !ok {
+			// A plain value or a command without a handler
+			return
+		}
+		if err := handler(string(payload)); err != nil {
+			c.logger().Printf("Failed to handle command on %s: %v", topic, err)
+		}
+	})
+	if err != nil {
+		c.commandLock.Lock()
+		delete(c.commands, topic)
+		c.commandLock.Unlock()
+	}
+	return err
+}
+
+// findTransducer returns the device's transducer with ID transducerID,
+// preferring the latest refreshed device info.
+// Must be called with c.commandLock held.
+func (c *DeviceClient) findTransducer(transducerID string) (rest.TransducerInfo, bool) {
+	transducers := c.node.Transducers
+	if c.refreshed != nil {
+		transducers = c.refreshed.Transducers
+	}
+	for _, transducer := range transducers {
+		if transducer.ID == transducerID {
+			return transducer, true
+		}
+	}
+	return rest.TransducerInfo{}, false
+}
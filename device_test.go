@@ -0,0 +1,95 @@
+package framework
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openchirp/framework/rest"
+)
+
+// topicMQTT is an mqttClient that lets the test deliver messages to
+// subscribed topics
+type topicMQTT struct {
+	mqttClient
+	callbacks map[string]func(topic string, payload []byte)
+}
+
+func (c *topicMQTT) Subscribe(topic string, callback func(topic string, payload []byte)) error {
+	c.callbacks[topic] = callback
+	return nil
+}
+
+func (c *topicMQTT) deliver(topic, payload string) {
+	if callback, ok := c.callbacks[topic]; ok {
+		callback(topic, []byte(payload))
+	}
+}
+
+func TestDeviceClient_HandleCommand(t *testing.T) {
+	topic := "openchirp/device/dev1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /apiv1/device/dev1/command":
+			json.NewEncoder(w).Encode([]rest.DeviceCommand{
+				{ID: "c1", Name: "On", TransducerID: "t1", Value: "1"},
+				{ID: "c2", Name: "Off", TransducerID: "t1", Value: "0"},
+				{ID: "c3", Name: "Reboot", TransducerID: "t2", Value: "now"},
+			})
+		case "GET /apiv1/device/dev1":
+			// Refreshed when a command uses a transducer added after start
+			json.NewEncoder(w).Encode(rest.DeviceNode{
+				NodeDescriptor: rest.NodeDescriptor{ID: "dev1", Pubsub: rest.PubSub{Topic: topic}},
+				Transducers: []rest.TransducerInfo{
+					{ID: "t1", Name: "Relay", IsActuable: true},
+					{ID: "t2", Name: "System", IsActuable: true},
+				},
+			})
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	mqtt := &topicMQTT{callbacks: make(map[string]func(string, []byte))}
+	c := new(DeviceClient)
+	c.id = "dev1"
+	c.host = rest.NewHost(server.URL)
+	c.mqtt = mqtt
+	c.node.Pubsub.Topic = topic
+	c.node.Transducers = []rest.TransducerInfo{{ID: "t1", Name: "Relay", IsActuable: true}}
+
+	var calls []string
+	record := func(command string) CommandHandler {
+		return func(value string) error {
+			calls = append(calls, command+"="+value)
+			return nil
+		}
+	}
+	for _, command := range []string{"On", "Off", "Reboot"} {
+		if err := c.HandleCommand(command, record(command)); err != nil {
+			t.Fatalf("Error handling command %s: %v", command, err)
+		}
+	}
+	if err := c.HandleCommand("Missing", record("Missing")); err != ErrCommandNotFound {
+		t.Fatalf("Expected ErrCommandNotFound, got %v", err)
+	}
+
+	mqtt.deliver(topic+"/relay", "1")
+	mqtt.deliver(topic+"/relay", "0")
+	mqtt.deliver(topic+"/relay", "25") // not a command value
+	mqtt.deliver(topic+"/system", "now")
+	expected := []string{"On=1", "Off=0", "Reboot=now"}
+	if !equalStringSlices(calls, expected) {
+		t.Fatalf("Expected command calls %v, got %v", expected, calls)
+	}
+
+	// Handler errors are only logged
+	if err := c.HandleCommand("On", func(value string) error { return errors.New("relay stuck") }); err != nil {
+		t.Fatal(err)
+	}
+	mqtt.deliver(topic+"/relay", "1")
+}
@@ -17,6 +17,54 @@ type links struct {
 	fwd []string
 	// subsubB --> subsubA
 	rev []string
+	// handler ids of the fwd and rev subscriptions, when supported by the
+	// underlying PubSub
+	fwdIDs map[string]SubscriptionID
+	revIDs map[string]SubscriptionID
+}
+
+func newLinks() links {
+	return links{
+		fwd:    make([]string, 0),
+		rev:    make([]string, 0),
+		fwdIDs: make(map[string]SubscriptionID),
+		revIDs: make(map[string]SubscriptionID),
+	}
+}
+
+// subscribe subscribes callback to topic on ps. If ps is a HandlerPubSub, only
+// the callback previously linked on topic is replaced, leaving any other
+// subscribers of topic intact.
+func subscribe(ps PubSub, ids map[string]SubscriptionID, topic string, callback func(topic string, payload []byte)) error {
+	hps, ok := ps.(HandlerPubSub)
+	if !ok {
+		return ps.Subscribe(topic, callback)
+	}
+	id, err := hps.SubscribeHandler(topic, callback)
+	if err != nil {
+		return err
+	}
+	if oldid, ok := ids[topic]; ok {
+		hps.UnsubscribeHandler(oldid)
+	}
+	ids[topic] = id
+	return nil
+}
+
+// unsubscribe removes the linked callbacks on topics from ps
+func unsubscribe(ps PubSub, ids map[string]SubscriptionID, topics ...string) error {
+	hps, ok := ps.(HandlerPubSub)
+	if !ok {
+		return ps.Unsubscribe(topics...)
+	}
+	hids := make([]SubscriptionID, 0, len(topics))
+	for _, topic := range topics {
+		if id, ok := ids[topic]; ok {
+			hids = append(hids, id)
+			delete(ids, topic)
+		}
+	}
+	return hps.UnsubscribeHandler(hids...)
 }
 
 func isIn(arr []string, str string) bool {
@@ -75,7 +123,7 @@ func (b *Bridge) IsLinkRev(deviceid, topicb string) bool {
 func (b *Bridge) AddLinkFwd(deviceid, topica string, topicb ...string) error {
 	ls, ok := b.devicelinks[deviceid]
 	if !ok {
-		ls = links{make([]string, 0), make([]string, 0)}
+		ls = newLinks()
 	}
 
 	// Mark down our link
@@ -84,7 +132,7 @@ func (b *Bridge) AddLinkFwd(deviceid, topica string, topicb ...string) error {
 	}
 
 	// Subscribe
-	err := b.pubsuba.Subscribe(topica, func(topic string, payload []byte) {
+	err := subscribe(b.pubsuba, ls.fwdIDs, topica, func(topic string, payload []byte) {
 		for _, tb := range topicb {
 			b.log.Debugf("Received on %s and publishing to %s", topic, tb)
 			if err := b.pubsubb.Publish(tb, payload); err != nil {
@@ -105,7 +153,7 @@ func (b *Bridge) AddLinkFwd(deviceid, topica string, topicb ...string) error {
 func (b *Bridge) AddFwd(deviceid, topica string, callback func(pubsubb PubSub, topica string, payload []byte) error) error {
 	ls, ok := b.devicelinks[deviceid]
 	if !ok {
-		ls = links{make([]string, 0), make([]string, 0)}
+		ls = newLinks()
 	}
 
 	// Mark down our link
@@ -113,7 +161,7 @@ func (b *Bridge) AddFwd(deviceid, topica string, callback func(pubsubb PubSub, t
 		ls.fwd = append(ls.fwd, topica)
 	}
 
-	err := b.pubsuba.Subscribe(topica, func(topic string, payload []byte) {
+	err := subscribe(b.pubsuba, ls.fwdIDs, topica, func(topic string, payload []byte) {
 		logitem := b.log.WithField("deviceid", deviceid).WithField("topica", topic)
 		logitem.Debugf("Running custom callback on received payload")
 		if err := callback(b.pubsubb, topic, payload); err != nil {
@@ -132,7 +180,7 @@ func (b *Bridge) AddFwd(deviceid, topica string, callback func(pubsubb PubSub, t
 func (b *Bridge) AddLinkRev(deviceid, topicb string, topica ...string) error {
 	ls, ok := b.devicelinks[deviceid]
 	if !ok {
-		ls = links{make([]string, 0), make([]string, 0)}
+		ls = newLinks()
 	}
 
 	// Mark down our link
@@ -141,7 +189,7 @@ func (b *Bridge) AddLinkRev(deviceid, topicb string, topica ...string) error {
 	}
 
 	// Subscribe
-	err := b.pubsubb.Subscribe(topicb, func(topic string, payload []byte) {
+	err := subscribe(b.pubsubb, ls.revIDs, topicb, func(topic string, payload []byte) {
 		for _, ta := range topica {
 			b.log.Debugf("Received on %s and publishing to %v", topic, ta)
 			if err := b.pubsuba.Publish(ta, payload); err != nil {
@@ -162,7 +210,7 @@ func (b *Bridge) AddLinkRev(deviceid, topicb string, topica ...string) error {
 func (b *Bridge) AddRev(deviceid, topicb string, callback func(pubsuba PubSub, topicb string, payload []byte) error) error {
 	ls, ok := b.devicelinks[deviceid]
 	if !ok {
-		ls = links{make([]string, 0), make([]string, 0)}
+		ls = newLinks()
 	}
 
 	// Mark down our link
@@ -170,7 +218,7 @@ func (b *Bridge) AddRev(deviceid, topicb string, callback func(pubsuba PubSub, t
 		ls.rev = append(ls.rev, topicb)
 	}
 
-	err := b.pubsubb.Subscribe(topicb, func(topic string, payload []byte) {
+	err := subscribe(b.pubsubb, ls.revIDs, topicb, func(topic string, payload []byte) {
 		logitem := b.log.WithField("deviceid", deviceid).WithField("topicb", topic)
 		logitem.Debugf("Running custom callback on received payload")
 		if err := callback(b.pubsubb, topic, payload); err != nil {
@@ -190,14 +238,14 @@ func (b *Bridge) RemoveLinksAll(deviceid string) error {
 	var err error
 	if ls, ok := b.devicelinks[deviceid]; ok {
 		if len(ls.fwd) > 0 {
-			e := b.pubsuba.Unsubscribe(ls.fwd...)
+			e := unsubscribe(b.pubsuba, ls.fwdIDs, ls.fwd...)
 			// save and return only first error
 			if e != nil && err == nil {
 				err = e
 			}
 		}
 		if len(ls.rev) > 0 {
-			e := b.pubsubb.Unsubscribe(ls.rev...)
+			e := unsubscribe(b.pubsubb, ls.revIDs, ls.rev...)
 			// save and return only first error
 			if e != nil && err == nil {
 				err = e
@@ -0,0 +1,569 @@
+//go:build mqtt5
+// +build mqtt5
+
+// The MQTT v5 client depends on github.com/eclipse/paho.golang v0.22.0,
+// which requires Go 1.21 or newer, so it is only built with the mqtt5 tag.
+
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	mqtt5KeepAlive      uint16 = 30
+	mqtt5ConnectTimeout        = 30 * time.Second
+	mqtt5OperationWait         = 30 * time.Second
+	// mqtt5ReasonFailure is the lowest reason code that indicates a failure
+	mqtt5ReasonFailure byte = 0x80
+)
+
+// MQTT5Options holds the MQTT v5 specific connection options
+type MQTT5Options struct {
+	// ClientIDPrefix is prepended to the random client id.
+	// The default is "client".
+	ClientIDPrefix string
+	// WillTopic and WillPayload set the will message, if WillTopic is not blank
+	WillTopic   string
+	WillPayload []byte
+	// NoLocal asks the broker to not send us messages we published ourselves.
+	// This is the standard replacement for the non-standard bridge flag used
+	// by NewMQTTBridgeClient.
+	NoLocal bool
+	// SessionExpiry is the time the broker should keep our session after
+	// disconnecting. Zero means the session ends with the connection.
+	SessionExpiry time.Duration
+	// Transport configures TLS and WebSocket connections to the broker
+	Transport MQTTTransport
+}
+
+// MQTT5PublishOptions holds the per message options and properties used
+// when publishing with MQTT v5
+type MQTT5PublishOptions struct {
+	QoS      MQTTQoS
+	Retained bool
+	// UserProperties are arbitrary key/value pairs sent with the message
+	UserProperties map[string]string
+	// MessageExpiry is the lifetime of the message at the broker.
+	// Zero means the message does not expire.
+	MessageExpiry time.Duration
+	// ResponseTopic and CorrelationData are used for request/response
+	ResponseTopic   string
+	CorrelationData []byte
+	ContentType     string
+}
+
+// MQTT5Message is a received message along with its MQTT v5 properties
+type MQTT5Message struct {
+	Topic           string
+	Payload         []byte
+	QoS             MQTTQoS
+	Retained        bool
+	UserProperties  map[string]string
+	ResponseTopic   string
+	CorrelationData []byte
+	ContentType     string
+}
+
+// MQTT5ReasonError is returned when the broker rejects an operation with
+// an MQTT v5 failure reason code
+type MQTT5ReasonError struct {
+	Op         string
+	Topic      string
+	ReasonCode byte
+}
+
+func (e *MQTT5ReasonError) Error() string {
+	return fmt.Sprintf("MQTT %s on %s failed with reason 0x%02x (%s)",
+		e.Op, e.Topic, e.ReasonCode, mqtt5ReasonString(e.ReasonCode))
+}
+
+// mqtt5ReasonString describes the common MQTT v5 failure reason codes
+func mqtt5ReasonString(code byte) string {
+	switch code {
+	case 0x80:
+		return "Unspecified error"
+	case 0x83:
+		return "Implementation specific error"
+	case 0x87:
+		return "Not authorized"
+	case 0x8F:
+		return "Topic filter invalid"
+	case 0x90:
+		return "Topic name invalid"
+	case 0x91:
+		return "Packet identifier in use"
+	case 0x97:
+		return "Quota exceeded"
+	case 0x99:
+		return "Payload format invalid"
+	case 0x9E:
+		return "Shared subscriptions not supported"
+	case 0xA1:
+		return "Subscription identifiers not supported"
+	case 0xA2:
+		return "Wildcard subscriptions not supported"
+	default:
+		return "Unknown reason"
+	}
+}
+
+// mqtt5Conn is the part of the autopaho connection manager used by
+// MQTT5Client
+type mqtt5Conn interface {
+	AwaitConnection(ctx context.Context) error
+	Disconnect(ctx context.Context) error
+	Subscribe(ctx context.Context, s *paho.Subscribe) (*paho.Suback, error)
+	Unsubscribe(ctx context.Context, u *paho.Unsubscribe) (*paho.Unsuback, error)
+	Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error)
+}
+
+// MQTT5Client is a PubSub implemented using the MQTT v5 protocol.
+// Besides the standard PubSub methods, it allows publishing and receiving
+// MQTT v5 message properties and using shared subscriptions.
+type MQTT5Client struct {
+	cm                 mqtt5Conn
+	defaultQoS         MQTTQoS
+	defaultPersistence bool
+	noLocal            bool
+	lock               sync.Mutex                  // lock to ensure topics is consistent with subs
+	topics             map[string]byte             // for reconnect subscriptions (byte is QoS)
+	router             *topicRouter                // dispatches messages to all matching callbacks
+	plain              map[string][]SubscriptionID // handlers registered by Subscribe, by topic
+	msgHandlers        sync.Map                    // SubscriptionID -> func(MQTT5Message)
+}
+
+// NewMQTT5Client creates and connects an MQTT v5 client that implements the
+// PubSub interface
+func NewMQTT5Client(
+	brokerURI, user, pass string,
+	defaultQoS MQTTQoS,
+	defaultPersistence bool,
+	opts MQTT5Options) (*MQTT5Client, error) {
+
+	c := newMQTT5Client(defaultQoS, defaultPersistence, opts.NoLocal)
+
+	/* Generate random client id for MQTT */
+	prefix := opts.ClientIDPrefix
+	if prefix == "" {
+		prefix = "client"
+	}
+	clientID, err := GenMQTTClientID(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if brokerURI == "" {
+		brokerURI = defaultBrokerURI
+	}
+	u, err := url.Parse(brokerURI)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{u},
+		KeepAlive:                     mqtt5KeepAlive,
+		ConnectTimeout:                mqtt5ConnectTimeout,
+		CleanStartOnInitialConnection: true,
+		SessionExpiryInterval:         uint32(opts.SessionExpiry / time.Second),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			c.resubscribe(cm)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          clientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){c.onPublish},
+		},
+		TlsCfg: opts.Transport.TLSConfig,
+		WebSocketCfg: &autopaho.WebSocketConfig{
+			Dialer: opts.Transport.websocketDialer,
+			Header: opts.Transport.websocketHeader,
+		},
+	}
+	// The spec allows a username without password, but not the reverse
+	if len(user) > 0 {
+		cfg.ConnectUsername = user
+		cfg.ConnectPassword = []byte(pass)
+	}
+	if opts.WillTopic != "" {
+		cfg.WillMessage = &paho.WillMessage{
+			Topic:   opts.WillTopic,
+			Payload: opts.WillPayload,
+			QoS:     byte(defaultQoS),
+			Retain:  defaultPersistence,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5ConnectTimeout)
+	defer cancel()
+
+	cm, err := autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.cm = cm
+	if err := c.cm.AwaitConnection(ctx); err != nil {
+		c.cm.Disconnect(context.Background())
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// newMQTT5Client creates an MQTT5Client without a connection
+func newMQTT5Client(defaultQoS MQTTQoS, defaultPersistence, noLocal bool) *MQTT5Client {
+	c := new(MQTT5Client)
+	c.defaultQoS = defaultQoS
+	c.defaultPersistence = defaultPersistence
+	c.noLocal = noLocal
+	c.topics = make(map[string]byte)
+	c.router = newTopicRouter()
+	c.plain = make(map[string][]SubscriptionID)
+	return c
+}
+
+// websocketDialer returns the dialer used by the MQTT v5 client to open
+// WebSocket connections
+func (t MQTTTransport) websocketDialer(u *url.URL, tlsCfg *tls.Config) *websocket.Dialer {
+	return &websocket.Dialer{
+		Proxy:            t.proxy(),
+		HandshakeTimeout: websocketHandshakeTimeout,
+		TLSClientConfig:  tlsCfg,
+		Subprotocols:     []string{websocketSubprotocol},
+	}
+}
+
+// websocketHeader returns the headers used by the MQTT v5 client during the
+// WebSocket handshake
+func (t MQTTTransport) websocketHeader(u *url.URL, tlsCfg *tls.Config) http.Header {
+	return t.HTTPHeaders
+}
+
+// resubscribe is called when the connection is made initially and on
+// reconnect, in order to resubscribe to the topics we originally
+// subscribed to
+func (c *MQTT5Client) resubscribe(cm mqtt5Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.topics) == 0 {
+		return
+	}
+	sub := &paho.Subscribe{}
+	for topic, qos := range c.topics {
+		sub.Subscriptions = append(sub.Subscriptions, c.subscribeOptions(topic, MQTTQoS(qos)))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5OperationWait)
+	defer cancel()
+	cm.Subscribe(ctx, sub)
+}
+
+// onPublish dispatches received messages to all matching callbacks
+func (c *MQTT5Client) onPublish(pr paho.PublishReceived) (bool, error) {
+	p := pr.Packet
+	msg := MQTT5Message{
+		Topic:    p.Topic,
+		Payload:  p.Payload,
+		QoS:      MQTTQoS(p.QoS),
+		Retained: p.Retain,
+	}
+	if p.Properties != nil {
+		msg.ResponseTopic = p.Properties.ResponseTopic
+		msg.CorrelationData = p.Properties.CorrelationData
+		msg.ContentType = p.Properties.ContentType
+		if len(p.Properties.User) > 0 {
+			msg.UserProperties = make(map[string]string, len(p.Properties.User))
+			for _, prop := range p.Properties.User {
+				msg.UserProperties[prop.Key] = prop.Value
+			}
+		}
+	}
+
+	for _, h := range c.router.match(msg.Topic) {
+		if mh, ok := c.msgHandlers.Load(h.id); ok {
+			mh.(func(MQTT5Message))(msg)
+		} else {
+			h.callback(msg.Topic, msg.Payload)
+		}
+	}
+	return true, nil
+}
+
+func (c *MQTT5Client) subscribeOptions(topic string, qos MQTTQoS) paho.SubscribeOptions {
+	return paho.SubscribeOptions{
+		Topic: topic,
+		QoS:   byte(qos),
+		// The broker rejects NoLocal on shared subscriptions
+		NoLocal: c.noLocal && !isSharedTopic(topic),
+	}
+}
+
+// Disconnect gracefully disconnects from the broker
+func (c *MQTT5Client) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(disconnectWaitMS)*time.Millisecond)
+	defer cancel()
+	c.cm.Disconnect(ctx)
+}
+
+// Subscribe registers callback to receive messages published on topic using
+// the client's default QoS. The callback is removed by Unsubscribe.
+func (c *MQTT5Client) Subscribe(topic string, callback func(topic string, payload []byte)) error {
+	return c.SubscribeQoS(topic, c.defaultQoS, callback)
+}
+
+// SubscribeQoS registers callback to receive messages published on topic
+// using the specified QoS. The callback is removed by Unsubscribe.
+func (c *MQTT5Client) SubscribeQoS(topic string, qos MQTTQoS, callback func(topic string, payload []byte)) error {
+	id, err := c.SubscribeHandlerQoS(topic, qos, callback)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.plain[topic] = append(c.plain[topic], id)
+	return nil
+}
+
+// SubscribeHandler registers callback to receive messages published on topic
+// using the client's default QoS. The returned SubscriptionID can be given to
+// UnsubscribeHandler to remove only this callback.
+func (c *MQTT5Client) SubscribeHandler(topic string, callback func(topic string, payload []byte)) (SubscriptionID, error) {
+	return c.SubscribeHandlerQoS(topic, c.defaultQoS, callback)
+}
+
+// SubscribeHandlerQoS registers callback to receive messages published on
+// topic using the specified QoS. See MQTTClient.SubscribeHandlerQoS.
+func (c *MQTT5Client) SubscribeHandlerQoS(topic string, qos MQTTQoS, callback func(topic string, payload []byte)) (SubscriptionID, error) {
+	if err := ValidateTopicFilter(topic); err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Register with the router first, so that retained messages are not missed
+	id := c.router.add(topic, callback)
+	if err := c.subscribe(topic, qos); err != nil {
+		c.router.remove(id)
+		return 0, err
+	}
+	return id, nil
+}
+
+// SubscribeMessage registers callback to receive messages published on topic,
+// along with their MQTT v5 properties
+func (c *MQTT5Client) SubscribeMessage(topic string, qos MQTTQoS, callback func(msg MQTT5Message)) (SubscriptionID, error) {
+	if err := ValidateTopicFilter(topic); err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	id := c.router.add(topic, nil)
+	c.msgHandlers.Store(id, callback)
+	if err := c.subscribe(topic, qos); err != nil {
+		c.router.remove(id)
+		c.msgHandlers.Delete(id)
+		return 0, err
+	}
+	return id, nil
+}
+
+// SubscribeShared registers callback on a shared subscription of topic.
+// Each message is delivered to only one of the clients subscribed with the
+// same group.
+func (c *MQTT5Client) SubscribeShared(group, topic string, qos MQTTQoS, callback func(topic string, payload []byte)) (SubscriptionID, error) {
+	if err := ValidateTopicFilter(topic); err != nil {
+		return 0, err
+	}
+	if err := validShareGroup(group); err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	id := c.router.add(SharedTopic(group, topic), callback)
+	if err := c.subscribe(SharedTopic(group, topic), qos); err != nil {
+		c.router.remove(id)
+		return 0, err
+	}
+	return id, nil
+}
+
+// subscribe makes the broker subscription for filter.
+// The caller must hold c.lock.
+func (c *MQTT5Client) subscribe(filter string, qos MQTTQoS) error {
+	if current, ok := c.topics[filter]; ok && current > byte(qos) {
+		qos = MQTTQoS(current)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5OperationWait)
+	defer cancel()
+	suback, err := c.cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{c.subscribeOptions(filter, qos)},
+	})
+	if err != nil {
+		return err
+	}
+	if suback != nil && len(suback.Reasons) > 0 && suback.Reasons[0] >= mqtt5ReasonFailure {
+		return &MQTT5ReasonError{Op: "subscribe", Topic: filter, ReasonCode: suback.Reasons[0]}
+	}
+
+	c.topics[filter] = byte(qos)
+	return nil
+}
+
+// unsubscribe removes the broker subscriptions for filters.
+// The caller must hold c.lock.
+func (c *MQTT5Client) unsubscribe(filters ...string) error {
+	if len(filters) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5OperationWait)
+	defer cancel()
+	unsuback, err := c.cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: filters})
+	if err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		delete(c.topics, filter)
+	}
+	if unsuback != nil {
+		for i, reason := range unsuback.Reasons {
+			if reason >= mqtt5ReasonFailure && i < len(filters) {
+				return &MQTT5ReasonError{Op: "unsubscribe", Topic: filters[i], ReasonCode: reason}
+			}
+		}
+	}
+	return nil
+}
+
+// Unsubscribe deregisters the callbacks registered on the given topics by
+// Subscribe and SubscribeQoS. See MQTTClient.Unsubscribe.
+func (c *MQTT5Client) Unsubscribe(topics ...string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var unused []string
+	for _, topic := range topics {
+		for _, id := range c.plain[topic] {
+			c.router.remove(id)
+		}
+		delete(c.plain, topic)
+		if _, ok := c.topics[topic]; ok && c.router.count(topic) == 0 {
+			unused = append(unused, topic)
+		}
+	}
+	return c.unsubscribe(unused...)
+}
+
+// UnsubscribeHandler deregisters the callbacks identified by ids.
+// The broker subscription for a topic is only removed once the last callback
+// on that topic has been deregistered.
+func (c *MQTT5Client) UnsubscribeHandler(ids ...SubscriptionID) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var filters []string
+	for _, id := range ids {
+		c.msgHandlers.Delete(id)
+		if filter, remaining, ok := c.router.remove(id); ok && remaining == 0 {
+			filters = append(filters, filter)
+		}
+	}
+	return c.unsubscribe(filters...)
+}
+
+// Publish publishes payload to topic using the client's default QoS and
+// retained setting
+func (c *MQTT5Client) Publish(topic string, payload interface{}) error {
+	return c.PublishOpts(topic, payload, c.defaultQoS, c.defaultPersistence)
+}
+
+// PublishOpts publishes payload to topic using the specified QoS and
+// retained flag
+func (c *MQTT5Client) PublishOpts(topic string, payload interface{}, qos MQTTQoS, retained bool) error {
+	buf, err := payloadBytes(payload)
+	if err != nil {
+		return err
+	}
+	return c.PublishMessage(topic, buf, MQTT5PublishOptions{QoS: qos, Retained: retained})
+}
+
+// PublishMessage publishes payload to topic with the given MQTT v5 options
+// and properties
+func (c *MQTT5Client) PublishMessage(topic string, payload []byte, opts MQTT5PublishOptions) error {
+	pub := &paho.Publish{
+		Topic:   topic,
+		QoS:     byte(opts.QoS),
+		Retain:  opts.Retained,
+		Payload: payload,
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   opts.ResponseTopic,
+			CorrelationData: opts.CorrelationData,
+			ContentType:     opts.ContentType,
+		},
+	}
+	if opts.MessageExpiry > 0 {
+		expiry := uint32(opts.MessageExpiry / time.Second)
+		pub.Properties.MessageExpiry = &expiry
+	}
+	for key, value := range opts.UserProperties {
+		pub.Properties.User.Add(key, value)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5OperationWait)
+	defer cancel()
+	if err := c.cm.AwaitConnection(ctx); err != nil {
+		return err
+	}
+	resp, err := c.cm.Publish(ctx, pub)
+	if err != nil {
+		return err
+	}
+	if resp != nil && resp.ReasonCode >= mqtt5ReasonFailure {
+		return &MQTT5ReasonError{Op: "publish", Topic: topic, ReasonCode: resp.ReasonCode}
+	}
+	return nil
+}
+
+// ClearRetained removes the retained message held by the broker for each of
+// the given topics
+func (c *MQTT5Client) ClearRetained(topics ...string) error {
+	for _, topic := range topics {
+		if err := c.PublishOpts(topic, []byte{}, c.defaultQoS, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// payloadBytes converts the payload types accepted by Publish into bytes
+func payloadBytes(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case []byte:
+		return p, nil
+	case string:
+		return []byte(p), nil
+	case bytes.Buffer:
+		return p.Bytes(), nil
+	case *bytes.Buffer:
+		return p.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("Unknown payload type %T", payload)
+	}
+}
@@ -0,0 +1,200 @@
+//go:build mqtt5
+// +build mqtt5
+
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// fakeMQTT5Conn is an mqtt5Conn that records subscriptions and publishes and
+// answers with the configured reason codes
+type fakeMQTT5Conn struct {
+	lock          sync.Mutex
+	subscribes    []paho.SubscribeOptions
+	unsubscribes  []string
+	publishes     []*paho.Publish
+	subackReason  byte
+	publishReason byte
+}
+
+func (f *fakeMQTT5Conn) AwaitConnection(ctx context.Context) error { return nil }
+
+func (f *fakeMQTT5Conn) Disconnect(ctx context.Context) error { return nil }
+
+func (f *fakeMQTT5Conn) Subscribe(ctx context.Context, s *paho.Subscribe) (*paho.Suback, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.subscribes = append(f.subscribes, s.Subscriptions...)
+	suback := &paho.Suback{}
+	for range s.Subscriptions {
+		suback.Reasons = append(suback.Reasons, f.subackReason)
+	}
+	return suback, nil
+}
+
+func (f *fakeMQTT5Conn) Unsubscribe(ctx context.Context, u *paho.Unsubscribe) (*paho.Unsuback, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.unsubscribes = append(f.unsubscribes, u.Topics...)
+	return &paho.Unsuback{Reasons: make([]byte, len(u.Topics))}, nil
+}
+
+func (f *fakeMQTT5Conn) Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.publishes = append(f.publishes, p)
+	return &paho.PublishResponse{ReasonCode: f.publishReason}, nil
+}
+
+// newFakeMQTT5Client returns an MQTT5Client connected to a fake connection
+func newFakeMQTT5Client(noLocal bool) (*MQTT5Client, *fakeMQTT5Conn) {
+	conn := new(fakeMQTT5Conn)
+	c := newMQTT5Client(QoSExactlyOnce, false, noLocal)
+	c.cm = conn
+	return c, conn
+}
+
+// receive delivers a message to the client as if it came from the broker
+func (c *MQTT5Client) receive(p *paho.Publish) {
+	c.onPublish(paho.PublishReceived{Packet: p})
+}
+
+func TestMQTT5Client_SubscribeUnsubscribe(t *testing.T) {
+	c, conn := newFakeMQTT5Client(true)
+
+	var plain, handler []string
+	if err := c.SubscribeQoS("site/+/rawrx", QoSAtLeastOnce, func(topic string, payload []byte) {
+		plain = append(plain, topic)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := c.SubscribeHandler("site/+/rawrx", func(topic string, payload []byte) {
+		handler = append(handler, topic)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.SubscribeShared("workers", "site/#", QoSAtMostOnce, func(topic string, payload []byte) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The QoS of a topic is only ever raised and the broker rejects NoLocal
+	// on shared subscriptions
+	expected := []paho.SubscribeOptions{
+		{Topic: "site/+/rawrx", QoS: byte(QoSAtLeastOnce), NoLocal: true},
+		{Topic: "site/+/rawrx", QoS: byte(QoSExactlyOnce), NoLocal: true},
+		{Topic: "$share/workers/site/#", QoS: byte(QoSAtMostOnce)},
+	}
+	if len(conn.subscribes) != len(expected) {
+		t.Fatalf("Expected subscribes %+v, got %+v", expected, conn.subscribes)
+	}
+	for i := range expected {
+		if conn.subscribes[i] != expected[i] {
+			t.Errorf("Expected subscribe %+v, got %+v", expected[i], conn.subscribes[i])
+		}
+	}
+
+	c.receive(&paho.Publish{Topic: "site/1/rawrx", Payload: []byte("1")})
+	if !equalStrings(plain, []string{"site/1/rawrx"}) || !equalStrings(handler, []string{"site/1/rawrx"}) {
+		t.Fatalf("Expected both callbacks to receive the message, got %v and %v", plain, handler)
+	}
+
+	// Unsubscribe only removes the Subscribe callback and keeps the broker
+	// subscription for the remaining handler
+	if err := c.Unsubscribe("site/+/rawrx"); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.unsubscribes) != 0 {
+		t.Fatalf("Expected the broker subscription to be kept, got unsubscribes %v", conn.unsubscribes)
+	}
+	c.receive(&paho.Publish{Topic: "site/2/rawrx", Payload: []byte("2")})
+	if len(plain) != 1 || len(handler) != 2 {
+		t.Fatalf("Expected only the remaining handler to receive the message, got %v and %v", plain, handler)
+	}
+
+	if err := c.UnsubscribeHandler(id); err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(conn.unsubscribes, []string{"site/+/rawrx"}) {
+		t.Fatalf("Expected the broker subscription to be removed, got unsubscribes %v", conn.unsubscribes)
+	}
+
+	// Reconnecting resubscribes to the remaining topics
+	conn.subscribes = nil
+	c.resubscribe(conn)
+	if len(conn.subscribes) != 1 || conn.subscribes[0].Topic != "$share/workers/site/#" {
+		t.Fatalf("Expected to resubscribe to the shared topic, got %+v", conn.subscribes)
+	}
+}
+
+func TestMQTT5Client_Messages(t *testing.T) {
+	c, conn := newFakeMQTT5Client(false)
+
+	err := c.PublishMessage("site/1/cmd", []byte("reboot"), MQTT5PublishOptions{
+		QoS:             QoSAtLeastOnce,
+		Retained:        true,
+		UserProperties:  map[string]string{"source": "test"},
+		ResponseTopic:   "site/1/reply",
+		CorrelationData: []byte("42"),
+		ContentType:     "text/plain",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := conn.publishes[0]
+	if p.Topic != "site/1/cmd" || string(p.Payload) != "reboot" || p.QoS != byte(QoSAtLeastOnce) || !p.Retain {
+		t.Fatalf("Unexpected publish %+v", p)
+	}
+	props := p.Properties
+	if props.ResponseTopic != "site/1/reply" || string(props.CorrelationData) != "42" || props.ContentType != "text/plain" {
+		t.Fatalf("Unexpected publish properties %+v", props)
+	}
+	if len(props.User) != 1 || props.User[0].Key != "source" || props.User[0].Value != "test" {
+		t.Fatalf("Unexpected user properties %+v", props.User)
+	}
+
+	var received MQTT5Message
+	if _, err := c.SubscribeMessage("site/1/reply", QoSAtLeastOnce, func(msg MQTT5Message) {
+		received = msg
+	}); err != nil {
+		t.Fatal(err)
+	}
+	reply := &paho.Publish{
+		Topic:   "site/1/reply",
+		Payload: []byte("ok"),
+		Properties: &paho.PublishProperties{
+			CorrelationData: []byte("42"),
+			User:            paho.UserProperties{{Key: "status", Value: "done"}},
+		},
+	}
+	c.receive(reply)
+	if received.Topic != "site/1/reply" || string(received.Payload) != "ok" ||
+		string(received.CorrelationData) != "42" || received.UserProperties["status"] != "done" {
+		t.Fatalf("Unexpected received message %+v", received)
+	}
+}
+
+func TestMQTT5Client_ReasonErrors(t *testing.T) {
+	c, conn := newFakeMQTT5Client(false)
+
+	conn.subackReason = 0x87
+	err := c.Subscribe("site/1/rawrx", func(topic string, payload []byte) {})
+	if reasonErr, ok := err.(*MQTT5ReasonError); !ok || reasonErr.Op != "subscribe" || reasonErr.ReasonCode != 0x87 {
+		t.Fatalf("Expected a subscribe reason error, got %v", err)
+	}
+	// A rejected subscription is not kept for reconnects
+	if _, ok := c.topics["site/1/rawrx"]; ok {
+		t.Fatal("Expected the rejected subscription to be forgotten")
+	}
+
+	conn.publishReason = 0x97
+	err = c.Publish("site/1/rawtx", "1")
+	if reasonErr, ok := err.(*MQTT5ReasonError); !ok || reasonErr.Op != "publish" || reasonErr.ReasonCode != 0x97 {
+		t.Fatalf("Expected a publish reason error, got %v", err)
+	}
+}
@@ -24,11 +24,13 @@ type MQTTClient struct {
 	mqtt               PahoMQTT.Client
 	defaultQoS         MQTTQoS
 	defaultPersistence bool
-	lock               sync.Mutex      // lock to ensure topics is consistent with subs
-	topics             map[string]byte // for reconnect subscriptions (byte is QoS)
-	publock            sync.RWMutex    // lock for publish to check for connected
-	connectedSubs      sync.Cond       // onConnect signal for subscribers and unsubscribers
-	connectedPubs      sync.Cond       // onConnect signal for publishers
+	lock               sync.Mutex                  // lock to ensure topics is consistent with subs
+	topics             map[string]byte             // for reconnect subscriptions (byte is QoS)
+	router             *topicRouter                // dispatches messages to all matching callbacks
+	plain              map[string][]SubscriptionID // handlers registered by Subscribe, by topic
+	publock            sync.RWMutex                // lock for publish to check for connected
+	connectedSubs      sync.Cond                   // onConnect signal for subscribers and unsubscribers
+	connectedPubs      sync.Cond                   // onConnect signal for publishers
 }
 
 type MQTTQoS byte
@@ -62,50 +64,29 @@ func GenMQTTClientID(prefix string) (string, error) {
 	return prefix + r.String(), nil
 }
 
+// MQTTOptions holds the optional connection settings used by
+// NewMQTTClientWithOptions
+type MQTTOptions struct {
+	// ClientIDPrefix is prepended to the random client id.
+	// The default is "client", or "bridge" for bridge clients.
+	ClientIDPrefix string
+	// WillTopic and WillPayload set the will message, if WillTopic is not blank
+	WillTopic   string
+	WillPayload []byte
+	// Bridge indicates to the broker that we are operating as an MQTT bridge.
+	// See NewMQTTBridgeClient.
+	Bridge bool
+	// Transport configures TLS and WebSocket connections to the broker
+	Transport MQTTTransport
+}
+
 // NewMQTTClient creates and connects an MQTT client that implements the
 // PubSub interface
 func NewMQTTClient(
 	brokerURI, user, pass string,
 	defaultQoS MQTTQoS,
 	defaultPersistence bool) (*MQTTClient, error) {
-
-	c := new(MQTTClient)
-	c.defaultQoS = defaultQoS
-	c.defaultPersistence = defaultPersistence
-	c.topics = make(map[string]byte)
-	c.connectedSubs.L = &c.lock
-	c.connectedPubs.L = c.publock.RLocker()
-
-	/* Generate random client id for MQTT */
-	clientID, err := GenMQTTClientID("client")
-	if err != nil {
-		return nil, err
-	}
-
-	/* Connect the MQTT connection */
-	opts := PahoMQTT.NewClientOptions()
-	if brokerURI == "" {
-		brokerURI = defaultBrokerURI
-	}
-	opts.AddBroker(brokerURI)
-	opts.SetClientID(clientID)
-	// http://www.hivemq.com/blog/mqtt-security-fundamentals-authentication-username-password:
-	//   "The spec also states that a username without password is possible.
-	//    It’s not possible to just send a password without username."
-	if len(user) > 0 {
-		// we do not allow absent passwords yet
-		opts.SetUsername(user).SetPassword(pass)
-	}
-	opts.SetAutoReconnect(AutoReconnect)
-	opts.SetOnConnectHandler(c.onConnect)
-
-	/* Create and start a client using the above ClientOptions */
-	c.mqtt = PahoMQTT.NewClient(opts)
-	if token := c.mqtt.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
-	}
-
-	return c, nil
+	return NewMQTTClientWithOptions(brokerURI, user, pass, defaultQoS, defaultPersistence, MQTTOptions{})
 }
 
 // NewMQTTWillClient creates and connects an MQTT client that implements the
@@ -116,47 +97,10 @@ func NewMQTTWillClient(
 	defaultPersistence bool,
 	willTopic string,
 	willPayload []byte) (*MQTTClient, error) {
-
-	c := new(MQTTClient)
-	c.defaultQoS = defaultQoS
-	c.defaultPersistence = defaultPersistence
-	c.topics = make(map[string]byte)
-	c.connectedSubs.L = &c.lock
-	c.connectedPubs.L = c.publock.RLocker()
-
-	/* Generate random client id for MQTT */
-	clientID, err := GenMQTTClientID("client")
-	if err != nil {
-		return nil, err
-	}
-
-	/* Connect the MQTT connection */
-	opts := PahoMQTT.NewClientOptions()
-	if brokerURI == "" {
-		brokerURI = defaultBrokerURI
-	}
-	opts.AddBroker(brokerURI)
-	opts.SetClientID(clientID)
-	// http://www.hivemq.com/blog/mqtt-security-fundamentals-authentication-username-password:
-	//   "The spec also states that a username without password is possible.
-	//    It’s not possible to just send a password without username."
-	if len(user) > 0 {
-		// we do not allow absent passwords yet
-		opts.SetUsername(user).SetPassword(pass)
-	}
-	opts.SetAutoReconnect(AutoReconnect)
-	opts.SetOnConnectHandler(c.onConnect)
-	if willTopic != "" {
-		opts.SetBinaryWill(willTopic, willPayload, byte(defaultQoS), defaultPersistence)
-	}
-
-	/* Create and start a client using the above ClientOptions */
-	c.mqtt = PahoMQTT.NewClient(opts)
-	if token := c.mqtt.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
-	}
-
-	return c, nil
+	return NewMQTTClientWithOptions(brokerURI, user, pass, defaultQoS, defaultPersistence, MQTTOptions{
+		WillTopic:   willTopic,
+		WillPayload: willPayload,
+	})
 }
 
 // NewMQTTBridgeClient creates and connects an MQTT client that implements the
@@ -171,45 +115,9 @@ func NewMQTTBridgeClient(
 	brokerURI, user, pass string,
 	defaultQoS MQTTQoS,
 	defaultPersistence bool) (*MQTTClient, error) {
-
-	c := new(MQTTClient)
-	c.defaultQoS = defaultQoS
-	c.defaultPersistence = defaultPersistence
-	c.topics = make(map[string]byte)
-	c.connectedSubs.L = &c.lock
-	c.connectedPubs.L = c.publock.RLocker()
-
-	/* Generate random client id for MQTT */
-	clientID, err := GenMQTTClientID("bridge")
-	if err != nil {
-		return nil, err
-	}
-
-	/* Connect the MQTT connection */
-	opts := PahoMQTT.NewClientOptions()
-	if brokerURI == "" {
-		brokerURI = defaultBrokerURI
-	}
-	opts.AddBroker(brokerURI)
-	opts.SetClientID(clientID)
-	// http://www.hivemq.com/blog/mqtt-security-fundamentals-authentication-username-password:
-	//   "The spec also states that a username without password is possible.
-	//    It’s not possible to just send a password without username."
-	if len(user) > 0 {
-		// we do not allow absent passwords yet
-		opts.SetUsername(user).SetPassword(pass)
-	}
-	opts.SetAutoReconnect(AutoReconnect)
-	opts.SetOnConnectHandler(c.onConnect)
-	opts.SetProtocolVersion(4 | 0x80) // indicate bridge
-
-	/* Create and start a client using the above ClientOptions */
-	c.mqtt = PahoMQTT.NewClient(opts)
-	if token := c.mqtt.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
-	}
-
-	return c, nil
+	return NewMQTTClientWithOptions(brokerURI, user, pass, defaultQoS, defaultPersistence, MQTTOptions{
+		Bridge: true,
+	})
 }
 
 // NewMQTTWillBridgeClient creates and connects an MQTT client that implements
@@ -227,16 +135,41 @@ func NewMQTTWillBridgeClient(
 	defaultPersistence bool,
 	willTopic string,
 	willPayload []byte) (*MQTTClient, error) {
+	return NewMQTTClientWithOptions(brokerURI, user, pass, defaultQoS, defaultPersistence, MQTTOptions{
+		WillTopic:   willTopic,
+		WillPayload: willPayload,
+		Bridge:      true,
+	})
+}
+
+// NewMQTTClientWithOptions creates and connects an MQTT client that
+// implements the PubSub interface using the given options.
+// This is the constructor to use for ws:// and wss:// brokers that need
+// custom handshake headers, a proxy, or TLS settings.
+func NewMQTTClientWithOptions(
+	brokerURI, user, pass string,
+	defaultQoS MQTTQoS,
+	defaultPersistence bool,
+	options MQTTOptions) (*MQTTClient, error) {
 
 	c := new(MQTTClient)
 	c.defaultQoS = defaultQoS
 	c.defaultPersistence = defaultPersistence
 	c.topics = make(map[string]byte)
+	c.router = newTopicRouter()
+	c.plain = make(map[string][]SubscriptionID)
 	c.connectedSubs.L = &c.lock
 	c.connectedPubs.L = c.publock.RLocker()
 
 	/* Generate random client id for MQTT */
-	clientID, err := GenMQTTClientID("bridge")
+	prefix := options.ClientIDPrefix
+	if prefix == "" {
+		prefix = "client"
+		if options.Bridge {
+			prefix = "bridge"
+		}
+	}
+	clientID, err := GenMQTTClientID(prefix)
 	if err != nil {
 		return nil, err
 	}
@@ -257,9 +190,15 @@ func NewMQTTWillBridgeClient(
 	}
 	opts.SetAutoReconnect(AutoReconnect)
 	opts.SetOnConnectHandler(c.onConnect)
-	opts.SetProtocolVersion(4 | 0x80) // indicate bridge
-	if willTopic != "" {
-		opts.SetBinaryWill(willTopic, willPayload, byte(defaultQoS), defaultPersistence)
+	opts.SetDefaultPublishHandler(c.onMessage)
+	if options.Bridge {
+		opts.SetProtocolVersion(4 | 0x80) // indicate bridge
+	}
+	if options.WillTopic != "" {
+		opts.SetBinaryWill(options.WillTopic, options.WillPayload, byte(defaultQoS), defaultPersistence)
+	}
+	if err := options.Transport.apply(opts, brokerURI); err != nil {
+		return nil, err
 	}
 
 	/* Create and start a client using the above ClientOptions */
@@ -297,6 +236,13 @@ func (c *MQTTClient) onConnect(client PahoMQTT.Client) {
 	c.connectedPubs.Broadcast()
 }
 
+// onMessage is the single Paho MQTT message handler for all subscriptions.
+// Received messages are dispatched to all callbacks whose topic filter
+// matches by the internal router.
+func (c *MQTTClient) onMessage(client PahoMQTT.Client, msg PahoMQTT.Message) {
+	c.router.dispatch(msg.Topic(), msg.Payload())
+}
+
 func (c *MQTTClient) Disconnect() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -304,7 +250,67 @@ func (c *MQTTClient) Disconnect() {
 	c.mqtt.Disconnect(disconnectWaitMS)
 }
 
+// Subscribe registers callback to receive messages published on topic using
+// the client's default QoS.
+// Subscribing multiple times to the same or overlapping topics registers
+// independent callbacks, which will all receive matching messages.
+// The callback is removed by Unsubscribe.
 func (c *MQTTClient) Subscribe(topic string, callback func(topic string, payload []byte)) error {
+	return c.SubscribeQoS(topic, c.defaultQoS, callback)
+}
+
+// SubscribeQoS registers callback to receive messages published on topic
+// using the specified QoS. The callback is removed by Unsubscribe.
+func (c *MQTTClient) SubscribeQoS(topic string, qos MQTTQoS, callback func(topic string, payload []byte)) error {
+	if err := ValidateTopicFilter(topic); err != nil {
+		return err
+	}
+	_, err := c.subscribe(topic, qos, callback, true)
+	return err
+}
+
+// SubscribeHandler registers callback to receive messages published on topic
+// using the client's default QoS. The returned SubscriptionID can be given to
+// UnsubscribeHandler to remove only this callback.
+func (c *MQTTClient) SubscribeHandler(topic string, callback func(topic string, payload []byte)) (SubscriptionID, error) {
+	return c.SubscribeHandlerQoS(topic, c.defaultQoS, callback)
+}
+
+// SubscribeHandlerQoS registers callback to receive messages published on
+// topic using the specified QoS. The returned SubscriptionID can be given to
+// UnsubscribeHandler to remove only this callback.
+//
+// The broker subscription is shared by all callbacks on the same topic and
+// uses the highest QoS requested. Note that every call resubscribes with the
+// broker, so callbacks already registered on topic may see retained
+// messages again.
+func (c *MQTTClient) SubscribeHandlerQoS(topic string, qos MQTTQoS, callback func(topic string, payload []byte)) (SubscriptionID, error) {
+	if err := ValidateTopicFilter(topic); err != nil {
+		return 0, err
+	}
+	return c.subscribe(topic, qos, callback, false)
+}
+
+// SubscribeShared registers callback on a shared subscription of topic.
+// Each message is delivered to only one of the clients subscribed with the
+// same group. The returned SubscriptionID can be given to UnsubscribeHandler
+// to remove only this callback.
+// Note, shared subscriptions are an MQTT v5 feature that many brokers also
+// offer to MQTT v3.1.1 clients.
+func (c *MQTTClient) SubscribeShared(group, topic string, qos MQTTQoS, callback func(topic string, payload []byte)) (SubscriptionID, error) {
+	if err := ValidateTopicFilter(topic); err != nil {
+		return 0, err
+	}
+	if err := validShareGroup(group); err != nil {
+		return 0, err
+	}
+	return c.subscribe(SharedTopic(group, topic), qos, callback, false)
+}
+
+// subscribe registers callback with the router and makes the broker
+// subscription for filter. If plain is true, the callback is removed by
+// Unsubscribe.
+func (c *MQTTClient) subscribe(filter string, qos MQTTQoS, callback func(topic string, payload []byte), plain bool) (SubscriptionID, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -312,22 +318,82 @@ func (c *MQTTClient) Subscribe(topic string, callback func(topic string, payload
 		c.connectedSubs.Wait()
 	}
 
-	token := c.mqtt.Subscribe(topic, byte(c.defaultQoS), func(client PahoMQTT.Client, msg PahoMQTT.Message) {
-		callback(msg.Topic(), msg.Payload())
-	})
+	// Register with the router first, so that retained messages are not missed
+	id := c.router.add(filter, callback)
+
+	if current, ok := c.topics[filter]; ok && current > byte(qos) {
+		qos = MQTTQoS(current)
+	}
+
+	token := c.mqtt.Subscribe(filter, byte(qos), nil)
+	if _, err := token.Wait(), token.Error(); err != nil {
+		c.router.remove(id)
+		return 0, err
+	}
+
+	c.topics[filter] = byte(qos)
+	if plain {
+		c.plain[filter] = append(c.plain[filter], id)
+	}
+
+	return id, nil
+}
+
+// Unsubscribe deregisters the callbacks registered on the given topics by
+// Subscribe and SubscribeQoS. Callbacks registered by SubscribeHandler are
+// left in place, so the broker subscription for a topic is only removed once
+// no callbacks remain on it.
+func (c *MQTTClient) Unsubscribe(topics ...string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var unused []string
+	for _, topic := range topics {
+		for _, id := range c.plain[topic] {
+			c.router.remove(id)
+		}
+		delete(c.plain, topic)
+		if _, ok := c.topics[topic]; ok && c.router.count(topic) == 0 {
+			unused = append(unused, topic)
+		}
+	}
+	if len(unused) == 0 {
+		return nil
+	}
+
+	if !c.mqtt.IsConnected() {
+		c.connectedSubs.Wait()
+	}
+
+	token := c.mqtt.Unsubscribe(unused...)
 	if _, err := token.Wait(), token.Error(); err != nil {
 		return err
 	}
 
-	c.topics[topic] = byte(c.defaultQoS)
+	for _, topic := range unused {
+		delete(c.topics, topic)
+	}
 
 	return nil
 }
 
-func (c *MQTTClient) Unsubscribe(topics ...string) error {
+// UnsubscribeHandler deregisters the callbacks identified by ids.
+// The broker subscription for a topic is only removed once the last callback
+// on that topic has been deregistered.
+func (c *MQTTClient) UnsubscribeHandler(ids ...SubscriptionID) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	var topics []string
+	for _, id := range ids {
+		if topic, remaining, ok := c.router.remove(id); ok && remaining == 0 {
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) == 0 {
+		return nil
+	}
+
 	if !c.mqtt.IsConnected() {
 		c.connectedSubs.Wait()
 	}
@@ -344,7 +410,15 @@ func (c *MQTTClient) Unsubscribe(topics ...string) error {
 	return nil
 }
 
+// Publish publishes payload to topic using the client's default QoS and
+// retained setting
 func (c *MQTTClient) Publish(topic string, payload interface{}) error {
+	return c.PublishOpts(topic, payload, c.defaultQoS, c.defaultPersistence)
+}
+
+// PublishOpts publishes payload to topic using the specified QoS and
+// retained flag
+func (c *MQTTClient) PublishOpts(topic string, payload interface{}, qos MQTTQoS, retained bool) error {
 	c.publock.RLock()
 	defer c.publock.RUnlock()
 
@@ -352,7 +426,19 @@ func (c *MQTTClient) Publish(topic string, payload interface{}) error {
 		c.connectedPubs.Wait()
 	}
 
-	token := c.mqtt.Publish(topic, byte(c.defaultQoS), c.defaultPersistence, payload)
+	token := c.mqtt.Publish(topic, byte(qos), retained, payload)
 	token.Wait()
 	return token.Error()
 }
+
+// ClearRetained removes the retained message held by the broker for each of
+// the given topics. This is accomplished by publishing a zero length retained
+// message to each topic.
+func (c *MQTTClient) ClearRetained(topics ...string) error {
+	for _, topic := range topics {
+		if err := c.PublishOpts(topic, []byte{}, c.defaultQoS, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
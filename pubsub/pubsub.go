@@ -8,3 +8,11 @@ type PubSub interface {
 	Unsubscribe(topics ...string) error
 	Publish(topic string, payload interface{}) error
 }
+
+// HandlerPubSub is a PubSub that can register multiple independent callbacks
+// on the same topic and remove them individually
+type HandlerPubSub interface {
+	PubSub
+	SubscribeHandler(topic string, callback func(topic string, payload []byte)) (SubscriptionID, error)
+	UnsubscribeHandler(ids ...SubscriptionID) error
+}
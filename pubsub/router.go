@@ -0,0 +1,294 @@
+package pubsub
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	topicSharedPrefix     = "$share/"
+	topicLevelSeparator   = "/"
+	topicSingleLevelWild  = "+"
+	topicMultiLevelWild   = "#"
+	topicSystemLevelStart = "$"
+)
+
+// ErrInvalidTopicFilter indicates that a topic filter does not follow the MQTT
+// topic filter syntax
+var ErrInvalidTopicFilter = errors.New("Invalid topic filter")
+
+// ValidateTopicFilter checks that filter is a valid MQTT topic filter.
+// The single level wildcard + must occupy an entire level and the multi level
+// wildcard # must occupy the entire last level.
+func ValidateTopicFilter(filter string) error {
+	if filter == "" || strings.ContainsRune(filter, 0) {
+		return ErrInvalidTopicFilter
+	}
+	levels := strings.Split(filter, topicLevelSeparator)
+	for i, level := range levels {
+		switch {
+		case level == topicMultiLevelWild && i == len(levels)-1:
+		case level == topicSingleLevelWild:
+		case strings.ContainsAny(level, topicSingleLevelWild+topicMultiLevelWild):
+			return ErrInvalidTopicFilter
+		}
+	}
+	return nil
+}
+
+// TopicMatch reports whether topic matches the MQTT topic filter.
+// A shared subscription filter matches the topics of its underlying filter.
+func TopicMatch(filter, topic string) bool {
+	if strings.HasPrefix(filter, topicSharedPrefix) {
+		rest := strings.TrimPrefix(filter, topicSharedPrefix)
+		i := strings.Index(rest, topicLevelSeparator)
+		if i < 0 {
+			return false
+		}
+		filter = rest[i+1:]
+	}
+	// Wildcards at the first level must not match topics beginning with $
+	if strings.HasPrefix(topic, topicSystemLevelStart) &&
+		(strings.HasPrefix(filter, topicSingleLevelWild) || strings.HasPrefix(filter, topicMultiLevelWild)) {
+		return false
+	}
+
+	for {
+		flevel, frest, fmore := nextTopicLevel(filter)
+		if flevel == topicMultiLevelWild {
+			return true
+		}
+		tlevel, trest, tmore := nextTopicLevel(topic)
+		if flevel != topicSingleLevelWild && flevel != tlevel {
+			return false
+		}
+		switch {
+		case !fmore:
+			return !tmore
+		case !tmore:
+			// A multi-level wildcard also matches its parent level
+			return frest == topicMultiLevelWild
+		}
+		filter, topic = frest, trest
+	}
+}
+
+// nextTopicLevel splits the first level off of topic. More reports whether
+// another level follows.
+func nextTopicLevel(topic string) (level, rest string, more bool) {
+	i := strings.Index(topic, topicLevelSeparator)
+	if i < 0 {
+		return topic, "", false
+	}
+	return topic[:i], topic[i+len(topicLevelSeparator):], true
+}
+
+// SharedTopic returns the shared subscription filter for topic within group.
+// The broker delivers each message on topic to only one of the subscribers
+// sharing the same group.
+func SharedTopic(group, topic string) string {
+	return topicSharedPrefix + group + topicLevelSeparator + topic
+}
+
+// isSharedTopic reports whether filter is a shared subscription filter
+func isSharedTopic(filter string) bool {
+	_, _, ok := splitSharedTopic(filter)
+	return ok
+}
+
+// splitSharedTopic returns the group and underlying topic filter of a
+// shared subscription filter
+func splitSharedTopic(filter string) (group, topic string, ok bool) {
+	if !strings.HasPrefix(filter, topicSharedPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(filter, topicSharedPrefix), topicLevelSeparator, 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// validShareGroup checks that group can be used as a shared subscription group
+func validShareGroup(group string) error {
+	if group == "" || strings.ContainsAny(group, topicLevelSeparator+topicSingleLevelWild+topicMultiLevelWild) {
+		return ErrInvalidTopicFilter
+	}
+	return nil
+}
+
+// SubscriptionID identifies a single callback registered on a topic filter.
+// It allows one of many callbacks on the same topic filter to be removed
+// without disturbing the others.
+type SubscriptionID uint64
+
+type routeHandler struct {
+	id       SubscriptionID
+	sub      string // the broker subscription this handler belongs to
+	callback func(topic string, payload []byte)
+}
+
+type routeNode struct {
+	children map[string]*routeNode
+	handlers []routeHandler
+}
+
+// topicRouter is a topic trie that dispatches received messages to every
+// callback whose topic filter matches the message's topic.
+// Multiple callbacks may be registered on the same or overlapping filters.
+//
+// Handlers are registered by the broker subscription filter, which may be a
+// shared subscription. Messages for shared subscriptions arrive on the
+// underlying topic, so these handlers are routed on the underlying filter.
+type topicRouter struct {
+	lock    sync.RWMutex
+	root    *routeNode
+	nextID  SubscriptionID
+	entries map[SubscriptionID]string // handler id to subscription
+	subs    map[string]int            // subscription to handler count
+}
+
+func newTopicRouter() *topicRouter {
+	return &topicRouter{
+		root:    new(routeNode),
+		entries: make(map[SubscriptionID]string),
+		subs:    make(map[string]int),
+	}
+}
+
+// routeLevels returns the levels of the filter that messages for the broker
+// subscription sub are routed on
+func routeLevels(sub string) []string {
+	if _, filter, ok := splitSharedTopic(sub); ok {
+		sub = filter
+	}
+	return strings.Split(sub, topicLevelSeparator)
+}
+
+// add registers callback on the broker subscription filter sub and returns
+// the new handler's id
+func (r *topicRouter) add(sub string, callback func(topic string, payload []byte)) SubscriptionID {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	node := r.root
+	for _, level := range routeLevels(sub) {
+		if node.children == nil {
+			node.children = make(map[string]*routeNode)
+		}
+		child, ok := node.children[level]
+		if !ok {
+			child = new(routeNode)
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	r.nextID++
+	id := r.nextID
+	node.handlers = append(node.handlers, routeHandler{id, sub, callback})
+	r.entries[id] = sub
+	r.subs[sub]++
+	return id
+}
+
+// remove deregisters the handler with the given id. It returns the
+// subscription filter the handler was registered on and how many handlers
+// remain on that subscription. If the id is unknown, ok is false.
+func (r *topicRouter) remove(id SubscriptionID) (sub string, remaining int, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	sub, ok = r.entries[id]
+	if !ok {
+		return "", 0, false
+	}
+	delete(r.entries, id)
+	r.root.remove(routeLevels(sub), func(h routeHandler) bool {
+		return h.id == id
+	})
+	r.subs[sub]--
+	remaining = r.subs[sub]
+	if remaining == 0 {
+		delete(r.subs, sub)
+	}
+	return sub, remaining, true
+}
+
+// count returns the number of handlers registered on the subscription filter
+// sub
+func (r *topicRouter) count(sub string) int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.subs[sub]
+}
+
+// remove drops the handlers selected by drop from the node found by
+// following levels and prunes any nodes left empty
+func (n *routeNode) remove(levels []string, drop func(h routeHandler) bool) {
+	if len(levels) == 0 {
+		handlers := n.handlers[:0]
+		for _, h := range n.handlers {
+			if !drop(h) {
+				handlers = append(handlers, h)
+			}
+		}
+		n.handlers = handlers
+		return
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok {
+		return
+	}
+	child.remove(levels[1:], drop)
+	if len(child.handlers) == 0 && len(child.children) == 0 {
+		delete(n.children, levels[0])
+	}
+}
+
+// match returns all handlers whose filter matches topic
+func (r *topicRouter) match(topic string) []routeHandler {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var handlers []routeHandler
+	levels := strings.Split(topic, topicLevelSeparator)
+	// Wildcards at the first level must not match topics beginning with $
+	system := strings.HasPrefix(topic, topicSystemLevelStart)
+	r.root.match(levels, system, &handlers)
+	return handlers
+}
+
+func (n *routeNode) match(levels []string, system bool, handlers *[]routeHandler) {
+	if len(levels) == 0 {
+		*handlers = append(*handlers, n.handlers...)
+		// A multi-level wildcard also matches its parent level
+		if child, ok := n.children[topicMultiLevelWild]; ok {
+			*handlers = append(*handlers, child.handlers...)
+		}
+		return
+	}
+
+	if !system {
+		if child, ok := n.children[topicMultiLevelWild]; ok {
+			*handlers = append(*handlers, child.handlers...)
+		}
+		if child, ok := n.children[topicSingleLevelWild]; ok {
+			child.match(levels[1:], false, handlers)
+		}
+	}
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], false, handlers)
+	}
+}
+
+// dispatch delivers the message to all matching handlers.
+// No locks are held while the callbacks run, so callbacks are free to
+// subscribe and unsubscribe.
+func (r *topicRouter) dispatch(topic string, payload []byte) {
+	for _, h := range r.match(topic) {
+		h.callback(topic, payload)
+	}
+}
@@ -0,0 +1,154 @@
+package pubsub
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestTopicRouter_Match(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "b/c", false},
+		{"#", "a/b/c", true},
+		{"+/+", "a/b", true},
+		{"+/+", "/b", true},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+		{"a/+", "a/", true},
+		{"a/b/#", "a/b", true},
+		{"a/b/#", "a/bc", false},
+		{"$share/g/a/+", "a/b", true},
+		{"$share/g/a/+", "b/b", false},
+	}
+
+	for _, test := range tests {
+		r := newTopicRouter()
+		r.add(test.filter, func(topic string, payload []byte) {})
+		if got := len(r.match(test.topic)) == 1; got != test.match {
+			t.Errorf("Filter %q on topic %q: expected match %v, got %v", test.filter, test.topic, test.match, got)
+		}
+		if got := TopicMatch(test.filter, test.topic); got != test.match {
+			t.Errorf("TopicMatch(%q, %q): expected %v, got %v", test.filter, test.topic, test.match, got)
+		}
+	}
+}
+
+func TestTopicMatch_NoAllocs(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		TopicMatch("$share/g/openchirp/device/+/#", "openchirp/device/dev1/temperature")
+	})
+	if allocs != 0 {
+		t.Fatalf("Expected TopicMatch not to allocate, got %v allocations", allocs)
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	valid := []string{"a", "a/b", "+", "#", "a/+/c", "a/#", "+/+/#", "/a"}
+	invalid := []string{"", "a#", "a/#/c", "a+/b", "a/b+", "##", "a\x00b"}
+
+	for _, filter := range valid {
+		if err := ValidateTopicFilter(filter); err != nil {
+			t.Errorf("Expected filter %q to be valid: %v", filter, err)
+		}
+	}
+	for _, filter := range invalid {
+		if err := ValidateTopicFilter(filter); err == nil {
+			t.Errorf("Expected filter %q to be invalid", filter)
+		}
+	}
+}
+
+func TestTopicRouter_MultipleHandlers(t *testing.T) {
+	r := newTopicRouter()
+	var received []string
+	record := func(name string) func(topic string, payload []byte) {
+		return func(topic string, payload []byte) {
+			received = append(received, name)
+		}
+	}
+
+	id1 := r.add("dev/1/rawrx", record("exact1"))
+	id2 := r.add("dev/1/rawrx", record("exact2"))
+	idSingle := r.add("dev/+/rawrx", record("single"))
+	idAll := r.add("dev/#", record("multi"))
+
+	r.dispatch("dev/1/rawrx", nil)
+	sort.Strings(received)
+	if expected := []string{"exact1", "exact2", "multi", "single"}; !equalStrings(received, expected) {
+		t.Fatalf("Expected handlers %v, got %v", expected, received)
+	}
+
+	filter, remaining, ok := r.remove(id1)
+	if !ok || filter != "dev/1/rawrx" || remaining != 1 {
+		t.Fatalf("Unexpected remove result: %q, %d, %v", filter, remaining, ok)
+	}
+	if _, _, ok := r.remove(id1); ok {
+		t.Fatal("Removing the same id twice should fail")
+	}
+
+	received = nil
+	r.dispatch("dev/1/rawrx", nil)
+	sort.Strings(received)
+	if expected := []string{"exact2", "multi", "single"}; !equalStrings(received, expected) {
+		t.Fatalf("Expected handlers %v, got %v", expected, received)
+	}
+
+	r.remove(id2)
+	r.remove(idSingle)
+	if _, remaining, _ := r.remove(idAll); remaining != 0 {
+		t.Fatalf("Expected no remaining handlers, got %d", remaining)
+	}
+	if len(r.root.children) != 0 {
+		t.Fatalf("Expected empty router to be pruned, got %d children", len(r.root.children))
+	}
+	if len(r.entries) != 0 || len(r.subs) != 0 {
+		t.Fatalf("Expected no registered handlers, got %v and %v", r.entries, r.subs)
+	}
+}
+
+func TestTopicRouter_Shared(t *testing.T) {
+	r := newTopicRouter()
+	var received int
+	id := r.add(SharedTopic("replicas", "dev/+/rawrx"), func(topic string, payload []byte) {
+		received++
+	})
+	idPlain := r.add("dev/+/rawrx", func(topic string, payload []byte) {})
+
+	// Shared subscription messages arrive on the underlying topic
+	if handlers := r.match("dev/1/rawrx"); len(handlers) != 2 {
+		t.Fatalf("Expected 2 handlers, got %d", len(handlers))
+	}
+
+	// The shared and plain subscriptions are counted separately
+	sub, remaining, ok := r.remove(id)
+	if !ok || sub != "$share/replicas/dev/+/rawrx" || remaining != 0 {
+		t.Fatalf("Unexpected remove result: %q, %d, %v", sub, remaining, ok)
+	}
+	if sub, remaining, ok := r.remove(idPlain); !ok || sub != "dev/+/rawrx" || remaining != 0 {
+		t.Fatalf("Unexpected remove result: %q, %d, %v", sub, remaining, ok)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
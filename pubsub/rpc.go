@@ -0,0 +1,363 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	CRAND "crypto/rand"
+)
+
+// DefaultRPCTimeout is the time a Request will wait for a response when the
+// provided context does not specify a deadline
+const DefaultRPCTimeout = 10 * time.Second
+
+// DefaultRPCMaxConcurrent is the number of requests an RPC handles at once
+// unless specified otherwise
+const DefaultRPCMaxConcurrent = 64
+
+// rpcReplyLevel is the topic level that reply topics must be directly under
+const rpcReplyLevel = "rpc"
+
+// rpcIDSize is the number of random bytes in reply topic and request ids
+const rpcIDSize = 8
+
+// ErrRPCClosed is returned when using an RPC that has been closed
+var ErrRPCClosed = errors.New("RPC has been closed")
+
+// RPCHandler processes a single request payload and returns the response
+// payload. A returned error is relayed back to the requester as an RPCError.
+type RPCHandler func(payload []byte) ([]byte, error)
+
+// RPCError is returned by Request when the remote handler reported an error
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+/*
+Requests and responses are JSON envelopes, where payloads are base64 encoded:
+request:
+{
+	"id": "5f1c4fa3b2a9e0d4",
+	"reply_to": "openchirp/service/<id>/rpc/3ac1e7a8d0b3c4f2",
+	"payload": "eyJjbWQiOiJyZWJvb3QifQ=="
+}
+response:
+{
+	"id": "5f1c4fa3b2a9e0d4",
+	"payload": "eyJzdGF0dXMiOiJvayJ9"
+}
+or, if the handler failed:
+{
+	"id": "5f1c4fa3b2a9e0d4",
+	"error": "unknown command"
+}
+*/
+
+type rpcRequest struct {
+	ID      string `json:"id"`
+	ReplyTo string `json:"reply_to"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+type rpcResponse struct {
+	ID      string `json:"id"`
+	Payload []byte `json:"payload,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// RPC implements request/response calls on top of a PubSub.
+// Requests carry a correlation id and a reply topic that is unique to this
+// RPC, so any number of requests may be in flight concurrently.
+type RPC struct {
+	// Timeout is used for requests whose context has no deadline
+	Timeout time.Duration
+	// MaxConcurrent is the number of received requests that are handled at
+	// once. Requests received while this many are being handled are dropped
+	// and time out at the requester.
+	MaxConcurrent int
+
+	active      int32 // number of requests being handled
+	ps          PubSub
+	replyTopic  string
+	lock        sync.Mutex // lock for subscription state
+	replyCancel func() error
+	handlers    map[string]func() error
+	pendingLock sync.Mutex // lock for pending, which is used from callbacks
+	pending     map[string]chan rpcResponse
+	done        chan struct{}
+}
+
+// NewRPC creates an RPC that sends requests and serves handlers using ps.
+// Responses to requests are received on a unique topic under replyPrefix,
+// which must end with an "rpc" topic level, like "openchirp/device/<id>/rpc".
+// Handlers reject requests whose reply topic is not under such a prefix, so
+// that requesters can not direct responses to arbitrary topics.
+func NewRPC(ps PubSub, replyPrefix string) (*RPC, error) {
+	id, err := genRPCID()
+	if err != nil {
+		return nil, err
+	}
+	r := new(RPC)
+	r.Timeout = DefaultRPCTimeout
+	r.MaxConcurrent = DefaultRPCMaxConcurrent
+	r.ps = ps
+	r.replyTopic = replyPrefix + "/" + id
+	r.pending = make(map[string]chan rpcResponse)
+	r.handlers = make(map[string]func() error)
+	r.done = make(chan struct{})
+	return r, nil
+}
+
+// genRPCID generates a random id for reply topics and request correlation
+func genRPCID() (string, error) {
+	b := make([]byte, rpcIDSize)
+	if _, err := CRAND.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validReplyTopic reports whether topic is a reply topic made by NewRPC,
+// which is a random id directly under an "rpc" topic level
+func validReplyTopic(topic string) bool {
+	if strings.ContainsAny(topic, "+#\x00") || strings.HasPrefix(topic, "$") {
+		return false
+	}
+	levels := strings.Split(topic, "/")
+	if len(levels) < 2 || levels[len(levels)-2] != rpcReplyLevel {
+		return false
+	}
+	id := levels[len(levels)-1]
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == hex.EncodedLen(rpcIDSize)
+}
+
+// subscribeCancelable subscribes callback to topic and returns a function that
+// removes the subscription. When ps is a HandlerPubSub only this callback is
+// removed, otherwise all callbacks on topic are unsubscribed.
+func subscribeCancelable(ps PubSub, topic string, callback func(topic string, payload []byte)) (func() error, error) {
+	if hps, ok := ps.(HandlerPubSub); ok {
+		id, err := hps.SubscribeHandler(topic, callback)
+		if err != nil {
+			return nil, err
+		}
+		return func() error { return hps.UnsubscribeHandler(id) }, nil
+	}
+	if err := ps.Subscribe(topic, callback); err != nil {
+		return nil, err
+	}
+	return func() error { return ps.Unsubscribe(topic) }, nil
+}
+
+// ReplyTopic returns the topic this RPC receives responses on
+func (r *RPC) ReplyTopic() string {
+	return r.replyTopic
+}
+
+func (r *RPC) isClosed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// onResponse routes a received response to the waiting request
+func (r *RPC) onResponse(topic string, payload []byte) {
+	var resp rpcResponse
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return
+	}
+	r.pendingLock.Lock()
+	ch, ok := r.pending[resp.ID]
+	r.pendingLock.Unlock()
+	if ok {
+		// Only the first response for a request is used
+		select {
+		case ch <- resp:
+		default:
+		}
+	}
+}
+
+// Request publishes payload as a request to topic and waits for the response.
+// If ctx has no deadline, the request times out after r.Timeout.
+// An error reported by the remote handler is returned as an *RPCError.
+func (r *RPC) Request(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+	id, err := genRPCID()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan rpcResponse, 1)
+
+	r.lock.Lock()
+	if r.isClosed() {
+		r.lock.Unlock()
+		return nil, ErrRPCClosed
+	}
+	// Lazily subscribe to our reply topic
+	if r.replyCancel == nil {
+		cancel, err := subscribeCancelable(r.ps, r.replyTopic, r.onResponse)
+		if err != nil {
+			r.lock.Unlock()
+			return nil, err
+		}
+		r.replyCancel = cancel
+	}
+	r.lock.Unlock()
+
+	r.pendingLock.Lock()
+	r.pending[id] = ch
+	r.pendingLock.Unlock()
+	defer func() {
+		r.pendingLock.Lock()
+		delete(r.pending, id)
+		r.pendingLock.Unlock()
+	}()
+
+	if _, ok := ctx.Deadline(); !ok && r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	body, err := json.Marshal(&rpcRequest{
+		ID:      id,
+		ReplyTo: r.replyTopic,
+		Payload: payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := r.ps.Publish(topic, body); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != "" {
+			return nil, &RPCError{Message: resp.Error}
+		}
+		return resp.Payload, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.done:
+		return nil, ErrRPCClosed
+	}
+}
+
+// HandleRequests serves requests received on topic using handler.
+// Each request is handled in its own goroutine, up to r.MaxConcurrent at
+// once, and the response is published to the reply topic specified by the
+// requester. Requests with a reply topic that was not made by NewRPC are
+// ignored.
+// Calling HandleRequests again for the same topic replaces the handler.
+func (r *RPC) HandleRequests(topic string, handler RPCHandler) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.isClosed() {
+		return ErrRPCClosed
+	}
+
+	// Remove the previous handler first, since plain PubSubs can only
+	// unsubscribe by topic
+	if oldcancel, ok := r.handlers[topic]; ok {
+		oldcancel()
+		delete(r.handlers, topic)
+	}
+
+	cancel, err := subscribeCancelable(r.ps, topic, func(topic string, payload []byte) {
+		var req rpcRequest
+		if err := json.Unmarshal(payload, &req); err != nil || !validReplyTopic(req.ReplyTo) {
+			// Not a request we can answer
+			return
+		}
+		if atomic.AddInt32(&r.active, 1) > int32(r.MaxConcurrent) {
+			// Too busy, so let the requester time out
+			atomic.AddInt32(&r.active, -1)
+			return
+		}
+		go func() {
+			defer atomic.AddInt32(&r.active, -1)
+			r.serve(req, handler)
+		}()
+	})
+	if err != nil {
+		return err
+	}
+	r.handlers[topic] = cancel
+	return nil
+}
+
+func (r *RPC) serve(req rpcRequest, handler RPCHandler) {
+	resp := rpcResponse{ID: req.ID}
+	payload, err := handler(req.Payload)
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Payload = payload
+	}
+	body, err := json.Marshal(&resp)
+	if err != nil {
+		return
+	}
+	r.ps.Publish(req.ReplyTo, body)
+}
+
+// StopHandlingRequests stops serving requests on the given topics
+func (r *RPC) StopHandlingRequests(topics ...string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var err error
+	for _, topic := range topics {
+		if cancel, ok := r.handlers[topic]; ok {
+			// save and return only first error
+			if e := cancel(); e != nil && err == nil {
+				err = e
+			}
+			delete(r.handlers, topic)
+		}
+	}
+	return err
+}
+
+// Close stops serving all requests, unsubscribes from the reply topic, and
+// fails all in flight requests with ErrRPCClosed
+func (r *RPC) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.isClosed() {
+		return nil
+	}
+	close(r.done)
+
+	var err error
+	for topic, cancel := range r.handlers {
+		// save and return only first error
+		if e := cancel(); e != nil && err == nil {
+			err = e
+		}
+		delete(r.handlers, topic)
+	}
+	if r.replyCancel != nil {
+		if e := r.replyCancel(); e != nil && err == nil {
+			err = e
+		}
+		r.replyCancel = nil
+	}
+	return err
+}
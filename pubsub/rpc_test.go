@@ -0,0 +1,259 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memPubSub is an in-process HandlerPubSub that delivers published messages
+// to matching subscribers synchronously
+type memPubSub struct {
+	router *topicRouter
+	lock   sync.Mutex
+	plain  map[string][]SubscriptionID // handlers added by Subscribe
+}
+
+func newMemPubSub() *memPubSub {
+	return &memPubSub{router: newTopicRouter(), plain: make(map[string][]SubscriptionID)}
+}
+
+func (m *memPubSub) Subscribe(topic string, callback func(topic string, payload []byte)) error {
+	id, err := m.SubscribeHandler(topic, callback)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.plain[topic] = append(m.plain[topic], id)
+	return nil
+}
+
+func (m *memPubSub) SubscribeHandler(topic string, callback func(topic string, payload []byte)) (SubscriptionID, error) {
+	if err := ValidateTopicFilter(topic); err != nil {
+		return 0, err
+	}
+	return m.router.add(topic, callback), nil
+}
+
+func (m *memPubSub) Unsubscribe(topics ...string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, topic := range topics {
+		for _, id := range m.plain[topic] {
+			m.router.remove(id)
+		}
+		delete(m.plain, topic)
+	}
+	return nil
+}
+
+func (m *memPubSub) UnsubscribeHandler(ids ...SubscriptionID) error {
+	for _, id := range ids {
+		m.router.remove(id)
+	}
+	return nil
+}
+
+func (m *memPubSub) Publish(topic string, payload interface{}) error {
+	switch p := payload.(type) {
+	case []byte:
+		m.router.dispatch(topic, p)
+	case string:
+		m.router.dispatch(topic, []byte(p))
+	default:
+		return fmt.Errorf("unsupported payload type %T", payload)
+	}
+	return nil
+}
+
+func TestRPC_Request(t *testing.T) {
+	ps := newMemPubSub()
+
+	server, err := NewRPC(ps, "server/rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := NewRPC(ps, "client/rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = server.HandleRequests("server/echo", func(payload []byte) ([]byte, error) {
+		if string(payload) == "fail" {
+			return nil, errors.New("failed on request")
+		}
+		return append([]byte("echo:"), payload...), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Request(context.Background(), "server/echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "echo:hello" {
+		t.Fatalf("Unexpected response %q", resp)
+	}
+
+	_, err = client.Request(context.Background(), "server/echo", []byte("fail"))
+	if rpcErr, ok := err.(*RPCError); !ok || rpcErr.Message != "failed on request" {
+		t.Fatalf("Expected RPCError, got %v", err)
+	}
+}
+
+func TestRPC_ConcurrentRequests(t *testing.T) {
+	ps := newMemPubSub()
+
+	server, _ := NewRPC(ps, "server/rpc")
+	defer server.Close()
+	client, _ := NewRPC(ps, "client/rpc")
+	defer client.Close()
+
+	// Hold all requests until every one of them is in flight
+	const count = 20
+	var arrived sync.WaitGroup
+	arrived.Add(count)
+	release := make(chan struct{})
+	server.HandleRequests("server/slow", func(payload []byte) ([]byte, error) {
+		arrived.Done()
+		<-release
+		return payload, nil
+	})
+	go func() {
+		arrived.Wait()
+		close(release)
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := fmt.Sprint(i)
+			resp, err := client.Request(context.Background(), "server/slow", []byte(req))
+			if err != nil {
+				errs <- err
+			} else if string(resp) != req {
+				errs <- fmt.Errorf("request %s received response %s", req, resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestRPC_Timeout(t *testing.T) {
+	ps := newMemPubSub()
+
+	client, _ := NewRPC(ps, "client/rpc")
+	client.Timeout = 10 * time.Millisecond
+
+	_, err := client.Request(context.Background(), "nobody/listening", nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+
+	client.Close()
+	if _, err := client.Request(context.Background(), "nobody/listening", nil); err != ErrRPCClosed {
+		t.Fatalf("Expected ErrRPCClosed, got %v", err)
+	}
+}
+
+func TestRPC_MaxConcurrent(t *testing.T) {
+	ps := newMemPubSub()
+
+	server, _ := NewRPC(ps, "server/rpc")
+	defer server.Close()
+	server.MaxConcurrent = 1
+	client, _ := NewRPC(ps, "client/rpc")
+	defer client.Close()
+
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	server.HandleRequests("server/slow", func(payload []byte) ([]byte, error) {
+		if string(payload) == "first" {
+			close(arrived)
+			<-release
+		}
+		return payload, nil
+	})
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := client.Request(context.Background(), "server/slow", []byte("first"))
+		first <- err
+	}()
+	<-arrived
+
+	// The second request is dropped while the first is being handled
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.Request(ctx, "server/slow", []byte("second")); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the busy server to drop the request, got %v", err)
+	}
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	// The slot is released just after the response is published
+	for atomic.LoadInt32(&server.active) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := client.Request(context.Background(), "server/slow", []byte("third")); err != nil {
+		t.Fatalf("Expected requests to be handled once the server is idle: %v", err)
+	}
+}
+
+func TestRPC_RejectsForeignReplyTopic(t *testing.T) {
+	ps := newMemPubSub()
+
+	server, _ := NewRPC(ps, "server/rpc")
+	defer server.Close()
+	client, _ := NewRPC(ps, "client/rpc")
+	defer client.Close()
+
+	var handled int32
+	server.HandleRequests("server/echo", func(payload []byte) ([]byte, error) {
+		atomic.AddInt32(&handled, 1)
+		return payload, nil
+	})
+	var hijacked int32
+	ps.Subscribe("#", func(topic string, payload []byte) {
+		if topic == "victim/status" {
+			atomic.AddInt32(&hijacked, 1)
+		}
+	})
+
+	// Requests may only direct responses to reply topics made by NewRPC
+	for _, replyTo := range []string{
+		"victim/status",
+		"victim/rpc",
+		"victim/rpc/status",
+		"victim/rpc/+",
+		"victim/rpc/5f1c4fa3b2a9e0d4/status",
+	} {
+		ps.Publish("server/echo", fmt.Sprintf(`{"id":"1","reply_to":%q,"payload":"aGk="}`, replyTo))
+	}
+	if _, err := client.Request(context.Background(), "server/echo", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Fatalf("Expected only the valid request to be handled, got %d", n)
+	}
+	if n := atomic.LoadInt32(&hijacked); n != 0 {
+		t.Fatalf("Expected no responses on the victim topic, got %d", n)
+	}
+}
@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	PahoMQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// websocketSubprotocol and websocketHandshakeTimeout are used by the
+	// MQTT v5 client, which dials WebSockets itself
+	websocketSubprotocol      = "mqtt"
+	websocketHandshakeTimeout = 10 * time.Second
+)
+
+// ErrWebsocketProxyUnsupported is returned when MQTTTransport.Proxy is set for
+// a WebSocket broker, but the paho.mqtt.golang release in use is older than
+// v1.3.5 and can not use it
+var ErrWebsocketProxyUnsupported = errors.New("WebSocket proxy requires paho.mqtt.golang v1.3.5 or newer")
+
+// MQTTTransport holds the settings used to reach the broker.
+// Broker URIs may use the tcp://, ssl://, tls://, ws://, or wss:// schemes.
+// For WebSocket brokers, the path of the URI is used as the
+// WebSocket endpoint, as in wss://example.com:443/mqtt .
+type MQTTTransport struct {
+	// HTTPHeaders are sent with the WebSocket handshake, when connecting to
+	// ws:// or wss:// brokers
+	HTTPHeaders http.Header
+	// TLSConfig is used for ssl://, tls://, and wss:// brokers.
+	// The default uses the system's root CAs.
+	TLSConfig *tls.Config
+	// Proxy selects the HTTP proxy used for WebSocket connections.
+	// The default, nil, uses the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY
+	// environment variables. The MQTT v3.1.1 client requires
+	// paho.mqtt.golang v1.3.5 or newer to use a proxy.
+	Proxy func(req *http.Request) (*url.URL, error)
+}
+
+// proxy returns the proxy function to use for WebSocket connections
+func (t MQTTTransport) proxy() func(req *http.Request) (*url.URL, error) {
+	if t.Proxy != nil {
+		return t.Proxy
+	}
+	return http.ProxyFromEnvironment
+}
+
+// websocketURI reports whether brokerURI is a ws:// or wss:// broker
+func websocketURI(brokerURI string) bool {
+	return strings.HasPrefix(brokerURI, "ws://") || strings.HasPrefix(brokerURI, "wss://")
+}
+
+// apply sets the transport settings for brokerURI on the Paho MQTT client
+// options. The WebSocket settings are only applied to WebSocket brokers.
+func (t MQTTTransport) apply(opts *PahoMQTT.ClientOptions, brokerURI string) error {
+	if t.TLSConfig != nil {
+		opts.SetTLSConfig(t.TLSConfig)
+	}
+	if !websocketURI(brokerURI) {
+		return nil
+	}
+	if t.HTTPHeaders != nil {
+		opts.SetHTTPHeaders(t.HTTPHeaders)
+	}
+	if !setWebsocketProxy(opts, t.proxy()) && t.Proxy != nil {
+		return ErrWebsocketProxyUnsupported
+	}
+	return nil
+}
+
+// setWebsocketProxy sets the WebSocket proxy using
+// ClientOptions.SetWebsocketOptions and reports whether it could.
+// That method only exists in paho.mqtt.golang v1.3.5 and newer, so it is
+// looked up at runtime in order to keep building with older releases.
+func setWebsocketProxy(opts *PahoMQTT.ClientOptions, proxy func(req *http.Request) (*url.URL, error)) bool {
+	method := reflect.ValueOf(opts).MethodByName("SetWebsocketOptions")
+	if !method.IsValid() || method.Type().NumIn() != 1 || method.Type().In(0).Kind() != reflect.Ptr {
+		return false
+	}
+	wsOpts := reflect.New(method.Type().In(0).Elem())
+	field := wsOpts.Elem().FieldByName("Proxy")
+	value := reflect.ValueOf(proxy)
+	if !field.IsValid() || !field.CanSet() || !value.Type().ConvertibleTo(field.Type()) {
+		return false
+	}
+	field.Set(value.Convert(field.Type()))
+	method.Call([]reflect.Value{wsOpts})
+	return true
+}
@@ -0,0 +1,351 @@
+package pubsub
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	PahoMQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gorilla/websocket"
+)
+
+// wsBroker is a minimal MQTT v3.1.1 broker stand-in served over WebSockets.
+// It accepts any connection, grants every subscription, and delivers
+// published messages back to the publishing connection if it subscribed.
+// Since it serves a single connection, shared subscriptions behave like
+// plain subscriptions.
+type wsBroker struct {
+	lock     sync.Mutex
+	path     string
+	header   http.Header
+	protocol string
+	// unsubscribed holds the filters of all unsubscribe requests
+	unsubscribed []string
+}
+
+func (b *wsBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{websocketSubprotocol}}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	b.lock.Lock()
+	b.path = r.URL.Path
+	b.header = r.Header
+	b.protocol = conn.Subprotocol()
+	b.lock.Unlock()
+
+	var filters []string
+	in := &wsReader{conn: conn}
+	for {
+		cp, err := packets.ReadPacket(in)
+		if err != nil {
+			return
+		}
+		var resp packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			resp = packets.NewControlPacket(packets.Connack)
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			for i := range p.Topics {
+				suback.ReturnCodes = append(suback.ReturnCodes, p.Qoss[i])
+			}
+			filters = append(filters, p.Topics...)
+			resp = suback
+		case *packets.UnsubscribePacket:
+			b.lock.Lock()
+			b.unsubscribed = append(b.unsubscribed, p.Topics...)
+			b.lock.Unlock()
+			remaining := filters[:0]
+			for _, filter := range filters {
+				if !containsString(p.Topics, filter) {
+					remaining = append(remaining, filter)
+				}
+			}
+			filters = remaining
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			resp = unsuback
+		case *packets.PublishPacket:
+			for _, filter := range filters {
+				if _, topic, ok := splitSharedTopic(filter); ok {
+					filter = topic
+				}
+				if TopicMatch(filter, p.TopicName) {
+					resp = p
+					break
+				}
+			}
+		case *packets.PingreqPacket:
+			resp = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if resp == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := resp.Write(&buf); err != nil {
+			return
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// wsReader reads a continuous stream from consecutive WebSocket messages
+type wsReader struct {
+	conn *websocket.Conn
+	r    io.Reader
+}
+
+func (r *wsReader) Read(p []byte) (int, error) {
+	for {
+		if r.r == nil {
+			_, reader, err := r.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			r.r = reader
+		}
+		n, err := r.r.Read(p)
+		if err == io.EOF {
+			r.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func TestMQTTClient_WebSocket(t *testing.T) {
+	tests := []struct {
+		scheme string
+		server func(http.Handler) *httptest.Server
+	}{
+		{"ws", httptest.NewServer},
+		{"wss", httptest.NewTLSServer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scheme, func(t *testing.T) {
+			broker := new(wsBroker)
+			srv := test.server(broker)
+			defer srv.Close()
+
+			var transport MQTTTransport
+			transport.HTTPHeaders = http.Header{"X-Site-Token": []string{"edge-42"}}
+			var proxied bool
+			transport.Proxy = func(req *http.Request) (*url.URL, error) {
+				proxied = true
+				return nil, nil
+			}
+			if srv.TLS != nil {
+				pool := x509.NewCertPool()
+				pool.AddCert(srv.Certificate())
+				transport.TLSConfig = &tls.Config{RootCAs: pool}
+			}
+
+			brokerURI, _ := url.Parse(srv.URL)
+			brokerURI.Scheme = test.scheme
+			brokerURI.Path = "/mqtt"
+			c, err := NewMQTTClientWithOptions(brokerURI.String(), "user", "pass", QoSAtMostOnce, false, MQTTOptions{
+				Transport: transport,
+			})
+			if err == ErrWebsocketProxyUnsupported {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Disconnect()
+
+			broker.lock.Lock()
+			if broker.path != "/mqtt" {
+				t.Errorf("Expected WebSocket path /mqtt, got %q", broker.path)
+			}
+			if token := broker.header.Get("X-Site-Token"); token != "edge-42" {
+				t.Errorf("Expected handshake header to be sent, got %q", token)
+			}
+			if broker.protocol != websocketSubprotocol {
+				t.Errorf("Expected subprotocol %q, got %q", websocketSubprotocol, broker.protocol)
+			}
+			broker.lock.Unlock()
+			if !proxied {
+				t.Error("Expected proxy function to be consulted")
+			}
+
+			received := make(chan string, 1)
+			err = c.Subscribe("site/+/rawrx", func(topic string, payload []byte) {
+				received <- topic + " " + string(payload)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Publish("site/1/rawrx", "hello"); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case msg := <-received:
+				if msg != "site/1/rawrx hello" {
+					t.Fatalf("Unexpected message %q", msg)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for message over WebSocket")
+			}
+		})
+	}
+}
+
+func TestMQTTTransport_ApplyTCP(t *testing.T) {
+	transport := MQTTTransport{
+		HTTPHeaders: http.Header{"X-Site-Token": []string{"edge-42"}},
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return nil, nil
+		},
+	}
+	opts := PahoMQTT.NewClientOptions()
+	// The WebSocket settings are left alone for other brokers
+	if err := transport.apply(opts, "tcp://localhost:1883"); err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.HTTPHeaders) != 0 {
+		t.Fatalf("Expected no handshake headers for a tcp:// broker, got %v", opts.HTTPHeaders)
+	}
+}
+
+func TestMQTTClient_SubscribeShared(t *testing.T) {
+	srv := httptest.NewServer(new(wsBroker))
+	defer srv.Close()
+
+	brokerURI, _ := url.Parse(srv.URL)
+	brokerURI.Scheme = "ws"
+	c, err := NewMQTTClientWithOptions(brokerURI.String(), "", "", QoSAtMostOnce, false, MQTTOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	if _, err := c.SubscribeShared("bad/group", "a/b", QoSAtMostOnce, nil); err != ErrInvalidTopicFilter {
+		t.Fatalf("Expected invalid group to be refused, got %v", err)
+	}
+
+	received := make(chan string, 1)
+	id, err := c.SubscribeShared("replicas", "site/+/rawrx", QoSAtMostOnce, func(topic string, payload []byte) {
+		received <- topic
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.topics["$share/replicas/site/+/rawrx"]; !ok {
+		t.Fatalf("Expected shared broker subscription, got %v", c.topics)
+	}
+
+	// Shared subscription messages arrive on the underlying topic
+	if err := c.Publish("site/1/rawrx", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case topic := <-received:
+		if topic != "site/1/rawrx" {
+			t.Fatalf("Unexpected topic %q", topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for shared subscription message")
+	}
+
+	if err := c.UnsubscribeHandler(id); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.topics) != 0 {
+		t.Fatalf("Expected no broker subscriptions, got %v", c.topics)
+	}
+}
+
+func TestMQTTClient_UnsubscribeKeepsHandlers(t *testing.T) {
+	broker := new(wsBroker)
+	srv := httptest.NewServer(broker)
+	defer srv.Close()
+
+	brokerURI, _ := url.Parse(srv.URL)
+	brokerURI.Scheme = "ws"
+	c, err := NewMQTTClientWithOptions(brokerURI.String(), "", "", QoSAtMostOnce, false, MQTTOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	plain := make(chan string, 10)
+	handler := make(chan string, 10)
+	if err := c.Subscribe("site/1/rawrx", func(topic string, payload []byte) {
+		plain <- string(payload)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := c.SubscribeHandler("site/1/rawrx", func(topic string, payload []byte) {
+		handler <- string(payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the Subscribe callback is removed and the broker subscription is
+	// kept for the remaining handler
+	if err := c.Unsubscribe("site/1/rawrx"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish("site/1/rawrx", "1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case payload := <-handler:
+		if payload != "1" {
+			t.Fatalf("Unexpected payload %q", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the remaining handler")
+	}
+	if len(plain) != 0 {
+		t.Fatal("Expected the unsubscribed callback to receive nothing")
+	}
+	broker.lock.Lock()
+	if len(broker.unsubscribed) != 0 {
+		t.Fatalf("Expected the broker subscription to be kept, got unsubscribes %v", broker.unsubscribed)
+	}
+	broker.lock.Unlock()
+
+	// Removing the last handler removes the broker subscription
+	if err := c.UnsubscribeHandler(id); err != nil {
+		t.Fatal(err)
+	}
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if !equalStrings(broker.unsubscribed, []string{"site/1/rawrx"}) {
+		t.Fatalf("Expected the broker subscription to be removed, got unsubscribes %v", broker.unsubscribed)
+	}
+}
+
+func containsString(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
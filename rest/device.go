@@ -21,11 +21,20 @@ type DeviceListServiceItem struct {
 
 // TransducerInfo describes a transducer within a Device.
 type TransducerInfo struct {
+	ID         string `json:"id,omitempty"`
 	Name       string `json:"name"`
 	Unit       string `json:"unit"`
 	IsActuable bool   `json:"is_actuable"`
 }
 
+// TransducerUpdateRequest encapsulates the data for a request to update a
+// transducer. Blank fields and a nil IsActuable are left unchanged.
+type TransducerUpdateRequest struct {
+	Name       string `json:"name,omitempty"`
+	Unit       string `json:"unit,omitempty"`
+	IsActuable *bool  `json:"is_actuable,omitempty"`
+}
+
 // TransducerValue holds a transducer description with a single value
 // and timestamp.
 type TransducerValue struct {
@@ -34,22 +43,50 @@ type TransducerValue struct {
 	ValueTimestamp time.Time `json:"timestamp"`
 }
 
+// DeviceCommand describes a command, which publishes a fixed value to one
+// of a device's transducers when executed
+type DeviceCommand struct {
+	ID           string `json:"id,omitempty"`
+	Name         string `json:"name"`
+	TransducerID string `json:"transducer_id"`
+	Value        string `json:"value"`
+}
+
 // DeviceNode is a container for Device Node object received
 // from the RESTful JSON interface
 type DeviceNode struct {
 	NodeDescriptor                         // Node descriptor of Device Node
+	LocationID     string                  `json:"location_id"`
 	Properties     map[string]string       `json:"properties"`
 	Transducers    []TransducerInfo        `json:"transducers"`
+	Commands       []DeviceCommand         `json:"commands"`
 	Services       []DeviceListServiceItem `json:"linked_services"`
 }
 
+// DeviceCreateRequest encapsulates the data for a request to create a device
+type DeviceCreateRequest struct {
+	Name       string            `json:"name"`
+	LocationID string            `json:"location_id,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// DeviceUpdateRequest encapsulates the data for a request to update a device.
+// Blank fields and nil Properties are left unchanged.
+type DeviceUpdateRequest struct {
+	Name       string            `json:"name,omitempty"`
+	LocationID string            `json:"location_id,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
 // Clone creates a new copy of the DeviceNode.
 // This is necessary because a DeviceNode has embedded slices.
 func (n *DeviceNode) Clone() DeviceNode {
 	var ret = *n
-	ret.Transducers = []TransducerInfo{}
-	ret.Services = []DeviceListServiceItem{}
+	ret.Transducers = make([]TransducerInfo, len(n.Transducers))
+	ret.Commands = make([]DeviceCommand, len(n.Commands))
+	ret.Services = make([]DeviceListServiceItem, len(n.Services))
 	copy(ret.Transducers, n.Transducers)
+	copy(ret.Commands, n.Commands)
 	copy(ret.Services, n.Services)
 	return ret
 }
@@ -105,6 +142,7 @@ func (host Host) RequestDeviceInfo(deviceID string) (DeviceNode, error) {
 
 // DeviceTransducerValues makes an HTTP GET to the framework server requesting
 // the transducers last value list for the device with ID deviceID.
+// Use DeviceTransducerHistory to fetch past values.
 func (host Host) DeviceTransducerValues(deviceID string) ([]TransducerValue, error) {
 	var transducers []TransducerValue
 	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + "/transducer"
@@ -232,3 +270,119 @@ func (host Host) ExecuteCommand(deviceID, commandID string) error {
 	defer resp.Body.Close()
 	return DecodeOCError(resp)
 }
+
+// DeviceCreate makes an HTTP POST to the framework server to create a new
+// device with the given name, optionally in location locationID and with
+// properties, which can be blank and nil respectively.
+// This function returns the newly created DeviceNode.
+func (host Host) DeviceCreate(name, locationID string, properties map[string]string) (DeviceNode, error) {
+	var deviceNode DeviceNode
+	uri := host.uri + rootAPISubPath + deviceSubPath
+	deviceReq := DeviceCreateRequest{
+		Name:       name,
+		LocationID: locationID,
+		Properties: properties,
+	}
+	err := host.requestJSON("POST", uri, &deviceReq, &deviceNode)
+	return deviceNode, err
+}
+
+// DeviceUpdate makes an HTTP PUT to the framework server to rename, move, or
+// change the properties of the device with ID deviceID.
+// This function returns the updated DeviceNode.
+func (host Host) DeviceUpdate(deviceID string, update DeviceUpdateRequest) (DeviceNode, error) {
+	var deviceNode DeviceNode
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID
+	err := host.requestJSON("PUT", uri, &update, &deviceNode)
+	return deviceNode, err
+}
+
+// DeviceDelete makes an HTTP DELETE to the framework server to delete the
+// device with ID deviceID
+func (host Host) DeviceDelete(deviceID string) error {
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID
+	return host.requestJSON("DELETE", uri, nil, nil)
+}
+
+// DeviceTransducerCreate makes an HTTP POST to the framework server to add
+// the transducer described by transducer to the device with ID deviceID.
+// This function returns the created transducer, including its ID.
+func (host Host) DeviceTransducerCreate(deviceID string, transducer TransducerInfo) (TransducerInfo, error) {
+	var created TransducerInfo
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + "/transducer"
+	transducer.ID = ""
+	err := host.requestJSON("POST", uri, &transducer, &created)
+	return created, err
+}
+
+// DeviceTransducerUpdate makes an HTTP PUT to the framework server to change
+// the name, unit, or actuability of the transducer with ID transducerID
+// on the device with ID deviceID.
+// This function returns the updated transducer.
+func (host Host) DeviceTransducerUpdate(deviceID, transducerID string, update TransducerUpdateRequest) (TransducerInfo, error) {
+	var updated TransducerInfo
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + "/transducer/" + transducerID
+	err := host.requestJSON("PUT", uri, &update, &updated)
+	return updated, err
+}
+
+// DeviceTransducerDelete makes an HTTP DELETE to the framework server to
+// remove the transducer with ID transducerID from the device with ID deviceID
+func (host Host) DeviceTransducerDelete(deviceID, transducerID string) error {
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + "/transducer/" + transducerID
+	return host.requestJSON("DELETE", uri, nil, nil)
+}
+
+// DeviceCommandList makes an HTTP GET to the framework server requesting
+// the commands of the device with ID deviceID
+func (host Host) DeviceCommandList(deviceID string) ([]DeviceCommand, error) {
+	var commands []DeviceCommand
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + "/command"
+	err := host.requestJSON("GET", uri, nil, &commands)
+	return commands, err
+}
+
+// DeviceCommandCreate makes an HTTP POST to the framework server to add
+// a command to the device with ID deviceID, which publishes command.Value to
+// the transducer with ID command.TransducerID.
+// This function returns the created command, including its ID.
+func (host Host) DeviceCommandCreate(deviceID string, command DeviceCommand) (DeviceCommand, error) {
+	var created DeviceCommand
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + "/command"
+	command.ID = ""
+	err := host.requestJSON("POST", uri, &command, &created)
+	return created, err
+}
+
+// DeviceCommandDelete makes an HTTP DELETE to the framework server to remove
+// the command with ID commandID from the device with ID deviceID
+func (host Host) DeviceCommandDelete(deviceID, commandID string) error {
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + "/command/" + commandID
+	return host.requestJSON("DELETE", uri, nil, nil)
+}
+
+// DeviceTokenGenerate makes an HTTP POST to the framework server to generate
+// a security token for the device with ID deviceID, which the device uses
+// as its MQTT password
+func (host Host) DeviceTokenGenerate(deviceID string) (string, error) {
+	var token string
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + deviceTokenSubPath
+	err := host.requestJSON("POST", uri, nil, &token)
+	return token, err
+}
+
+// DeviceTokenRegenerate makes an HTTP PUT to the framework server to replace
+// the security token of the device with ID deviceID
+func (host Host) DeviceTokenRegenerate(deviceID string) (string, error) {
+	var token string
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + deviceTokenSubPath
+	err := host.requestJSON("PUT", uri, nil, &token)
+	return token, err
+}
+
+// DeviceTokenDelete makes an HTTP DELETE to the framework server to revoke
+// the security token of the device with ID deviceID
+func (host Host) DeviceTokenDelete(deviceID string) error {
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + deviceTokenSubPath
+	return host.requestJSON("DELETE", uri, nil, nil)
+}
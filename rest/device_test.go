@@ -0,0 +1,197 @@
+package rest_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/openchirp/framework/rest"
+)
+
+func TestHost_DeviceCreateUpdateDelete(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+
+	created := rest.DeviceNode{
+		NodeDescriptor: rest.NodeDescriptor{
+			Name:   "Sensor 1",
+			ID:     "5930aaf27d6ec25f901d96da",
+			Pubsub: rest.PubSub{Protocol: "MQTT", Topic: "openchirp/device/5930aaf27d6ec25f901d96da"},
+		},
+		LocationID: "5a0c1a7cf76abe01c57abf01",
+		Properties: map[string]string{"model": "v2"},
+	}
+	f.reply("POST", "/apiv1/device", created)
+	node, err := host.DeviceCreate("Sensor 1", "5a0c1a7cf76abe01c57abf01", map[string]string{"model": "v2"})
+	if err != nil {
+		t.Fatal("Error creating device:", err)
+	}
+	if !reflect.DeepEqual(node, created) {
+		t.Fatalf("Expected created device %+v, got %+v", created, node)
+	}
+	expectedBody := map[string]interface{}{
+		"name":        "Sensor 1",
+		"location_id": "5a0c1a7cf76abe01c57abf01",
+		"properties":  map[string]interface{}{"model": "v2"},
+	}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected create body %v, got %v", expectedBody, body)
+	}
+
+	renamed := created
+	renamed.Name = "Sensor 2"
+	f.reply("PUT", "/apiv1/device/"+created.ID, renamed)
+	node, err = host.DeviceUpdate(created.ID, rest.DeviceUpdateRequest{Name: "Sensor 2"})
+	if err != nil {
+		t.Fatal("Error updating device:", err)
+	}
+	if node.Name != "Sensor 2" {
+		t.Fatalf("Expected renamed device, got %+v", node)
+	}
+	// Unchanged fields must not be sent, so that they are left unchanged
+	expectedBody = map[string]interface{}{"name": "Sensor 2"}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected update body %v, got %v", expectedBody, body)
+	}
+
+	f.reply("DELETE", "/apiv1/device/"+created.ID, map[string]string{})
+	if err := host.DeviceDelete(created.ID); err != nil {
+		t.Fatal("Error deleting device:", err)
+	}
+	if r := f.lastRequest(); r.Method != "DELETE" || r.Body != nil {
+		t.Fatalf("Unexpected delete request %+v", r)
+	}
+}
+
+func TestHost_DeviceErrors(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+
+	f.fail("POST", "/apiv1/device", http.StatusBadRequest, "Device name is required")
+	if _, err := host.DeviceCreate("", "", nil); err == nil || err.Error() != "Device name is required" {
+		t.Fatalf("Expected the server's error message, got %v", err)
+	}
+	f.fail("DELETE", "/apiv1/device/missing", http.StatusNotFound, "Device not found")
+	if err := host.DeviceDelete("missing"); err == nil || err.Error() != "Device not found" {
+		t.Fatalf("Expected the server's error message, got %v", err)
+	}
+}
+
+func TestHost_DeviceTransducerCRUD(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+	deviceID := "5930aaf27d6ec25f901d96da"
+	transducerPath := "/apiv1/device/" + deviceID + "/transducer"
+
+	created := rest.TransducerInfo{ID: "5930ab0c7d6ec25f901d96db", Name: "temperature", Unit: "C"}
+	f.reply("POST", transducerPath, created)
+	transducer, err := host.DeviceTransducerCreate(deviceID, rest.TransducerInfo{Name: "temperature", Unit: "C"})
+	if err != nil {
+		t.Fatal("Error creating transducer:", err)
+	}
+	if transducer != created {
+		t.Fatalf("Expected created transducer %+v, got %+v", created, transducer)
+	}
+	expectedBody := map[string]interface{}{"name": "temperature", "unit": "C", "is_actuable": false}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected create body %v, got %v", expectedBody, body)
+	}
+
+	actuable := true
+	updated := created
+	updated.IsActuable = true
+	f.reply("PUT", transducerPath+"/"+created.ID, updated)
+	transducer, err = host.DeviceTransducerUpdate(deviceID, created.ID, rest.TransducerUpdateRequest{IsActuable: &actuable})
+	if err != nil {
+		t.Fatal("Error updating transducer:", err)
+	}
+	if !transducer.IsActuable {
+		t.Fatalf("Expected actuable transducer, got %+v", transducer)
+	}
+	expectedBody = map[string]interface{}{"is_actuable": true}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected update body %v, got %v", expectedBody, body)
+	}
+
+	f.reply("DELETE", transducerPath+"/"+created.ID, map[string]string{})
+	if err := host.DeviceTransducerDelete(deviceID, created.ID); err != nil {
+		t.Fatal("Error deleting transducer:", err)
+	}
+}
+
+func TestHost_DeviceCommandCRUD(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+	deviceID := "5930aaf27d6ec25f901d96da"
+	commandPath := "/apiv1/device/" + deviceID + "/command"
+
+	created := rest.DeviceCommand{ID: "c1", Name: "Turn on", TransducerID: "t1", Value: "1"}
+	f.reply("POST", commandPath, created)
+	command, err := host.DeviceCommandCreate(deviceID, rest.DeviceCommand{Name: "Turn on", TransducerID: "t1", Value: "1"})
+	if err != nil {
+		t.Fatal("Error creating command:", err)
+	}
+	if command != created {
+		t.Fatalf("Expected created command %+v, got %+v", created, command)
+	}
+	expectedBody := map[string]interface{}{"name": "Turn on", "transducer_id": "t1", "value": "1"}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected create body %v, got %v", expectedBody, body)
+	}
+
+	f.reply("GET", commandPath, []rest.DeviceCommand{created})
+	commands, err := host.DeviceCommandList(deviceID)
+	if err != nil {
+		t.Fatal("Error listing commands:", err)
+	}
+	if len(commands) != 1 || commands[0] != created {
+		t.Fatalf("Expected command list [%+v], got %+v", created, commands)
+	}
+
+	f.reply("DELETE", commandPath+"/"+created.ID, map[string]string{})
+	if err := host.DeviceCommandDelete(deviceID, created.ID); err != nil {
+		t.Fatal("Error deleting command:", err)
+	}
+}
+
+func TestHost_DeviceToken(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+	deviceID := "5930aaf27d6ec25f901d96da"
+	tokenPath := "/apiv1/device/" + deviceID + "/token"
+
+	f.reply("POST", tokenPath, "Zxkq8vDbLEMzZ9b1tQ2wH7Rk")
+	token, err := host.DeviceTokenGenerate(deviceID)
+	if err != nil || token != "Zxkq8vDbLEMzZ9b1tQ2wH7Rk" {
+		t.Fatalf("Expected generated token, got %q, %v", token, err)
+	}
+	f.reply("PUT", tokenPath, "Pq3nR8sT0uV2wX4yZ6aB8cD0")
+	token, err = host.DeviceTokenRegenerate(deviceID)
+	if err != nil || token != "Pq3nR8sT0uV2wX4yZ6aB8cD0" {
+		t.Fatalf("Expected regenerated token, got %q, %v", token, err)
+	}
+	f.reply("DELETE", tokenPath, map[string]string{})
+	if err := host.DeviceTokenDelete(deviceID); err != nil {
+		t.Fatal("Error deleting token:", err)
+	}
+}
+
+func TestDeviceNode_Clone(t *testing.T) {
+	node := rest.DeviceNode{
+		Transducers: []rest.TransducerInfo{{ID: "t1", Name: "Relay"}},
+		Commands:    []rest.DeviceCommand{{Name: "On", TransducerID: "t1", Value: "1"}},
+	}
+	clone := node.Clone()
+	if !reflect.DeepEqual(clone.Transducers, node.Transducers) || !reflect.DeepEqual(clone.Commands, node.Commands) {
+		t.Fatalf("Expected a copy of %+v, got %+v", node, clone)
+	}
+	clone.Commands[0].Value = "0"
+	if node.Commands[0].Value != "1" {
+		t.Fatal("Modifying the clone changed the original")
+	}
+}
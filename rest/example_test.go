@@ -14,9 +14,7 @@ func ExampleNewHost() {
 	token := "DJpHxwmExGbcYwsEHgQezDVeKS4N"
 
 	host := rest.NewHost(frameworkUri)
-	if err := host.Login(id, token); err != nil {
-		log.Fatalln("Error logging in:", err)
-	}
+	host.SetCredentials(id, token)
 	log.Println(host)
 }
 
@@ -26,10 +24,9 @@ func ExampleHost_RequestServiceInfo() {
 	id := os.Getenv("SERVICE_ID")
 	token := os.Getenv("SERVICE_TOKEN")
 
+	// Service credentials can not be validated using Login
 	host := rest.NewHost(frameworkUri)
-	if err := host.Login(id, token); err != nil {
-		log.Fatalln("Error logging in:", err)
-	}
+	host.SetCredentials(id, token)
 
 	sInfo, err := host.RequestServiceInfo(id)
 	if err != nil {
@@ -39,6 +36,23 @@ func ExampleHost_RequestServiceInfo() {
 	// Ouput: Blah
 }
 
+func ExampleHost_RequestDeviceInfo() {
+	// Get parameters from environment variables
+	frameworkUri := os.Getenv("FRAMEWORK_SERVER")
+	id := os.Getenv("DEVICE_ID")
+	token := os.Getenv("DEVICE_TOKEN")
+
+	// Device credentials can not be validated using Login
+	host := rest.NewHost(frameworkUri)
+	host.SetCredentials(id, token)
+
+	dInfo, err := host.RequestDeviceInfo(id)
+	if err != nil {
+		log.Fatalln("Error requesting device info:", err)
+	}
+	fmt.Println(dInfo)
+}
+
 func ExampleHost_RequestUserInfo() {
 	// Get parameters from environment variables
 	frameworkUri := os.Getenv("FRAMEWORK_SERVER")
@@ -46,7 +60,7 @@ func ExampleHost_RequestUserInfo() {
 	token := os.Getenv("USER_TOKEN")
 
 	host := rest.NewHost(frameworkUri)
-	if err := host.Login(id, token); err != nil {
+	if _, err := host.Login(id, token); err != nil {
 		log.Fatalln("Error logging in:", err)
 	}
 
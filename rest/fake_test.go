@@ -0,0 +1,115 @@
+package rest_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/openchirp/framework/rest"
+)
+
+const (
+	fakeUser  = "5a1ea73df76abe01c57abfb8"
+	fakeToken = "DJpHxwmExGbcYwsEHgQezDVeKS4N"
+)
+
+// fakeRequest is a request received by a fakeFramework
+type fakeRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Body   map[string]interface{}
+}
+
+// fakeFramework is a stand in for the framework server, which serves
+// canned responses keyed by "METHOD /path"
+type fakeFramework struct {
+	t        *testing.T
+	server   *httptest.Server
+	lock     sync.Mutex
+	routes   map[string]http.HandlerFunc
+	requests []fakeRequest
+}
+
+// newFakeFramework starts a fake server, which must be closed by the caller
+func newFakeFramework(t *testing.T) *fakeFramework {
+	f := &fakeFramework{t: t, routes: make(map[string]http.HandlerFunc)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// host returns a Host with credentials for the fake server
+func (f *fakeFramework) host() rest.Host {
+	host := rest.NewHost(f.server.URL)
+	host.SetCredentials(fakeUser, fakeToken)
+	return host
+}
+
+// handle serves requests matching method and path using handler
+func (f *fakeFramework) handle(method, path string, handler http.HandlerFunc) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.routes[method+" "+path] = handler
+}
+
+// reply serves requests matching method and path with the JSON encoding of
+// response
+func (f *fakeFramework) reply(method, path string, response interface{}) {
+	f.handle(method, path, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// fail serves requests matching method and path with an OpenChirp error
+func (f *fakeFramework) fail(method, path string, status int, message string) {
+	f.handle(method, path, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]string{"message": message},
+		})
+	})
+}
+
+// lastRequest returns the most recent request
+func (f *fakeFramework) lastRequest() fakeRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.requests) == 0 {
+		f.t.Fatal("No requests received")
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+// requestLog returns all requests received so far
+func (f *fakeFramework) requestLog() []fakeRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]fakeRequest(nil), f.requests...)
+}
+
+func (f *fakeFramework) serve(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != fakeUser || pass != fakeToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	request := fakeRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request.Body); err != nil {
+			f.t.Errorf("Invalid JSON body for %s %s: %v", r.Method, r.URL.Path, err)
+		}
+	}
+
+	f.lock.Lock()
+	f.requests = append(f.requests, request)
+	handler, ok := f.routes[r.Method+" "+r.URL.Path]
+	f.lock.Unlock()
+	if !ok {
+		f.t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	handler(w, r)
+}
@@ -12,6 +12,38 @@ type Group struct {
 	Name string `json:"name"`
 }
 
+// GroupMember is a user that belongs to a group
+type GroupMember struct {
+	User
+	WriteAccess bool `json:"write_access"`
+}
+
+// GroupMemberRequest is the container for the request to add, update, or
+// remove a group member. WriteAccess is left out when removing a member.
+type GroupMemberRequest struct {
+	UserID      string `json:"user_id"`
+	WriteAccess *bool  `json:"write_access,omitempty"`
+}
+
+// AccessPermission is the level of access a group is granted to a device or
+// service
+type AccessPermission int
+
+const (
+	// AccessRead allows reading the node and its data
+	AccessRead AccessPermission = iota
+	// AccessExecute additionally allows executing the node's commands
+	AccessExecute
+	// AccessWrite additionally allows modifying the node
+	AccessWrite
+)
+
+// AccessRequest is the container for the request to grant access to a
+// device or service
+type AccessRequest struct {
+	Permission AccessPermission `json:"perm"`
+}
+
 // GroupCreateRequest is the container for the request to create a new group
 type GroupCreateRequest struct {
 	Name string `json:"name"`
@@ -68,3 +100,76 @@ func (host Host) GroupAll() ([]Group, error) {
 	err = json.NewDecoder(resp.Body).Decode(&groups)
 	return groups, err
 }
+
+// GroupGet fetches the group with ID groupID
+func (host Host) GroupGet(groupID string) (Group, error) {
+	var group Group
+	uri := host.uri + rootAPISubPath + groupSubPath + "/" + groupID
+	err := host.requestJSON("GET", uri, nil, &group)
+	return group, err
+}
+
+// GroupDelete deletes the group with ID groupID
+func (host Host) GroupDelete(groupID string) error {
+	uri := host.uri + rootAPISubPath + groupSubPath + "/" + groupID
+	return host.requestJSON("DELETE", uri, nil, nil)
+}
+
+// GroupMembers fetches the members of the group with ID groupID
+func (host Host) GroupMembers(groupID string) ([]GroupMember, error) {
+	var members []GroupMember
+	uri := host.uri + rootAPISubPath + groupSubPath + "/" + groupID + groupMembersSubPath
+	err := host.requestJSON("GET", uri, nil, &members)
+	return members, err
+}
+
+// GroupAddMember adds the user with ID userID to the group with ID groupID.
+// If writeAccess is true, the user may also manage the group's members.
+func (host Host) GroupAddMember(groupID, userID string, writeAccess bool) error {
+	uri := host.uri + rootAPISubPath + groupSubPath + "/" + groupID + groupMemberSubPath
+	req := &GroupMemberRequest{UserID: userID, WriteAccess: &writeAccess}
+	return host.requestJSON("POST", uri, req, nil)
+}
+
+// GroupUpdateMember changes the write access of the user with ID userID in
+// the group with ID groupID
+func (host Host) GroupUpdateMember(groupID, userID string, writeAccess bool) error {
+	uri := host.uri + rootAPISubPath + groupSubPath + "/" + groupID + groupMemberSubPath
+	req := &GroupMemberRequest{UserID: userID, WriteAccess: &writeAccess}
+	return host.requestJSON("PUT", uri, req, nil)
+}
+
+// GroupRemoveMember removes the user with ID userID from the group with ID
+// groupID
+func (host Host) GroupRemoveMember(groupID, userID string) error {
+	uri := host.uri + rootAPISubPath + groupSubPath + "/" + groupID + groupMemberSubPath
+	return host.requestJSON("DELETE", uri, &GroupMemberRequest{UserID: userID}, nil)
+}
+
+// DeviceGrantGroupAccess grants the group with ID groupID perm access to the
+// device with ID deviceID. Granting access again changes the permission.
+func (host Host) DeviceGrantGroupAccess(deviceID, groupID string, perm AccessPermission) error {
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + aclSubPath + "/" + groupID
+	return host.requestJSON("POST", uri, &AccessRequest{Permission: perm}, nil)
+}
+
+// DeviceRevokeGroupAccess revokes the access of the group with ID groupID to
+// the device with ID deviceID
+func (host Host) DeviceRevokeGroupAccess(deviceID, groupID string) error {
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + aclSubPath + "/" + groupID
+	return host.requestJSON("DELETE", uri, nil, nil)
+}
+
+// ServiceGrantGroupAccess grants the group with ID groupID perm access to the
+// service with ID serviceID. Granting access again changes the permission.
+func (host Host) ServiceGrantGroupAccess(serviceID, groupID string, perm AccessPermission) error {
+	uri := host.uri + rootAPISubPath + servicesSubPath + "/" + serviceID + aclSubPath + "/" + groupID
+	return host.requestJSON("POST", uri, &AccessRequest{Permission: perm}, nil)
+}
+
+// ServiceRevokeGroupAccess revokes the access of the group with ID groupID to
+// the service with ID serviceID
+func (host Host) ServiceRevokeGroupAccess(serviceID, groupID string) error {
+	uri := host.uri + rootAPISubPath + servicesSubPath + "/" + serviceID + aclSubPath + "/" + groupID
+	return host.requestJSON("DELETE", uri, nil, nil)
+}
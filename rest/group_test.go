@@ -0,0 +1,99 @@
+package rest_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/openchirp/framework/rest"
+)
+
+func TestHost_GroupMembers(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+	groupID := "5a2b0c1df76abe01c57abf10"
+	groupPath := "/apiv1/group/" + groupID
+
+	f.reply("GET", groupPath, rest.Group{ID: groupID, Name: "Lab"})
+	group, err := host.GroupGet(groupID)
+	if err != nil || group.Name != "Lab" {
+		t.Fatalf("Expected group Lab, got %+v, %v", group, err)
+	}
+
+	f.reply("POST", groupPath+"/member", map[string]string{})
+	if err := host.GroupAddMember(groupID, "u1", true); err != nil {
+		t.Fatal("Error adding member:", err)
+	}
+	expectedBody := map[string]interface{}{"user_id": "u1", "write_access": true}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected add member body %v, got %v", expectedBody, body)
+	}
+
+	// Write access must also be sent when it is revoked
+	f.reply("PUT", groupPath+"/member", map[string]string{})
+	if err := host.GroupUpdateMember(groupID, "u1", false); err != nil {
+		t.Fatal("Error updating member:", err)
+	}
+	expectedBody = map[string]interface{}{"user_id": "u1", "write_access": false}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected update member body %v, got %v", expectedBody, body)
+	}
+
+	member := rest.GroupMember{User: rest.User{ID: "u1", Name: "Alice"}, WriteAccess: true}
+	f.reply("GET", groupPath+"/members", []rest.GroupMember{member})
+	members, err := host.GroupMembers(groupID)
+	if err != nil {
+		t.Fatal("Error listing members:", err)
+	}
+	if len(members) != 1 || members[0] != member {
+		t.Fatalf("Expected members [%+v], got %+v", member, members)
+	}
+
+	f.reply("DELETE", groupPath+"/member", map[string]string{})
+	if err := host.GroupRemoveMember(groupID, "u1"); err != nil {
+		t.Fatal("Error removing member:", err)
+	}
+	expectedBody = map[string]interface{}{"user_id": "u1"}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected remove member body %v, got %v", expectedBody, body)
+	}
+
+	f.reply("DELETE", groupPath, map[string]string{})
+	if err := host.GroupDelete(groupID); err != nil {
+		t.Fatal("Error deleting group:", err)
+	}
+}
+
+func TestHost_GroupAccess(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+	groupID := "5a2b0c1df76abe01c57abf10"
+
+	devicePath := "/apiv1/device/dev1/acl/" + groupID
+	f.reply("POST", devicePath, map[string]string{})
+	if err := host.DeviceGrantGroupAccess("dev1", groupID, rest.AccessExecute); err != nil {
+		t.Fatal("Error granting device access:", err)
+	}
+	expectedBody := map[string]interface{}{"perm": float64(rest.AccessExecute)}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected grant body %v, got %v", expectedBody, body)
+	}
+	f.reply("DELETE", devicePath, map[string]string{})
+	if err := host.DeviceRevokeGroupAccess("dev1", groupID); err != nil {
+		t.Fatal("Error revoking device access:", err)
+	}
+
+	servicePath := "/apiv1/service/svc1/acl/" + groupID
+	f.reply("POST", servicePath, map[string]string{})
+	if err := host.ServiceGrantGroupAccess("svc1", groupID, rest.AccessWrite); err != nil {
+		t.Fatal("Error granting service access:", err)
+	}
+	f.reply("DELETE", servicePath, map[string]string{})
+	if err := host.ServiceRevokeGroupAccess("svc1", groupID); err != nil {
+		t.Fatal("Error revoking service access:", err)
+	}
+	if r := f.lastRequest(); r.Method != "DELETE" || r.Path != servicePath {
+		t.Fatalf("Unexpected revoke request %+v", r)
+	}
+}
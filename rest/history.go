@@ -0,0 +1,169 @@
+package rest
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/openchirp/framework/utils"
+)
+
+const (
+	// historyPageSize is the number of points fetched per history request
+	historyPageSize = 1000
+)
+
+// TransducerPoint is a single historical transducer value.
+// Value holds the result of utils.ParseOCValue, so it is a float64, bool,
+// or string.
+type TransducerPoint struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Value     interface{} `json:"value"`
+}
+
+// UnmarshalJSON decodes a point, parsing the value with utils.ParseOCValue
+// whether it was sent as a JSON string or a primitive
+func (p *TransducerPoint) UnmarshalJSON(data []byte) error {
+	var point struct {
+		Timestamp time.Time       `json:"timestamp"`
+		Value     json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &point); err != nil {
+		return err
+	}
+	value := string(point.Value)
+	var str string
+	if err := json.Unmarshal(point.Value, &str); err == nil {
+		value = str
+	}
+	p.Timestamp = point.Timestamp
+	p.Value = utils.ParseOCValue(value)
+	return nil
+}
+
+// formatOCValue formats a value parsed by utils.ParseOCValue back into
+// its OpenChirp string form
+func formatOCValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return utils.FormatFloat64(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	}
+	buf, _ := json.Marshal(value)
+	return string(buf)
+}
+
+// DeviceTransducerHistoryStream makes HTTP GETs to the framework server
+// requesting the values of the transducer with ID transducerID of the device
+// with ID deviceID between from and to, calling fn with each point in order.
+// A zero from or to leaves that end of the range open, and a limit of zero
+// or less fetches all points.
+// Points are fetched a page at a time, so large ranges are not held in
+// memory. If fn returns an error, the stream stops and the error is returned.
+func (host Host) DeviceTransducerHistoryStream(
+	deviceID, transducerID string,
+	from, to time.Time,
+	limit int,
+	fn func(point TransducerPoint) error,
+) error {
+	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + "/transducer/" + transducerID + "/history"
+	params := url.Values{}
+	if !from.IsZero() {
+		params.Set("from", from.UTC().Format(time.RFC3339Nano))
+	}
+	if !to.IsZero() {
+		params.Set("to", to.UTC().Format(time.RFC3339Nano))
+	}
+
+	for offset := 0; limit <= 0 || offset < limit; {
+		pageSize := historyPageSize
+		if limit > 0 && limit-offset < pageSize {
+			pageSize = limit - offset
+		}
+		params.Set("offset", strconv.Itoa(offset))
+		params.Set("limit", strconv.Itoa(pageSize))
+
+		var points []TransducerPoint
+		if err := host.requestJSON("GET", uri+"?"+params.Encode(), nil, &points); err != nil {
+			return err
+		}
+		for _, point := range points {
+			if err := fn(point); err != nil {
+				return err
+			}
+		}
+		if len(points) < pageSize {
+			break
+		}
+		offset += len(points)
+	}
+	return nil
+}
+
+// DeviceTransducerHistory fetches the values of the transducer with ID
+// transducerID of the device with ID deviceID between from and to.
+// A zero from or to leaves that end of the range open, and a limit of zero
+// or less fetches all points.
+// Use DeviceTransducerHistoryStream for large ranges.
+func (host Host) DeviceTransducerHistory(deviceID, transducerID string, from, to time.Time, limit int) ([]TransducerPoint, error) {
+	var points []TransducerPoint
+	err := host.DeviceTransducerHistoryStream(deviceID, transducerID, from, to, limit, func(point TransducerPoint) error {
+		points = append(points, point)
+		return nil
+	})
+	return points, err
+}
+
+// ExportTransducerHistoryCSV streams the transducer history between from and
+// to to w as CSV, with a "timestamp,value" header row
+func (host Host) ExportTransducerHistoryCSV(w io.Writer, deviceID, transducerID string, from, to time.Time) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"timestamp", "value"}); err != nil {
+		return err
+	}
+	err := host.DeviceTransducerHistoryStream(deviceID, transducerID, from, to, 0, func(point TransducerPoint) error {
+		return cw.Write([]string{
+			point.Timestamp.UTC().Format(time.RFC3339Nano),
+			formatOCValue(point.Value),
+		})
+	})
+	cw.Flush()
+	if err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// ExportTransducerHistoryJSON streams the transducer history between from and
+// to to w as a JSON array of points
+func (host Host) ExportTransducerHistoryJSON(w io.Writer, deviceID, transducerID string, from, to time.Time) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	first := true
+	err := host.DeviceTransducerHistoryStream(deviceID, transducerID, from, to, 0, func(point TransducerPoint) error {
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		buf, err := json.Marshal(point)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]\n")
+	return err
+}
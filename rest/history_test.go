@@ -0,0 +1,116 @@
+package rest_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openchirp/framework/rest"
+)
+
+// serveHistory serves n points, one per second from start, paginated by the
+// offset and limit query parameters
+func serveHistory(f *fakeFramework, path string, start time.Time, n int) {
+	f.handle("GET", path, func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		points := []map[string]interface{}{}
+		for i := offset; i < n && i < offset+limit; i++ {
+			points = append(points, map[string]interface{}{
+				"timestamp": start.Add(time.Duration(i) * time.Second),
+				"value":     strconv.Itoa(i),
+			})
+		}
+		json.NewEncoder(w).Encode(points)
+	})
+}
+
+func TestHost_DeviceTransducerHistory(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+	path := "/apiv1/device/dev1/transducer/t1/history"
+	start := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	serveHistory(f, path, start, 2500)
+
+	from := start.Add(-time.Hour)
+	points, err := host.DeviceTransducerHistory("dev1", "t1", from, time.Time{}, 0)
+	if err != nil {
+		t.Fatal("Error fetching history:", err)
+	}
+	if len(points) != 2500 {
+		t.Fatalf("Expected all 2500 points across pages, got %d", len(points))
+	}
+	for i, point := range points {
+		if point.Value != float64(i) || !point.Timestamp.Equal(start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("Unexpected point %d: %+v", i, point)
+		}
+	}
+	query := f.lastRequest().Query
+	if !strings.Contains(query, "from=2018-01-02T02%3A04%3A05Z") || strings.Contains(query, "to=") {
+		t.Fatalf("Expected only the from bound in the query, got %q", query)
+	}
+
+	points, err = host.DeviceTransducerHistory("dev1", "t1", time.Time{}, time.Time{}, 1200)
+	if err != nil {
+		t.Fatal("Error fetching history:", err)
+	}
+	if len(points) != 1200 {
+		t.Fatalf("Expected the limit of 1200 points, got %d", len(points))
+	}
+}
+
+func TestTransducerPoint_UnmarshalJSON(t *testing.T) {
+	var points []rest.TransducerPoint
+	data := `[
+		{"timestamp": "2018-01-02T03:04:05Z", "value": "21.5"},
+		{"timestamp": "2018-01-02T03:04:06Z", "value": 22},
+		{"timestamp": "2018-01-02T03:04:07Z", "value": "true"},
+		{"timestamp": "2018-01-02T03:04:08Z", "value": "open"}
+	]`
+	if err := json.Unmarshal([]byte(data), &points); err != nil {
+		t.Fatal(err)
+	}
+	var values []interface{}
+	for _, point := range points {
+		values = append(values, point.Value)
+	}
+	expected := []interface{}{21.5, float64(22), true, "open"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("Expected values %v, got %v", expected, values)
+	}
+}
+
+func TestHost_ExportTransducerHistory(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+	start := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	serveHistory(f, "/apiv1/device/dev1/transducer/t1/history", start, 2)
+
+	var buf bytes.Buffer
+	if err := host.ExportTransducerHistoryCSV(&buf, "dev1", "t1", time.Time{}, time.Time{}); err != nil {
+		t.Fatal("Error exporting CSV:", err)
+	}
+	expected := "timestamp,value\n2018-01-02T03:04:05Z,0\n2018-01-02T03:04:06Z,1\n"
+	if buf.String() != expected {
+		t.Fatalf("Expected CSV:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := host.ExportTransducerHistoryJSON(&buf, "dev1", "t1", time.Time{}, time.Time{}); err != nil {
+		t.Fatal("Error exporting JSON:", err)
+	}
+	var points []rest.TransducerPoint
+	if err := json.Unmarshal(buf.Bytes(), &points); err != nil {
+		t.Fatalf("Invalid JSON export %q: %v", buf.String(), err)
+	}
+	if len(points) != 2 || points[1].Value != float64(1) {
+		t.Fatalf("Unexpected exported points %+v", points)
+	}
+}
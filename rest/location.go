@@ -5,9 +5,21 @@ package rest
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"sync"
 )
 
+const (
+	// locationTreeConcurrency limits the concurrent requests made by
+	// LocationTree
+	locationTreeConcurrency = 8
+)
+
+// SkipLocation is returned by a LocationTree.Walk function to skip the
+// sublocations of the current location
+var SkipLocation = errors.New("Skip this location")
+
 // LocationNode is a container for Location Node object received
 // from the RESTful JSON interface
 type LocationNode struct {
@@ -18,6 +30,18 @@ type LocationNode struct {
 	// We currently omit the geo_loc, timestamps, test, and type
 }
 
+// LocationCreateRequest encapsulates the data for a request to create a
+// location
+type LocationCreateRequest struct {
+	Name string `json:"name"`
+}
+
+// LocationUpdateRequest encapsulates the data for a request to update a
+// location. Blank fields are left unchanged.
+type LocationUpdateRequest struct {
+	Name string `json:"name,omitempty"`
+}
+
 func (n LocationNode) String() string {
 	buf, _ := json.MarshalIndent(&n, "", jsonPrettyIndent)
 	return string(buf)
@@ -101,3 +125,168 @@ func (host Host) RequestLocationDevices(locID string, recursive bool) ([]NodeDes
 	err = json.NewDecoder(resp.Body).Decode(&deviceNodes)
 	return deviceNodes, err
 }
+
+// rootLocationID resolves the blank location ID to the root location's ID
+func (host Host) rootLocationID(locID string) (string, error) {
+	if locID != "" {
+		return locID, nil
+	}
+	loc, err := host.RequestLocationInfo("")
+	if err != nil {
+		return "", err
+	}
+	return loc.ID, nil
+}
+
+// LocationCreate makes an HTTP POST to the framework server to create a
+// location named name within the location with ID parentID, which is the
+// root location if blank.
+// This function returns the newly created LocationNode.
+func (host Host) LocationCreate(parentID, name string) (LocationNode, error) {
+	var locNode LocationNode
+	parentID, err := host.rootLocationID(parentID)
+	if err != nil {
+		return locNode, err
+	}
+	uri := host.uri + rootAPISubPath + locationSubPath + "/" + parentID
+	err = host.requestJSON("POST", uri, &LocationCreateRequest{Name: name}, &locNode)
+	return locNode, err
+}
+
+// LocationUpdate makes an HTTP PUT to the framework server to update the
+// location with ID locID.
+// This function returns the updated LocationNode.
+func (host Host) LocationUpdate(locID string, update LocationUpdateRequest) (LocationNode, error) {
+	var locNode LocationNode
+	uri := host.uri + rootAPISubPath + locationSubPath + "/" + locID
+	err := host.requestJSON("PUT", uri, &update, &locNode)
+	return locNode, err
+}
+
+// LocationDelete makes an HTTP DELETE to the framework server to delete the
+// location with ID locID
+func (host Host) LocationDelete(locID string) error {
+	uri := host.uri + rootAPISubPath + locationSubPath + "/" + locID
+	return host.requestJSON("DELETE", uri, nil, nil)
+}
+
+// DeviceMove moves the device with ID deviceID to the location with ID locID.
+// This function returns the updated DeviceNode.
+func (host Host) DeviceMove(deviceID, locID string) (DeviceNode, error) {
+	return host.DeviceUpdate(deviceID, DeviceUpdateRequest{LocationID: locID})
+}
+
+// LocationTree is a location along with the devices directly at the location
+// and its sublocations
+type LocationTree struct {
+	Location     LocationNode
+	Devices      []NodeDescriptor
+	Sublocations []*LocationTree
+}
+
+// LocationTree fetches the tree of locations below and including the
+// location with ID rootID, which is the root location if blank.
+// The locations are fetched concurrently.
+func (host Host) LocationTree(rootID string) (*LocationTree, error) {
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, locationTreeConcurrency)
+		errLock  sync.Mutex
+		firstErr error
+	)
+	// failed reports whether a location could not be fetched, which stops
+	// the walk, since the tree is then thrown away
+	failed := func() bool {
+		errLock.Lock()
+		defer errLock.Unlock()
+		return firstErr != nil
+	}
+
+	var fetch func(tree *LocationTree, locID string)
+	fetch = func(tree *LocationTree, locID string) {
+		defer wg.Done()
+
+		sem <- struct{}{}
+		if failed() {
+			<-sem
+			return
+		}
+		loc, err := host.RequestLocationInfo(locID)
+		var devices []NodeDescriptor
+		if err == nil && !failed() {
+			devices, err = host.RequestLocationDevices(loc.ID, false)
+		}
+		<-sem
+		if err != nil {
+			errLock.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			errLock.Unlock()
+			return
+		}
+
+		if failed() {
+			return
+		}
+		tree.Location = loc
+		tree.Devices = devices
+		tree.Sublocations = make([]*LocationTree, len(loc.Children))
+		for i, childID := range loc.Children {
+			child := new(LocationTree)
+			tree.Sublocations[i] = child
+			wg.Add(1)
+			go fetch(child, childID)
+		}
+	}
+
+	root := new(LocationTree)
+	wg.Add(1)
+	go fetch(root, rootID)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return root, nil
+}
+
+// Walk calls fn for each location in the tree, parents before their
+// sublocations, along with the location's depth below t.
+// If fn returns SkipLocation, the sublocations of that location are skipped.
+// Any other error stops the walk and is returned.
+func (t *LocationTree) Walk(fn func(tree *LocationTree, depth int) error) error {
+	err := t.walk(fn, 0)
+	if err == SkipLocation {
+		return nil
+	}
+	return err
+}
+
+func (t *LocationTree) walk(fn func(tree *LocationTree, depth int) error, depth int) error {
+	if err := fn(t, depth); err != nil {
+		return err
+	}
+	for _, sub := range t.Sublocations {
+		if err := sub.walk(fn, depth+1); err != nil && err != SkipLocation {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find returns the first location in the tree, in Walk order, for which match
+// returns true, or nil if there is none
+func (t *LocationTree) Find(match func(tree *LocationTree) bool) *LocationTree {
+	var found *LocationTree
+	t.Walk(func(tree *LocationTree, depth int) error {
+		if match(tree) {
+			found = tree
+			return errLocationFound
+		}
+		return nil
+	})
+	return found
+}
+
+// errLocationFound stops the walk of Find
+var errLocationFound = errors.New("Location found")
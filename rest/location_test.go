@@ -0,0 +1,152 @@
+package rest_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openchirp/framework/rest"
+)
+
+func TestHost_LocationCreateUpdateDelete(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+
+	root := rest.LocationNode{ID: "root", Name: "Root"}
+	f.reply("GET", "/apiv1/location", []rest.LocationNode{root})
+	created := rest.LocationNode{ID: "loc1", Name: "Lab"}
+	f.reply("POST", "/apiv1/location/root", created)
+	loc, err := host.LocationCreate("", "Lab")
+	if err != nil {
+		t.Fatal("Error creating location:", err)
+	}
+	if !reflect.DeepEqual(loc, created) {
+		t.Fatalf("Expected created location %+v, got %+v", created, loc)
+	}
+	expectedBody := map[string]interface{}{"name": "Lab"}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected create body %v, got %v", expectedBody, body)
+	}
+
+	renamed := created
+	renamed.Name = "Lab 2"
+	f.reply("PUT", "/apiv1/location/loc1", renamed)
+	loc, err = host.LocationUpdate("loc1", rest.LocationUpdateRequest{Name: "Lab 2"})
+	if err != nil {
+		t.Fatal("Error updating location:", err)
+	}
+	if loc.Name != "Lab 2" {
+		t.Fatalf("Expected renamed location, got %+v", loc)
+	}
+
+	f.reply("PUT", "/apiv1/device/dev1", rest.DeviceNode{LocationID: "loc1"})
+	device, err := host.DeviceMove("dev1", "loc1")
+	if err != nil {
+		t.Fatal("Error moving device:", err)
+	}
+	if device.LocationID != "loc1" {
+		t.Fatalf("Expected device at loc1, got %+v", device)
+	}
+	expectedBody = map[string]interface{}{"location_id": "loc1"}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected move body %v, got %v", expectedBody, body)
+	}
+
+	f.reply("DELETE", "/apiv1/location/loc1", map[string]string{})
+	if err := host.LocationDelete("loc1"); err != nil {
+		t.Fatal("Error deleting location:", err)
+	}
+}
+
+func TestHost_LocationTree(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+
+	locations := []rest.LocationNode{
+		{ID: "root", Name: "Root", Children: []string{"a", "b"}},
+		{ID: "a", Name: "A", Children: []string{"c"}},
+		{ID: "b", Name: "B"},
+		{ID: "c", Name: "C"},
+	}
+	f.reply("GET", "/apiv1/location", locations[:1])
+	for _, loc := range locations {
+		f.reply("GET", "/apiv1/location/"+loc.ID, loc)
+		f.reply("GET", "/apiv1/location/"+loc.ID+"/devices", []rest.NodeDescriptor{
+			{ID: "dev-" + loc.ID, Name: "Device " + loc.Name},
+		})
+	}
+
+	tree, err := host.LocationTree("")
+	if err != nil {
+		t.Fatal("Error fetching location tree:", err)
+	}
+
+	var visited []string
+	err = tree.Walk(func(tree *rest.LocationTree, depth int) error {
+		if len(tree.Devices) != 1 || tree.Devices[0].ID != "dev-"+tree.Location.ID {
+			t.Errorf("Unexpected devices at %s: %+v", tree.Location.ID, tree.Devices)
+		}
+		visited = append(visited, tree.Location.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Unexpected walk error:", err)
+	}
+	if expected := []string{"root", "a", "c", "b"}; !reflect.DeepEqual(visited, expected) {
+		t.Fatalf("Expected walk order %v, got %v", expected, visited)
+	}
+
+	visited = nil
+	tree.Walk(func(tree *rest.LocationTree, depth int) error {
+		visited = append(visited, tree.Location.ID)
+		if tree.Location.ID == "a" {
+			return rest.SkipLocation
+		}
+		return nil
+	})
+	if expected := []string{"root", "a", "b"}; !reflect.DeepEqual(visited, expected) {
+		t.Fatalf("Expected skipped walk order %v, got %v", expected, visited)
+	}
+
+	found := tree.Find(func(tree *rest.LocationTree) bool {
+		return tree.Location.Name == "C"
+	})
+	if found == nil || found.Location.ID != "c" {
+		t.Fatalf("Expected to find location c, got %+v", found)
+	}
+	if tree.Find(func(*rest.LocationTree) bool { return false }) != nil {
+		t.Fatal("Expected no location to be found")
+	}
+}
+
+func TestHost_LocationTreeStopsOnError(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+
+	f.reply("GET", "/apiv1/location/root", rest.LocationNode{ID: "root", Children: []string{"bad", "a"}})
+	f.reply("GET", "/apiv1/location/root/devices", []rest.NodeDescriptor{})
+	f.handle("GET", "/apiv1/location/bad", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	})
+	// Answer a only after the failure of bad has been received
+	f.handle("GET", "/apiv1/location/a", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(rest.LocationNode{ID: "a", Children: []string{"c"}})
+	})
+
+	if _, err := host.LocationTree("root"); err == nil {
+		t.Fatal("Expected the invalid location to fail the tree")
+	}
+	// The rest of the tree is not fetched once a location failed
+	for _, r := range f.requestLog() {
+		if strings.HasPrefix(r.Path, "/apiv1/location/a/") || strings.HasPrefix(r.Path, "/apiv1/location/c") {
+			t.Errorf("Unexpected request %s %s after the failure", r.Method, r.Path)
+		}
+	}
+}
@@ -7,8 +7,10 @@
 package rest
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 )
 
@@ -19,9 +21,14 @@ const (
 	servicesSubPath       = "/service"
 	serviceDevicesSubPath = "/things"
 	serviceTokenSubPath   = "/token"
+	deviceTokenSubPath    = "/token"
+	userTokenSubPath      = "/token"
 	locationSubPath       = "/location"
 	userSubPath           = "/user"
 	groupSubPath          = "/group"
+	groupMemberSubPath    = "/member"
+	groupMembersSubPath   = "/members"
+	aclSubPath            = "/acl"
 	healthCheckSubPath    = "/check"
 )
 
@@ -72,11 +79,63 @@ func NewHost(uri string) Host {
 	return Host{uri: uri, client: http.Client{}}
 }
 
-func (host *Host) Login(username, password string) error {
+// SetCredentials sets the credentials used for subsequent requests without
+// checking them. This is used for device and service credentials, which can
+// not be validated as a user.
+func (host *Host) SetCredentials(username, password string) {
 	host.user = username
 	host.pass = password
-	// TODO: Check login credentials -- return error if no good
-	return nil
+}
+
+// Login validates the user credentials against the framework server and uses
+// them for subsequent requests. Only user credentials are accepted, so device
+// and service credentials must be set using SetCredentials.
+// This function returns the authenticated user's details. If the credentials
+// are rejected, the previous credentials are kept.
+func (host *Host) Login(username, password string) (UserDetails, error) {
+	prevUser, prevPass := host.user, host.pass
+	host.SetCredentials(username, password)
+	user, err := host.RequestUserInfo()
+	if err != nil {
+		host.SetCredentials(prevUser, prevPass)
+		return user, err
+	}
+	return user, nil
+}
+
+// requestJSON makes an HTTP request to uri with the JSON encoding of in as the
+// body, if in is not nil, and decodes the JSON response into out, if out is
+// not nil
+func (host Host) requestJSON(method, uri string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	req.SetBasicAuth(host.user, host.pass)
+
+	resp, err := host.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := DecodeOCError(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
 }
 
 // PubSub describes a node's pubsub endpoint
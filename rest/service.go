@@ -36,6 +36,36 @@ type ServiceUpdateRequest struct {
 	ConfigParameters []ServiceConfigParameter `json:"config_required,omitempty"`
 }
 
+// ServiceUpdatePartial encapsulates the data for a request to update some of
+// the fields of a service. Only the fields that are set are updated, so nil
+// fields are left unchanged, while a non-nil empty Properties or
+// ConfigParameters clears them.
+// Properties replaces all of the service's properties.
+type ServiceUpdatePartial struct {
+	Name             *string
+	Description      *string
+	Properties       map[string]string
+	ConfigParameters []ServiceConfigParameter
+}
+
+// MarshalJSON encodes only the fields of the update that are set
+func (r ServiceUpdatePartial) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{})
+	if r.Name != nil {
+		fields["name"] = *r.Name
+	}
+	if r.Description != nil {
+		fields["description"] = *r.Description
+	}
+	if r.Properties != nil {
+		fields["properties"] = r.Properties
+	}
+	if r.ConfigParameters != nil {
+		fields["config_required"] = r.ConfigParameters
+	}
+	return json.Marshal(fields)
+}
+
 /*
 Services Device Config Responses Look Like The Following:
 [
@@ -302,6 +332,16 @@ func (host Host) ServiceDelete(serviceID string) error {
 	return nil
 }
 
+// ServiceUpdate makes an HTTP PUT request to the framework server
+// in order to update the fields of the service that are set in update.
+// This function returns the new and updated ServiceNode.
+func (host Host) ServiceUpdate(serviceID string, update ServiceUpdatePartial) (ServiceNode, error) {
+	var serviceNode ServiceNode
+	uri := host.uri + rootAPISubPath + servicesSubPath + "/" + serviceID
+	err := host.requestJSON("PUT", uri, &update, &serviceNode)
+	return serviceNode, err
+}
+
 // ServiceUpdateConfig makes an HTTP PUT request to the framework server
 // in order to update the service's config.
 // This function returns the new and updated ServiceNode.
@@ -309,43 +349,13 @@ func (host Host) ServiceUpdateConfig(
 	serviceID string,
 	configParams []ServiceConfigParameter, // can be nil
 ) (ServiceNode, error) {
-
-	var serviceNode ServiceNode
-	uri := host.uri + rootAPISubPath + servicesSubPath + "/" + serviceID
-	serviceReq := ServiceUpdateRequest{
-		// This blank slice will ensure that we can clear the config if configParams
-		// is nil
-		ConfigParameters: []ServiceConfigParameter{},
+	if configParams == nil {
+		// This blank slice will ensure that we clear the config
+		configParams = []ServiceConfigParameter{}
 	}
-
-	if configParams != nil {
-		serviceReq.ConfigParameters = configParams
-	}
-
-	body, err := json.Marshal(&serviceReq)
-	if err != nil {
-		return serviceNode, err
-	}
-	req, err := http.NewRequest("PUT", uri, bytes.NewReader(body))
-	if err != nil {
-		return serviceNode, err
-	}
-	req.Header.Add("Content-Type", "application/json")
-	req.SetBasicAuth(host.user, host.pass)
-
-	resp, err := host.client.Do(req)
-	if err != nil {
-		// should report auth problems here in future
-		return serviceNode, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != httpStatusCodeOK {
-		return serviceNode, fmt.Errorf("%v", resp.Status)
-	}
-
-	err = json.NewDecoder(resp.Body).Decode(&serviceNode)
-
-	return serviceNode, err
+	return host.ServiceUpdate(serviceID, ServiceUpdatePartial{
+		ConfigParameters: configParams,
+	})
 }
 
 // ServiceTokenGenerate makes an HTTP POST request to the framework server
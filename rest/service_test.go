@@ -2,6 +2,7 @@ package rest_test
 
 import (
 	"os"
+	"reflect"
 	"testing"
 
 	"github.com/openchirp/framework/rest"
@@ -14,7 +15,7 @@ func TestHost_ServiceCreateAndCheck(t *testing.T) {
 	token := os.Getenv("USER_TOKEN")
 
 	host := rest.NewHost(frameworkUri)
-	if err := host.Login(id, token); err != nil {
+	if _, err := host.Login(id, token); err != nil {
 		t.Error("Error logging in:", err)
 		return
 	}
@@ -56,7 +57,7 @@ func TestHost_ServiceCreateAndDelete(t *testing.T) {
 	token := os.Getenv("USER_TOKEN")
 
 	host := rest.NewHost(frameworkUri)
-	if err := host.Login(id, token); err != nil {
+	if _, err := host.Login(id, token); err != nil {
 		t.Error("Error logging in:", err)
 		return
 	}
@@ -74,3 +75,46 @@ func TestHost_ServiceCreateAndDelete(t *testing.T) {
 		return
 	}
 }
+
+func TestHost_ServiceUpdatePartial(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+	servicePath := "/apiv1/service/svc1"
+	f.reply("PUT", servicePath, rest.ServiceNode{Description: ""})
+
+	// Fields that are not set must not be sent
+	name := "Counter"
+	if _, err := host.ServiceUpdate("svc1", rest.ServiceUpdatePartial{Name: &name}); err != nil {
+		t.Fatal("Error updating service:", err)
+	}
+	expectedBody := map[string]interface{}{"name": "Counter"}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected update body %v, got %v", expectedBody, body)
+	}
+
+	// Fields that are set to empty values must be sent, so they are cleared
+	empty := ""
+	_, err := host.ServiceUpdate("svc1", rest.ServiceUpdatePartial{
+		Description: &empty,
+		Properties:  map[string]string{},
+	})
+	if err != nil {
+		t.Fatal("Error updating service:", err)
+	}
+	expectedBody = map[string]interface{}{
+		"description": "",
+		"properties":  map[string]interface{}{},
+	}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected update body %v, got %v", expectedBody, body)
+	}
+
+	if _, err := host.ServiceUpdateConfig("svc1", nil); err != nil {
+		t.Fatal("Error updating service config:", err)
+	}
+	expectedBody = map[string]interface{}{"config_required": []interface{}{}}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected config body %v, got %v", expectedBody, body)
+	}
+}
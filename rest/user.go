@@ -41,6 +41,13 @@ type UserCreateRequest struct {
 	Password string `json:"password"`
 }
 
+// UserUpdateRequest encapsulates the data for a request to update the
+// authenticated user. Blank fields are left unchanged.
+type UserUpdateRequest struct {
+	Name     string `json:"name,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
 func (n GroupNode) String() string {
 	buf, _ := json.MarshalIndent(&n, "", jsonPrettyIndent)
 	return string(buf)
@@ -136,3 +143,45 @@ func (host Host) UserCreate(email, name, password string) error {
 	defer resp.Body.Close()
 	return DecodeOCError(resp)
 }
+
+// UserUpdate makes an HTTP PUT to the framework server to update the name or
+// password of the authenticated user.
+// This function returns the updated User.
+func (host Host) UserUpdate(update UserUpdateRequest) (User, error) {
+	var user User
+	uri := host.uri + rootAPISubPath + userSubPath
+	err := host.requestJSON("PUT", uri, &update, &user)
+	return user, err
+}
+
+// UserDelete makes an HTTP DELETE to the framework server to delete the user
+// with ID userID. This requires admin privileges.
+func (host Host) UserDelete(userID string) error {
+	uri := host.uri + rootAPISubPath + userSubPath + "/" + userID
+	return host.requestJSON("DELETE", uri, nil, nil)
+}
+
+// UserTokenGenerate makes an HTTP POST to the framework server to generate
+// an API token for the authenticated user
+func (host Host) UserTokenGenerate() (string, error) {
+	var token string
+	uri := host.uri + rootAPISubPath + userSubPath + userTokenSubPath
+	err := host.requestJSON("POST", uri, nil, &token)
+	return token, err
+}
+
+// UserTokenRegenerate makes an HTTP PUT to the framework server to replace
+// the API token of the authenticated user
+func (host Host) UserTokenRegenerate() (string, error) {
+	var token string
+	uri := host.uri + rootAPISubPath + userSubPath + userTokenSubPath
+	err := host.requestJSON("PUT", uri, nil, &token)
+	return token, err
+}
+
+// UserTokenDelete makes an HTTP DELETE to the framework server to revoke the
+// API token of the authenticated user
+func (host Host) UserTokenDelete() error {
+	uri := host.uri + rootAPISubPath + userSubPath + userTokenSubPath
+	return host.requestJSON("DELETE", uri, nil, nil)
+}
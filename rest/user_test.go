@@ -1,7 +1,9 @@
 package rest_test
 
 import (
+	"net/http"
 	"os"
+	"reflect"
 	"testing"
 
 	"github.com/openchirp/framework/rest"
@@ -14,7 +16,7 @@ func TestHost_RequestLocationInfo(t *testing.T) {
 	token := os.Getenv("USER_TOKEN")
 
 	host := rest.NewHost(frameworkUri)
-	if err := host.Login(id, token); err != nil {
+	if _, err := host.Login(id, token); err != nil {
 		t.Error("Error logging in:", err)
 		return
 	}
@@ -40,7 +42,7 @@ func TestHost_RequestUserInfo(t *testing.T) {
 	token := os.Getenv("USER_TOKEN")
 
 	host := rest.NewHost(frameworkUri)
-	if err := host.Login(id, token); err != nil {
+	if _, err := host.Login(id, token); err != nil {
 		t.Error("Error logging in:", err)
 		return
 	}
@@ -52,3 +54,67 @@ func TestHost_RequestUserInfo(t *testing.T) {
 	}
 	t.Log(uInfo)
 }
+
+func TestHost_Login(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	details := rest.UserDetails{
+		User:   rest.User{ID: fakeUser, Name: "Alice", Email: "alice@example.com"},
+		Groups: []rest.GroupNode{{ID: "g1", Name: "Lab", WriteAccess: true}},
+	}
+	f.reply("GET", "/apiv1/user", details)
+
+	host := rest.NewHost(f.server.URL)
+	user, err := host.Login(fakeUser, fakeToken)
+	if err != nil {
+		t.Fatal("Error logging in:", err)
+	}
+	if !reflect.DeepEqual(user, details) {
+		t.Fatalf("Expected user details %+v, got %+v", details, user)
+	}
+
+	// Rejected credentials must not replace the working ones
+	if _, err := host.Login(fakeUser, "wrong"); err == nil {
+		t.Fatal("Expected bad credentials to be rejected")
+	}
+	if _, err := host.RequestUserInfo(); err != nil {
+		t.Fatal("Expected previous credentials to be kept, got", err)
+	}
+}
+
+func TestHost_UserManagement(t *testing.T) {
+	f := newFakeFramework(t)
+	defer f.server.Close()
+	host := f.host()
+
+	f.reply("PUT", "/apiv1/user", rest.User{ID: fakeUser, Name: "Alice B"})
+	user, err := host.UserUpdate(rest.UserUpdateRequest{Name: "Alice B"})
+	if err != nil || user.Name != "Alice B" {
+		t.Fatalf("Expected renamed user, got %+v, %v", user, err)
+	}
+	// The password must not be sent unless it is changed
+	expectedBody := map[string]interface{}{"name": "Alice B"}
+	if body := f.lastRequest().Body; !reflect.DeepEqual(body, expectedBody) {
+		t.Fatalf("Expected update body %v, got %v", expectedBody, body)
+	}
+
+	f.reply("POST", "/apiv1/user/token", "Zxkq8vDbLEMzZ9b1tQ2wH7Rk")
+	token, err := host.UserTokenGenerate()
+	if err != nil || token != "Zxkq8vDbLEMzZ9b1tQ2wH7Rk" {
+		t.Fatalf("Expected generated token, got %q, %v", token, err)
+	}
+	f.reply("PUT", "/apiv1/user/token", "Pq3nR8sT0uV2wX4yZ6aB8cD0")
+	token, err = host.UserTokenRegenerate()
+	if err != nil || token != "Pq3nR8sT0uV2wX4yZ6aB8cD0" {
+		t.Fatalf("Expected regenerated token, got %q, %v", token, err)
+	}
+	f.reply("DELETE", "/apiv1/user/token", map[string]string{})
+	if err := host.UserTokenDelete(); err != nil {
+		t.Fatal("Error deleting token:", err)
+	}
+
+	f.fail("DELETE", "/apiv1/user/u2", http.StatusForbidden, "Admin privileges required")
+	if err := host.UserDelete("u2"); err == nil || err.Error() != "Admin privileges required" {
+		t.Fatalf("Expected the server's error message, got %v", err)
+	}
+}
@@ -1,12 +1,14 @@
 package framework
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
 
 	"encoding/json"
 
+	"github.com/openchirp/framework/pubsub"
 	"github.com/openchirp/framework/rest"
 )
 
@@ -77,16 +79,28 @@ type ServiceTopicHandler func(client *ServiceClient, topic string, payload []byt
 // ServiceClient hold a single ses.Publish(s.)rvice context
 type ServiceClient struct {
 	Client
-	node           rest.ServiceNode
-	updatesWg      sync.WaitGroup
-	updatesRunning bool
-	updatesQueue   chan DeviceUpdate
-	updates        chan DeviceUpdate
-	manager        serviceRuntimeManager
+	node                rest.ServiceNode
+	propertiesLock      sync.RWMutex
+	propertiesVersion   uint64 // incremented by SetProperties
+	propertiesWatchLock sync.Mutex
+	propertiesWatch     *propertiesWatch
+	onPropertiesChanged func(old, new map[string]string)
+	updatesWg           sync.WaitGroup
+	updatesRunning      bool
+	updatesBuffering    int // overrides deviceUpdatesBuffering, if nonzero
+	updatesQueue        chan DeviceUpdate
+	updates             chan DeviceUpdate
+	manager             serviceRuntimeManager
+	electionLock        sync.Mutex
+	election            *leaderElection
+	onElected           func()
+	onDemoted           func()
 }
 
 type serviceRuntimeManager interface {
 	Stop()
+	setShard(index, count int) error
+	droppedMessages() uint64
 }
 
 /*
@@ -172,8 +186,14 @@ func StartServiceClientStatus(frameworkURI, brokerURI, id, token, statusmsg stri
 	return c, nil
 }
 
-// StopClient shuts down a started service
+// StopClient shuts down a started service.
+// A managed service first drains the device messages it already received,
+// calls ProcessShutdown on each ShutdownAwareDevice, and publishes the final
+// service status set by WithShutdownStatus, if any, within the timeout set by
+// WithShutdownTimeout.
 func (c *ServiceClient) StopClient() {
+	c.StopElection()
+	c.StopPropertiesWatch()
 	if c.manager != nil {
 		c.manager.Stop()
 	}
@@ -251,7 +271,11 @@ func (c *ServiceClient) startDeviceUpdatesQueue() error {
 		return ErrDeviceUpdatesAlreadyStarted
 	}
 	c.updatesRunning = true
-	c.updatesQueue = make(chan DeviceUpdate, deviceUpdatesBuffering)
+	buffering := deviceUpdatesBuffering
+	if c.updatesBuffering > 0 {
+		buffering = c.updatesBuffering
+	}
+	c.updatesQueue = make(chan DeviceUpdate, buffering)
 	err := c.Subscribe(topicEvents, c.updateEventsHandler())
 	if err != nil {
 		c.stopDeviceUpdatesQueue()
@@ -387,6 +411,12 @@ func (c *ServiceClient) Subscribe(topic string, callback func(topic string, payl
 	return c.subscribe(topic, callback)
 }
 
+// SubscribeQoS registers a callback for a receiving a given mqtt topic payload
+// using the specified QoS
+func (c *ServiceClient) SubscribeQoS(topic string, qos pubsub.MQTTQoS, callback func(topic string, payload []byte)) error {
+	return c.subscribeQoS(topic, qos, callback)
+}
+
 // SubscribeWithClient registers a callback for a receiving a given mqtt
 // topic payload and provides the client object
 func (c *ServiceClient) SubscribeWithClient(topic string, callback ServiceTopicHandler) error {
@@ -400,21 +430,125 @@ func (c *ServiceClient) Unsubscribe(topics ...string) error {
 	return c.unsubscribe(topics...)
 }
 
+// SubscribeHandler registers a callback for a receiving a given mqtt topic
+// payload and returns an id that can be used to deregister only this callback
+func (c *ServiceClient) SubscribeHandler(topic string, callback func(topic string, payload []byte)) (pubsub.SubscriptionID, error) {
+	return c.subscribeHandler(topic, mqttQoS, callback)
+}
+
+// UnsubscribeHandler deregisters the callbacks identified by ids
+func (c *ServiceClient) UnsubscribeHandler(ids ...pubsub.SubscriptionID) error {
+	return c.unsubscribeHandler(ids...)
+}
+
 // Publish publishes a payload to a given mqtt topic
 func (c *ServiceClient) Publish(topic string, payload interface{}) error {
 	return c.publish(topic, payload)
 }
 
-// GetProperties returns the full service properties key/value mapping
+// PublishOpts publishes a payload to a given mqtt topic using the specified
+// QoS and retained flag
+func (c *ServiceClient) PublishOpts(topic string, payload interface{}, qos pubsub.MQTTQoS, retained bool) error {
+	return c.publishOpts(topic, payload, qos, retained)
+}
+
+// Request publishes payload as a request to topic and waits for the
+// response. If ctx has no deadline, pubsub.DefaultRPCTimeout is used.
+// See pubsub.RPC for details.
+func (c *ServiceClient) Request(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+	rpc, err := c.getRPC(c.node.Pubsub.Topic + "/" + rpcSubtopic)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.Request(ctx, topic, payload)
+}
+
+// HandleRequests serves requests received on topic using handler
+func (c *ServiceClient) HandleRequests(topic string, handler pubsub.RPCHandler) error {
+	rpc, err := c.getRPC(c.node.Pubsub.Topic + "/" + rpcSubtopic)
+	if err != nil {
+		return err
+	}
+	return rpc.HandleRequests(topic, handler)
+}
+
+// StopHandlingRequests stops serving requests on the given topics
+func (c *ServiceClient) StopHandlingRequests(topics ...string) error {
+	rpc, err := c.getRPC(c.node.Pubsub.Topic + "/" + rpcSubtopic)
+	if err != nil {
+		return err
+	}
+	return rpc.StopHandlingRequests(topics...)
+}
+
+// GetProperties returns the full service properties key/value mapping.
+// The returned map must not be modified.
 func (c *ServiceClient) GetProperties() map[string]string {
+	c.propertiesLock.RLock()
+	defer c.propertiesLock.RUnlock()
 	return c.node.Properties
 }
 
 // GetProperty fetches the service property associated with key. If it does
 // not exist the blank string is returned.
 func (c *ServiceClient) GetProperty(key string) string {
+	c.propertiesLock.RLock()
+	defer c.propertiesLock.RUnlock()
 	if value, ok := c.node.Properties[key]; ok {
 		return value
 	}
 	return ""
 }
+
+// SetProperty persists the service property key with value in the framework
+func (c *ServiceClient) SetProperty(key, value string) error {
+	return c.SetProperties(map[string]string{key: value})
+}
+
+// SetProperties persists the given service properties in the framework.
+// Existing properties that are not given are left unchanged.
+func (c *ServiceClient) SetProperties(properties map[string]string) error {
+	c.propertiesLock.RLock()
+	version := c.propertiesVersion
+	c.propertiesLock.RUnlock()
+
+	// The cached properties may be stale, so merge into the current ones
+	current, err := c.host.RequestServiceInfo(c.id)
+	if err != nil {
+		return err
+	}
+	merged := make(map[string]string, len(current.Properties)+len(properties))
+	for key, value := range current.Properties {
+		merged[key] = value
+	}
+	for key, value := range properties {
+		merged[key] = value
+	}
+	node, err := c.host.ServiceUpdate(c.id, rest.ServiceUpdatePartial{
+		Properties: merged,
+	})
+	if err != nil {
+		return err
+	}
+	if node.Properties == nil {
+		node.Properties = merged
+	}
+
+	c.propertiesLock.Lock()
+	defer c.propertiesLock.Unlock()
+	if c.propertiesVersion != version {
+		// Another SetProperties updated the cache meanwhile, so only add
+		// the given properties to it
+		updated := make(map[string]string, len(c.node.Properties)+len(properties))
+		for key, value := range c.node.Properties {
+			updated[key] = value
+		}
+		for key, value := range properties {
+			updated[key] = value
+		}
+		node.Properties = updated
+	}
+	c.node.Properties = node.Properties
+	c.propertiesVersion++
+	return nil
+}
@@ -0,0 +1,204 @@
+package framework
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/openchirp/framework/pubsub"
+)
+
+const (
+	// deadLetterSubtopic is the subtopic of the service status topic that
+	// dead letters are published to by default
+	deadLetterSubtopic = "deadletter"
+)
+
+// ErrorReportingDevice may be implemented by a Device in order to report
+// message processing failures. When implemented, ProcessMessageErr is called
+// instead of ProcessMessage and a returned error causes the message to be
+// sent to the dead letter sinks configured with WithDeadLetterTopic,
+// WithDeadLetterFile, or WithDeadLetterSink.
+type ErrorReportingDevice interface {
+	ProcessMessageErr(ctrl *DeviceControl, msg Message) error
+}
+
+/*
+Dead letters are encoded as JSON, where the payload is base64 encoded:
+{
+	"device_id": "5930aaf27d6ec25f901d96da",
+	"topic": "openchirp/device/5930aaf27d6ec25f901d96da/rawrx",
+	"subtopic": "rawrx",
+	"payload": "eyJ0ZW1wIjogMjF9",
+	"error": "Message payload exceeds the size limit",
+	"time": "2017-06-01T12:30:00Z"
+}
+*/
+
+// DeadLetter is a device message that could not be processed along with the
+// reason
+type DeadLetter struct {
+	DeviceID string    `json:"device_id"`
+	Topic    string    `json:"topic"`
+	Subtopic string    `json:"subtopic"`
+	Payload  []byte    `json:"payload"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+// DeadLetterSink stores dead letters for later inspection or replay
+type DeadLetterSink interface {
+	WriteDeadLetter(letter DeadLetter) error
+}
+
+// PubSubDeadLetterSink publishes dead letters as JSON to a pubsub topic
+type PubSubDeadLetterSink struct {
+	ps    pubsub.PubSub
+	topic string
+}
+
+// NewPubSubDeadLetterSink creates a sink that publishes dead letters to topic
+func NewPubSubDeadLetterSink(ps pubsub.PubSub, topic string) *PubSubDeadLetterSink {
+	return &PubSubDeadLetterSink{ps: ps, topic: topic}
+}
+
+// WriteDeadLetter publishes letter to the sink's topic
+func (s *PubSubDeadLetterSink) WriteDeadLetter(letter DeadLetter) error {
+	payload, err := json.Marshal(&letter)
+	if err != nil {
+		return err
+	}
+	return s.ps.Publish(s.topic, payload)
+}
+
+// FileDeadLetterSink appends dead letters to a file, one JSON object per line
+type FileDeadLetterSink struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// NewFileDeadLetterSink opens or creates the file at path for appending
+// dead letters
+func NewFileDeadLetterSink(path string) (*FileDeadLetterSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterSink{file: file}, nil
+}
+
+// WriteDeadLetter appends letter to the file
+func (s *FileDeadLetterSink) WriteDeadLetter(letter DeadLetter) error {
+	line, err := json.Marshal(&letter)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.file.Write(line)
+	return err
+}
+
+// Close closes the file
+func (s *FileDeadLetterSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
+
+// ReadDeadLetters reads dead letters written one JSON object per line, as
+// by FileDeadLetterSink. Blank lines are skipped.
+func ReadDeadLetters(r io.Reader) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(r)
+	// Allow lines with large payloads
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return letters, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, scanner.Err()
+}
+
+// ReplayDeadLetters republishes each letter's payload to its original topic,
+// which reinjects it into the services subscribed to that topic
+func ReplayDeadLetters(ps pubsub.PubSub, letters ...DeadLetter) error {
+	for _, letter := range letters {
+		if err := ps.Publish(letter.Topic, letter.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithDeadLetterTopic publishes messages that devices fail to process, as
+// DeadLetter JSON, to topic. If topic is blank, the deadletter subtopic of
+// the service's status topic is used.
+func WithDeadLetterTopic(topic string) ManagedOption {
+	return func(m *serviceManager) {
+		if topic == "" {
+			topic = m.c.node.Pubsub.TopicStatus + "/" + deadLetterSubtopic
+		}
+		m.deadLetterSinks = append(m.deadLetterSinks, NewPubSubDeadLetterSink(m.c, topic))
+	}
+}
+
+// WithDeadLetterFile appends messages that devices fail to process, as
+// DeadLetter JSON lines, to the file at path. The file is closed when the
+// service client is stopped. Use ReadDeadLetters and ReplayDeadLetters to
+// reinject them.
+func WithDeadLetterFile(path string) ManagedOption {
+	return func(m *serviceManager) {
+		sink, err := NewFileDeadLetterSink(path)
+		if err != nil {
+			m.err = err
+			return
+		}
+		m.deadLetterSinks = append(m.deadLetterSinks, sink)
+	}
+}
+
+// WithDeadLetterSink sends messages that devices fail to process to sink.
+// If sink is an io.Closer, it is closed when the service client is stopped.
+func WithDeadLetterSink(sink DeadLetterSink) ManagedOption {
+	return func(m *serviceManager) {
+		m.deadLetterSinks = append(m.deadLetterSinks, sink)
+	}
+}
+
+// deadLetter sends a message that failed processing to all dead letter sinks
+func (m *serviceManager) deadLetter(dState *deviceState, topic string, msg Message, err error) {
+	letter := DeadLetter{
+		DeviceID: dState.id,
+		Topic:    topic,
+		Subtopic: msg.Topic(),
+		Payload:  msg.Payload(),
+		Error:    err.Error(),
+		Time:     time.Now().UTC(),
+	}
+	for _, sink := range m.deadLetterSinks {
+		if err := sink.WriteDeadLetter(letter); err != nil {
+			m.logf("Failed to write dead letter for device %s: %v", dState.id, err)
+		}
+	}
+}
+
+// closeDeadLetterSinks closes all sinks that can be closed
+func (m *serviceManager) closeDeadLetterSinks() {
+	for _, sink := range m.deadLetterSinks {
+		if closer, ok := sink.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package framework
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// recordPubSub is a pubsub.PubSub that records all publishes
+type recordPubSub struct {
+	topics   []string
+	payloads [][]byte
+}
+
+func (r *recordPubSub) Subscribe(topic string, callback func(topic string, payload []byte)) error {
+	return nil
+}
+
+func (r *recordPubSub) Unsubscribe(topics ...string) error {
+	return nil
+}
+
+func (r *recordPubSub) Publish(topic string, payload interface{}) error {
+	r.topics = append(r.topics, topic)
+	r.payloads = append(r.payloads, payload.([]byte))
+	return nil
+}
+
+// failingDevice fails to process every message
+type failingDevice struct {
+	Device
+	err error
+}
+
+func (d failingDevice) ProcessMessageErr(ctrl *DeviceControl, msg Message) error {
+	return d.err
+}
+
+func TestDeadLetter_FileAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deadletters.jsonl")
+	sink, err := NewFileDeadLetterSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("unknown payload format")
+	m := &serviceManager{deadLetterSinks: []DeadLetterSink{sink}}
+	dState := &deviceState{
+		id:         "dev1",
+		topic:      "openchirp/device/dev1",
+		userDevice: failingDevice{err: failure},
+	}
+	ctrl := &DeviceControl{manager: m, dState: dState}
+	for _, payload := range []string{"\x01\x02", "\xff"} {
+		msg := Message{topic: "rawrx", payload: []byte(payload)}
+		err := m.processMessage(ctrl, msg)
+		if err != failure {
+			t.Fatalf("Expected device error, got %v", err)
+		}
+		m.deadLetter(dState, "openchirp/device/dev1/rawrx", msg, err)
+	}
+	m.closeDeadLetterSinks()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	letters, err := ReadDeadLetters(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("Expected 2 dead letters, got %d", len(letters))
+	}
+	letter := letters[0]
+	if letter.DeviceID != "dev1" || letter.Subtopic != "rawrx" || letter.Error != failure.Error() ||
+		string(letter.Payload) != "\x01\x02" || letter.Time.IsZero() {
+		t.Fatalf("Unexpected dead letter %+v", letter)
+	}
+
+	var ps recordPubSub
+	if err := ReplayDeadLetters(&ps, letters...); err != nil {
+		t.Fatal(err)
+	}
+	if len(ps.topics) != 2 || ps.topics[1] != "openchirp/device/dev1/rawrx" || string(ps.payloads[1]) != "\xff" {
+		t.Fatalf("Unexpected replay %v %q", ps.topics, ps.payloads)
+	}
+}
@@ -0,0 +1,497 @@
+package framework
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	CRAND "crypto/rand"
+
+	"github.com/openchirp/framework/pubsub"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLeaderLease is the lease used by StartElection when none is given
+	DefaultLeaderLease = 15 * time.Second
+	// leaderSubtopic is the service subtopic that carries the retained lease
+	leaderSubtopic = "leader"
+)
+
+var ErrElectionAlreadyStarted = errors.New("Leader election already started")
+var ErrElectionNotStarted = errors.New("Leader election not started")
+
+/*
+Leases are published retained to the service's leader subtopic:
+openchirp/service/592880c57d6ec25f901d9668/leader:
+{
+	"holder": "myservice-1-8c3a5e27d1f09b64",
+	"lease_ms": 15000
+}
+When the leader steps down, or through its will when its connection is lost,
+the lease is released:
+{
+	"holder": "myservice-1-8c3a5e27d1f09b64",
+	"released": true
+}
+*/
+
+// serviceLeaderLease describes the JSON blob used to claim, renew, and
+// release leadership
+type serviceLeaderLease struct {
+	Holder   string `json:"holder"`
+	LeaseMS  int64  `json:"lease_ms,omitempty"`
+	Released bool   `json:"released,omitempty"`
+}
+
+// electionClient is the set of pubsub methods used by the election, which
+// runs on its own connection in order to have its own will
+type electionClient interface {
+	Subscribe(topic string, callback func(topic string, payload []byte)) error
+	PublishOpts(topic string, payload interface{}, qos pubsub.MQTTQoS, retained bool) error
+	Disconnect()
+}
+
+// leaderElection elects a single leader among all candidates using a
+// retained lease message.
+//
+// The latest lease message decides the holder. Candidates consider a lease
+// expired once it has not been renewed for the lease duration after they
+// received it, so clocks need not be synchronized. A candidate claims a free
+// or expired lease by publishing its own lease and only becomes leader once
+// its lease is still the latest after a settle period, which lets
+// concurrent claims resolve to the last one published.
+// The leader renews its lease and steps down if it stops seeing its
+// renewals, such as when it is cut off from the broker.
+type leaderElection struct {
+	client electionClient
+	topic  string
+	id     string
+	lease  time.Duration
+	notify func(leader bool)
+	log    *logrus.Logger
+
+	lock       sync.Mutex
+	stopped    bool
+	leader     bool
+	holder     string        // holder of the latest lease, blank when free
+	holderSeen time.Time     // when the holder's lease was last received
+	holderTTL  time.Duration // the holder's lease duration
+	ownSeen    time.Time     // when our own lease was last received
+	claim      *time.Timer
+	settle     *time.Timer
+	settleGen  int // identifies the current settle timer
+	expiry     *time.Timer
+	done       chan struct{}
+	rand       *rand.Rand // staggers claims
+
+	notifyLock sync.Mutex    // lock for the notification queue
+	pending    []bool        // leader states waiting to be notified, in order
+	notifying  chan struct{} // closed once the queue drains, nil when idle
+}
+
+// newCandidateID generates a unique election candidate id, which starts
+// with the hostname for easier diagnosis
+func newCandidateID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := CRAND.Read(b); err != nil {
+		return "", err
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "candidate"
+	}
+	return hostname + "-" + hex.EncodeToString(b), nil
+}
+
+// leaderRelease returns the payload used to release id's lease
+func leaderRelease(id string) []byte {
+	payload, _ := json.Marshal(&serviceLeaderLease{Holder: id, Released: true})
+	return payload
+}
+
+func newLeaderElection(client electionClient, topic, id string, lease time.Duration, notify func(leader bool)) *leaderElection {
+	// Candidates started together must not stagger their claims alike
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return &leaderElection{
+		client: client,
+		topic:  topic,
+		id:     id,
+		lease:  lease,
+		notify: notify,
+		log:    logrus.StandardLogger(),
+		done:   make(chan struct{}),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(h.Sum64()))),
+	}
+}
+
+// start subscribes to the lease and claims it, if no retained lease is
+// received shortly after subscribing
+func (e *leaderElection) start() error {
+	e.lock.Lock()
+	e.scheduleClaim(e.settleTime())
+	e.lock.Unlock()
+
+	if err := e.client.Subscribe(e.topic, e.onLease); err != nil {
+		e.stop()
+		return err
+	}
+	go e.renewLoop()
+	return nil
+}
+
+// stop ends participation in the election. If we are the leader, the lease
+// is released, so that another candidate takes over immediately.
+func (e *leaderElection) stop() {
+	e.lock.Lock()
+	if e.stopped {
+		e.lock.Unlock()
+		return
+	}
+	e.stopped = true
+	wasLeader := e.leader
+	e.leader = false
+	if wasLeader {
+		e.queueNotify(false)
+	}
+	for _, t := range []*time.Timer{e.claim, e.settle, e.expiry} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	close(e.done)
+	e.lock.Unlock()
+
+	if wasLeader {
+		if err := e.client.PublishOpts(e.topic, leaderRelease(e.id), mqttQoS, true); err != nil {
+			e.log.Printf("Failed to release leader lease: %v", err)
+		}
+	}
+	e.client.Disconnect()
+	e.waitNotified()
+}
+
+func (e *leaderElection) isLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.leader
+}
+
+// settleTime is how long to wait for competing claims or retained leases
+func (e *leaderElection) settleTime() time.Duration {
+	return e.lease / 5
+}
+
+// onLease handles every lease message, including our own
+func (e *leaderElection) onLease(topic string, payload []byte) {
+	var l serviceLeaderLease
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &l); err != nil {
+			e.log.Printf("Ignoring invalid leader lease: %s", payload)
+			return
+		}
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.stopped {
+		return
+	}
+
+	switch {
+	case l.Holder == "" || l.Released:
+		if e.leader && l.Holder != e.id {
+			// A stale release or clear replaced our retained lease
+			go e.publishLease()
+			return
+		}
+		if l.Released && e.holder != "" && l.Holder != e.holder {
+			// Stale release of a previous holder, which the current holder
+			// will replace
+			return
+		}
+		e.holder = ""
+		if e.expiry != nil {
+			e.expiry.Stop()
+		}
+		// Stagger claims to reduce collisions
+		e.scheduleClaim(e.claimDelay())
+	case l.Holder == e.id:
+		e.holder = e.id
+		e.ownSeen = time.Now()
+		if !e.leader && e.settle == nil {
+			e.settleGen++
+			gen := e.settleGen
+			e.settle = time.AfterFunc(e.settleTime(), func() { e.onSettled(gen) })
+		}
+	default:
+		e.holder = l.Holder
+		e.holderSeen = time.Now()
+		e.holderTTL = time.Duration(l.LeaseMS) * time.Millisecond
+		if e.holderTTL <= 0 {
+			e.holderTTL = e.lease
+		}
+		if e.expiry != nil {
+			e.expiry.Stop()
+		}
+		e.expiry = time.AfterFunc(e.holderTTL, e.onExpired)
+		if e.settle != nil {
+			// Our claim was overridden
+			e.settle.Stop()
+			e.settle = nil
+		}
+		if e.leader {
+			e.leader = false
+			e.queueNotify(false)
+		}
+	}
+}
+
+// claimDelay returns a random delay within the settle time, which staggers
+// the claims of candidates to reduce collisions.
+// Must be called with e.lock held.
+func (e *leaderElection) claimDelay() time.Duration {
+	return time.Duration(e.rand.Int63n(int64(e.settleTime()) + 1))
+}
+
+// scheduleClaim claims the lease after delay, if it is still free.
+// Must be called with e.lock held.
+func (e *leaderElection) scheduleClaim(delay time.Duration) {
+	if e.claim != nil {
+		e.claim.Stop()
+	}
+	e.claim = time.AfterFunc(delay, func() {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		if e.stopped || e.leader || e.holder != "" {
+			return
+		}
+		go e.publishLease()
+	})
+}
+
+// onSettled makes us leader if our claim is still the latest lease
+func (e *leaderElection) onSettled(gen int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.settle == nil || e.settleGen != gen {
+		// Stale timer
+		return
+	}
+	e.settle = nil
+	if e.stopped || e.leader || e.holder != e.id {
+		return
+	}
+	e.leader = true
+	e.queueNotify(true)
+}
+
+// onExpired frees the lease of a holder that stopped renewing it
+func (e *leaderElection) onExpired() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.stopped || e.holder == "" || e.holder == e.id || time.Since(e.holderSeen) < e.holderTTL {
+		// Stale timer
+		return
+	}
+	e.holder = ""
+	e.scheduleClaim(e.claimDelay())
+}
+
+// renewLoop renews the lease while we are leader and steps down if our
+// renewals stop arriving
+func (e *leaderElection) renewLoop() {
+	ticker := time.NewTicker(e.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.done:
+			return
+		}
+
+		e.lock.Lock()
+		if !e.leader {
+			e.lock.Unlock()
+			continue
+		}
+		if time.Since(e.ownSeen) > e.lease {
+			// Others may consider our lease expired by now
+			e.leader = false
+			e.queueNotify(false)
+			e.lock.Unlock()
+			continue
+		}
+		e.lock.Unlock()
+		e.publishLease()
+	}
+}
+
+// publishLease claims or renews the lease
+func (e *leaderElection) publishLease() {
+	payload, err := json.Marshal(&serviceLeaderLease{
+		Holder:  e.id,
+		LeaseMS: int64(e.lease / time.Millisecond),
+	})
+	if err != nil {
+		return
+	}
+	if err := e.client.PublishOpts(e.topic, payload, mqttQoS, true); err != nil {
+		e.lock.Lock()
+		stopped := e.stopped
+		e.lock.Unlock()
+		if !stopped {
+			e.log.Printf("Failed to publish leader lease: %v", err)
+		}
+	}
+}
+
+// queueNotify queues a notification of a leadership change. Every change
+// is delivered in order, without blocking the election.
+// Must be called with e.lock held, so that the queue follows the state.
+func (e *leaderElection) queueNotify(leader bool) {
+	e.notifyLock.Lock()
+	defer e.notifyLock.Unlock()
+
+	e.pending = append(e.pending, leader)
+	if e.notifying == nil {
+		e.notifying = make(chan struct{})
+		go e.deliverNotifications(e.notifying)
+	}
+}
+
+// deliverNotifications calls notify for each queued change until the queue
+// is empty and then closes idle
+func (e *leaderElection) deliverNotifications(idle chan struct{}) {
+	for {
+		e.notifyLock.Lock()
+		if len(e.pending) == 0 {
+			e.notifying = nil
+			e.notifyLock.Unlock()
+			close(idle)
+			return
+		}
+		leader := e.pending[0]
+		e.pending = e.pending[1:]
+		e.notifyLock.Unlock()
+
+		e.notify(leader)
+	}
+}
+
+// waitNotified waits for all queued notifications to be delivered
+func (e *leaderElection) waitNotified() {
+	e.notifyLock.Lock()
+	idle := e.notifying
+	e.notifyLock.Unlock()
+	if idle != nil {
+		<-idle
+	}
+}
+
+// StartElection makes this service instance a candidate in the election of
+// a single leader among all instances of the service.
+// The election runs on a dedicated broker connection, whose will releases
+// our lease if the connection is lost. If the lease is not released, it
+// expires when the leader stops renewing it for the lease duration.
+// A lease of zero uses DefaultLeaderLease.
+//
+// Use IsLeader to check whether this instance currently leads, and
+// OnElected and OnDemoted to be notified of changes.
+func (c *ServiceClient) StartElection(lease time.Duration) error {
+	c.electionLock.Lock()
+	defer c.electionLock.Unlock()
+
+	if c.election != nil {
+		return ErrElectionAlreadyStarted
+	}
+	if lease <= 0 {
+		lease = DefaultLeaderLease
+	}
+
+	id, err := newCandidateID()
+	if err != nil {
+		return err
+	}
+	topic := c.node.Pubsub.Topic + "/" + leaderSubtopic
+	client, err := c.connectMQTT(pubsub.MQTTOptions{
+		ClientIDPrefix: "leader",
+		WillTopic:      topic,
+		WillPayload:    leaderRelease(id),
+	}, true)
+	if err != nil {
+		return err
+	}
+
+	election := newLeaderElection(client, topic, id, lease, c.notifyLeader)
+	election.log = c.logger()
+	if err := election.start(); err != nil {
+		return err
+	}
+	c.election = election
+	return nil
+}
+
+// StopElection stops being a candidate. If this instance is the leader,
+// leadership is released and OnDemoted is called.
+func (c *ServiceClient) StopElection() error {
+	c.electionLock.Lock()
+	election := c.election
+	c.election = nil
+	c.electionLock.Unlock()
+
+	if election == nil {
+		return ErrElectionNotStarted
+	}
+	election.stop()
+	return nil
+}
+
+// IsLeader reports whether this instance is currently the elected leader
+func (c *ServiceClient) IsLeader() bool {
+	c.electionLock.Lock()
+	election := c.election
+	c.electionLock.Unlock()
+
+	return election != nil && election.isLeader()
+}
+
+// OnElected sets the callback that is called when this instance becomes the
+// leader. Callbacks are never called concurrently and should not block.
+func (c *ServiceClient) OnElected(callback func()) {
+	c.electionLock.Lock()
+	defer c.electionLock.Unlock()
+	c.onElected = callback
+}
+
+// OnDemoted sets the callback that is called when this instance stops being
+// the leader. Callbacks are never called concurrently and should not block.
+func (c *ServiceClient) OnDemoted(callback func()) {
+	c.electionLock.Lock()
+	defer c.electionLock.Unlock()
+	c.onDemoted = callback
+}
+
+// notifyLeader runs the callback for a leadership change
+func (c *ServiceClient) notifyLeader(leader bool) {
+	c.electionLock.Lock()
+	callback := c.onDemoted
+	if leader {
+		callback = c.onElected
+	}
+	c.electionLock.Unlock()
+
+	if callback != nil {
+		callback()
+	}
+}
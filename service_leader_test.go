@@ -0,0 +1,370 @@
+package framework
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openchirp/framework/pubsub"
+)
+
+// memBroker is an in-process broker stand-in that supports retained messages
+// and wills. Messages are delivered to all connections in the same order.
+type memBroker struct {
+	lock     sync.Mutex // lock for retained and conns
+	deliver  sync.Mutex // serializes delivery, like a single broker would
+	retained map[string][]byte
+	conns    map[*memConn]bool
+}
+
+func newMemBroker() *memBroker {
+	return &memBroker{
+		retained: make(map[string][]byte),
+		conns:    make(map[*memConn]bool),
+	}
+}
+
+// connect opens a connection with the given will, which is published
+// retained if the connection is lost
+func (b *memBroker) connect(willTopic string, willPayload []byte) *memConn {
+	c := &memConn{
+		broker:      b,
+		subs:        make(map[string]func(topic string, payload []byte)),
+		willTopic:   willTopic,
+		willPayload: willPayload,
+	}
+	b.lock.Lock()
+	b.conns[c] = true
+	b.lock.Unlock()
+	return c
+}
+
+func (b *memBroker) publish(topic string, payload []byte, retained bool) {
+	b.deliver.Lock()
+	defer b.deliver.Unlock()
+
+	b.lock.Lock()
+	if retained {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+	var callbacks []func(topic string, payload []byte)
+	for c := range b.conns {
+		c.lock.Lock()
+		for filter, callback := range c.subs {
+			if pubsub.TopicMatch(filter, topic) {
+				callbacks = append(callbacks, callback)
+			}
+		}
+		c.lock.Unlock()
+	}
+	b.lock.Unlock()
+
+	for _, callback := range callbacks {
+		callback(topic, payload)
+	}
+}
+
+var errMemConnClosed = errors.New("connection closed")
+
+// memConn is a single client connection to a memBroker
+type memConn struct {
+	broker      *memBroker
+	lock        sync.Mutex
+	subs        map[string]func(topic string, payload []byte)
+	willTopic   string
+	willPayload []byte
+	closed      bool
+}
+
+func (c *memConn) Subscribe(topic string, callback func(topic string, payload []byte)) error {
+	c.broker.deliver.Lock()
+	defer c.broker.deliver.Unlock()
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return errMemConnClosed
+	}
+	c.subs[topic] = callback
+	c.lock.Unlock()
+
+	c.broker.lock.Lock()
+	var retained [][2]string
+	for t, payload := range c.broker.retained {
+		if pubsub.TopicMatch(topic, t) {
+			retained = append(retained, [2]string{t, string(payload)})
+		}
+	}
+	c.broker.lock.Unlock()
+	for _, msg := range retained {
+		callback(msg[0], []byte(msg[1]))
+	}
+	return nil
+}
+
+func (c *memConn) PublishOpts(topic string, payload interface{}, qos pubsub.MQTTQoS, retained bool) error {
+	c.lock.Lock()
+	closed := c.closed
+	c.lock.Unlock()
+	if closed {
+		return errMemConnClosed
+	}
+	var p []byte
+	switch v := payload.(type) {
+	case []byte:
+		p = v
+	case string:
+		p = []byte(v)
+	default:
+		return fmt.Errorf("unsupported payload type %T", payload)
+	}
+	c.broker.publish(topic, p, retained)
+	return nil
+}
+
+// Disconnect cleanly closes the connection, which does not send the will
+func (c *memConn) Disconnect() {
+	c.close()
+}
+
+// crash loses the connection, which makes the broker send the will
+func (c *memConn) crash() {
+	c.close()
+	if c.willTopic != "" {
+		c.broker.publish(c.willTopic, c.willPayload, true)
+	}
+}
+
+func (c *memConn) close() {
+	c.broker.lock.Lock()
+	delete(c.broker.conns, c)
+	c.broker.lock.Unlock()
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+}
+
+const (
+	testLeaderTopic = "openchirp/service/test/leader"
+	testLeaderLease = 100 * time.Millisecond
+)
+
+// testCandidate is a candidate in an election along with its connection and
+// the leadership notifications it received
+type testCandidate struct {
+	conn     *memConn
+	election *leaderElection
+	lock     sync.Mutex
+	events   []bool
+}
+
+func startTestCandidate(t *testing.T, broker *memBroker, name string) *testCandidate {
+	candidate := new(testCandidate)
+	candidate.conn = broker.connect(testLeaderTopic, leaderRelease(name))
+	candidate.election = newLeaderElection(candidate.conn, testLeaderTopic, name, testLeaderLease, func(leader bool) {
+		candidate.lock.Lock()
+		candidate.events = append(candidate.events, leader)
+		candidate.lock.Unlock()
+	})
+	if err := candidate.election.start(); err != nil {
+		t.Fatal(err)
+	}
+	return candidate
+}
+
+func (c *testCandidate) notifications() []bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]bool(nil), c.events...)
+}
+
+// waitLeader waits until exactly one candidate is leader and returns it
+func waitLeader(t *testing.T, candidates ...*testCandidate) *testCandidate {
+	deadline := time.Now().Add(20 * testLeaderLease)
+	for time.Now().Before(deadline) {
+		var leaders []*testCandidate
+		for _, c := range candidates {
+			if c.election.isLeader() {
+				leaders = append(leaders, c)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(testLeaderLease / 20)
+	}
+	t.Fatal("Timed out waiting for a single leader")
+	return nil
+}
+
+// waitNotifications waits until candidate received n notifications
+func waitNotifications(t *testing.T, candidate *testCandidate, n int) {
+	deadline := time.Now().Add(20 * testLeaderLease)
+	for len(candidate.notifications()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d notifications, got %v", n, candidate.notifications())
+		}
+		time.Sleep(testLeaderLease / 20)
+	}
+}
+
+// assertSingleLeader checks that leadership stays with leader for duration
+func assertSingleLeader(t *testing.T, duration time.Duration, leader *testCandidate, candidates ...*testCandidate) {
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		for _, c := range candidates {
+			if c.election.isLeader() != (c == leader) {
+				t.Fatalf("Leadership changed unexpectedly: %s leader is %v", c.election.id, c.election.isLeader())
+			}
+		}
+		time.Sleep(testLeaderLease / 20)
+	}
+}
+
+func TestLeaderElection_SingleLeader(t *testing.T) {
+	broker := newMemBroker()
+	var candidates []*testCandidate
+	for i := 0; i < 3; i++ {
+		c := startTestCandidate(t, broker, fmt.Sprintf("candidate-%d", i))
+		defer c.election.stop()
+		candidates = append(candidates, c)
+	}
+
+	leader := waitLeader(t, candidates...)
+	// Renewals must keep the same leader for many lease periods
+	assertSingleLeader(t, 10*testLeaderLease, leader, candidates...)
+
+	for _, c := range candidates {
+		events := c.notifications()
+		if c == leader && (len(events) != 1 || !events[0]) {
+			t.Errorf("Expected leader to be elected once, got %v", events)
+		}
+		if c != leader && len(events) != 0 {
+			t.Errorf("Expected follower to never be elected, got %v", events)
+		}
+	}
+
+	// A late candidate must follow the retained lease
+	late := startTestCandidate(t, broker, "late")
+	defer late.election.stop()
+	assertSingleLeader(t, 5*testLeaderLease, leader, append(candidates, late)...)
+}
+
+func TestLeaderElection_Failover(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func(c *testCandidate)
+	}{
+		// The will releases the lease immediately
+		{"crash", func(c *testCandidate) { c.conn.crash() }},
+		// The lease must expire without a will
+		{"partition", func(c *testCandidate) { c.conn.close() }},
+		// The lease is released on a clean stop
+		{"stop", func(c *testCandidate) { c.election.stop() }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := newMemBroker()
+			var candidates []*testCandidate
+			for i := 0; i < 3; i++ {
+				c := startTestCandidate(t, broker, fmt.Sprintf("candidate-%d", i))
+				defer c.election.stop()
+				candidates = append(candidates, c)
+			}
+			leader := waitLeader(t, candidates...)
+			test.fail(leader)
+
+			var rest []*testCandidate
+			for _, c := range candidates {
+				if c != leader {
+					rest = append(rest, c)
+				}
+			}
+			next := waitLeader(t, rest...)
+			assertSingleLeader(t, 5*testLeaderLease, next, rest...)
+
+			// The old leader must have stepped down
+			if leader.election.isLeader() {
+				t.Fatal("Failed leader still considers itself leader")
+			}
+			waitNotifications(t, leader, 2)
+			if events := leader.notifications(); len(events) != 2 || !events[0] || events[1] {
+				t.Fatalf("Expected failed leader to be elected and demoted, got %v", events)
+			}
+		})
+	}
+}
+
+func TestLeaderElection_RestoreOverwrittenLease(t *testing.T) {
+	broker := newMemBroker()
+	a := startTestCandidate(t, broker, "a")
+	defer a.election.stop()
+	b := startTestCandidate(t, broker, "b")
+	defer b.election.stop()
+	leader := waitLeader(t, a, b)
+
+	// A crashed former candidate's will overwrites the retained lease
+	stale := broker.connect(testLeaderTopic, leaderRelease("stale"))
+	stale.crash()
+
+	assertSingleLeader(t, 5*testLeaderLease, leader, a, b)
+	broker.lock.Lock()
+	retained := string(broker.retained[testLeaderTopic])
+	broker.lock.Unlock()
+	if expected := fmt.Sprintf(`{"holder":"%s","lease_ms":%d}`, leader.election.id, testLeaderLease/time.Millisecond); retained != expected {
+		t.Fatalf("Expected leader to restore retained lease %s, got %s", expected, retained)
+	}
+}
+
+func TestLeaderElection_NotificationsInOrder(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var events []bool
+	e := newLeaderElection(nil, testLeaderTopic, "a", testLeaderLease, func(leader bool) {
+		lock.Lock()
+		first := len(events) == 0
+		lock.Unlock()
+		// Hold the first notification while the state keeps changing
+		if first {
+			<-release
+		}
+		lock.Lock()
+		events = append(events, leader)
+		lock.Unlock()
+	})
+
+	expected := []bool{true, false, true, false}
+	e.lock.Lock()
+	for _, leader := range expected {
+		e.leader = leader
+		e.queueNotify(leader)
+	}
+	e.lock.Unlock()
+	close(release)
+	e.waitNotified()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !equalBools(events, expected) {
+		t.Fatalf("Expected notifications %v, got %v", expected, events)
+	}
+}
+
+func equalBools(a, b []bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,17 +1,17 @@
 // TODO: Handle errors for pubsub methods, although these errors are probably
 // fatal.
-// TODO: Straighten out the case for when a user subscribes
-//       to the same topic twice.
 
 package framework
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/groupcache/lru"
+	"github.com/openchirp/framework/pubsub"
 )
 
 const (
@@ -19,13 +19,46 @@ const (
 )
 
 type serviceManager struct {
-	c           *ServiceClient
-	newdevice   func() Device
-	updates     <-chan DeviceUpdate
-	devices     map[string]*deviceState
-	deviceCtrls *lru.Cache
-	shutdown    chan bool
-	wg          sync.WaitGroup
+	dropped         uint64 // messages dropped by rate limits, accessed atomically
+	c               *ServiceClient
+	newdevice       func() Device
+	updates         <-chan DeviceUpdate
+	devices         map[string]*deviceState
+	deviceCtrls     *lru.Cache
+	deviceCtrlsLock sync.Mutex // lock for deviceCtrls, which is used from callbacks
+	shareGroup      string
+	middlewares     []Middleware
+	handler         MessageHandler // delivers messages through the middlewares
+	deadLetterSinks []DeadLetterSink
+	limits          *RateLimits    // inbound message limits, see WithRateLimits
+	err             error          // first error from applying options
+	shutdown        chan struct{}  // closed to stop the runtime
+	wg              sync.WaitGroup // tracks the runtime
+	workersStop     chan struct{}  // closed to stop the workers
+	workersWg       sync.WaitGroup // tracks the workers
+	messages        pendingGroup   // messages accepted for processing
+	publishes       pendingGroup   // background publishes, see publishAsync
+
+	// Tunables, see StartServiceClientManagedWithOptions
+	cacheSize       int
+	workerCount     int
+	workers         []chan func()
+	metrics         *MessageMetrics
+	resyncInterval  time.Duration
+	shutdownTimeout time.Duration
+	shutdownStatus  string
+
+	// Resync state, see WithResyncInterval
+	resyncs    chan resyncResult
+	updateSeq  uint64            // count of device events, owned by runtime
+	updateSeqs map[string]uint64 // each device's latest event, owned by runtime
+
+	// Sharding state, see WithSharding
+	shard       shardConfig             // the applied config, owned by runtime
+	known       map[string]DeviceUpdate // all linked devices, owned by runtime
+	shardLock   sync.Mutex              // lock for shardWant, which is used from callbacks
+	shardWant   shardConfig             // the latest requested config
+	shardSignal chan struct{}           // signals runtime to rebalance
 }
 
 // runtime is the primary service manager routine that handles device service
@@ -33,44 +66,117 @@ type serviceManager struct {
 func (m *serviceManager) runtime() {
 	defer m.wg.Done()
 
+	var resyncTick <-chan time.Time
+	if m.resyncInterval > 0 {
+		ticker := time.NewTicker(m.resyncInterval)
+		defer ticker.Stop()
+		resyncTick = ticker.C
+	}
+
 	for {
 		select {
 		case update := <-m.updates:
-			switch update.Type {
-			case DeviceUpdateTypeRem:
-				m.removeDevice(update.Id)
-			case DeviceUpdateTypeUpd:
-				fallthrough
-			case DeviceUpdateTypeAdd:
-				m.addUpdateDevice(update.Id, update.Topic, update.Config)
+			if update.Id != "" {
+				m.updateSeq++
+				m.updateSeqs[update.Id] = m.updateSeq
 			}
+			m.applyUpdate(update)
+		case <-m.shardSignal:
+			m.rebalance()
+		case <-resyncTick:
+			m.startResync()
+		case result := <-m.resyncs:
+			m.resync(result)
 		case <-m.shutdown:
 			return
 		}
 	}
 }
 
+// applyUpdate links, updates, or unlinks a device.
+// Must only be called from the runtime.
+func (m *serviceManager) applyUpdate(update DeviceUpdate) {
+	if m.sharded() && !m.shardUpdate(update) {
+		// Another instance owns this device
+		return
+	}
+	switch update.Type {
+	case DeviceUpdateTypeRem:
+		m.removeDevice(update.Id)
+	case DeviceUpdateTypeUpd:
+		fallthrough
+	case DeviceUpdateTypeAdd:
+		m.addUpdateDevice(update.Id, update.Topic, update.Config)
+	}
+}
+
+// Stop gracefully shuts down the runtime, within the shutdown timeout.
+// It stops accepting device messages and events, drains the messages already
+// received, notifies each ShutdownAwareDevice, flushes background publishes,
+// and publishes the final service status, if one was set. The caller then
+// disconnects.
 func (m *serviceManager) Stop() {
-	m.shutdown <- true
-	m.wg.Wait()
+	var deadline time.Time
+	if m.shutdownTimeout > 0 {
+		deadline = time.Now().Add(m.shutdownTimeout)
+	}
+
+	// Stop accepting device messages and events
+	drained := m.messages.close()
+	if m.sharded() {
+		m.stopSharding()
+	}
+	close(m.shutdown)
+	runtimeStopped := waitDeadline(waitGroupDone(&m.wg), deadline)
+
+	// Drain the rate limit and worker queues
+	messagesDrained := waitDeadline(drained, deadline)
+	if !messagesDrained {
+		m.logf("Timed out after %v draining device messages", m.shutdownTimeout)
+	}
+	close(m.workersStop)
+	workersStopped := waitDeadline(waitGroupDone(&m.workersWg), deadline)
+
+	if runtimeStopped {
+		m.shutdownDevices()
+	} else {
+		// The runtime still owns the devices, so leave them be
+		m.logf("Timed out after %v waiting for the managed runtime to stop", m.shutdownTimeout)
+	}
+
+	if !waitDeadline(m.publishes.close(), deadline) {
+		m.logf("Timed out after %v flushing publishes", m.shutdownTimeout)
+	}
+	if runtimeStopped && messagesDrained && workersStopped {
+		m.closeDeadLetterSinks()
+	} else {
+		// Dead letters may still be written, so leave the sinks open
+		m.logf("Leaving dead letter sinks open, since device messages are still being processed")
+	}
+
+	if m.shutdownStatus != "" {
+		if err := m.c.SetStatus(m.shutdownStatus); err != nil {
+			m.logf("Failed to publish final service status: %v", err)
+		}
+	}
 	m.c.manager = nil
 }
 
 /* DeviceControl Cache */
 
-func (m *serviceManager) deviceCtrlsCacheAdd(dCtrl *DeviceControl) {
-	m.deviceCtrls.Add(lru.Key(dCtrl.Id()), dCtrl)
-}
-
 func (m *serviceManager) deviceCtrlsCacheRemove(deviceID string) {
+	m.deviceCtrlsLock.Lock()
+	defer m.deviceCtrlsLock.Unlock()
 	m.deviceCtrls.Remove(lru.Key(deviceID))
 }
 
 func (m *serviceManager) deviceCtrlsCacheProvide(dState *deviceState) *DeviceControl {
+	m.deviceCtrlsLock.Lock()
+	defer m.deviceCtrlsLock.Unlock()
 	dCtrlInt, dCtrlExists := m.deviceCtrls.Get(lru.Key(dState.id))
 	if !dCtrlExists {
 		dCtrlInt = m.generateDeviceCtrl(dState)
-		m.deviceCtrlsCacheAdd(dCtrlInt.(*DeviceControl))
+		m.deviceCtrls.Add(lru.Key(dState.id), dCtrlInt)
 	}
 	// TODO: Should probably assert that the dCtrl.dStat == m.devices[deviceid]
 	return dCtrlInt.(*DeviceControl)
@@ -86,7 +192,7 @@ func (m *serviceManager) addUpdateDevice(deviceID string, topic string, config m
 			// Do not allow keys to be missing, since we do not expect users to
 			// to understand missing keys on updates - we will remove and re-add
 			// TODO: Should probably log, since this may be a REST bug
-			log.Printf("missing keys, but the changes were: %v", cchanges)
+			m.logf("missing keys, but the changes were: %v", cchanges)
 			m.removeDevice(deviceID)
 			m.addUpdateDevice(deviceID, topic, config)
 			return
@@ -124,17 +230,25 @@ func (m *serviceManager) addUpdateDevice(deviceID string, topic string, config m
 		}
 
 		// Update device's service link status
-		m.c.SetDeviceStatus(dState.id, status)
+		m.setDeviceStatus(dState, status)
 	} else {
 		// Create a new device context
 		dState := &deviceState{
 			id:         deviceID,
 			topic:      topic,
 			config:     config,
-			subs:       make(map[string]interface{}),
+			subs:       make(map[string]deviceSubscription),
+			retained:   make(map[string]bool),
 			userDevice: m.newdevice(),
 		}
 		m.devices[deviceID] = dState
+		if m.limits != nil {
+			dState.limiter = newDeviceLimiter(*m.limits, &m.dropped, func(status string) {
+				m.publishAsync(func() {
+					m.c.SetDeviceStatus(dState.id, status)
+				})
+			})
+		}
 
 		// Fetch a device control
 		dCtrl := m.deviceCtrlsCacheProvide(dState)
@@ -143,21 +257,32 @@ func (m *serviceManager) addUpdateDevice(deviceID string, topic string, config m
 		status := dState.userDevice.ProcessLink(dCtrl)
 
 		// Update device's service link status
-		m.c.SetDeviceStatus(dState.id, status)
+		m.setDeviceStatus(dState, status)
 	}
 
 }
 
 func (m *serviceManager) removeDevice(deviceID string) {
 	if dState, dStateExists := m.devices[deviceID]; dStateExists {
+		// Unsubscribe from all remaining topics
+		m.deviceUnsubscribeAll(dState)
+
+		// Discard rate limited messages still waiting for delivery
+		if dState.limiter != nil {
+			dState.limiter.stop()
+		}
+
 		// Fetch a device control
 		dCtrl := m.deviceCtrlsCacheProvide(dState)
 
 		// Process unlink
 		dState.userDevice.ProcessUnlink(dCtrl)
 
-		// Unsubscribe from all remaining topics
-		m.deviceUnsubscribeAll(dState)
+		// Clear all retained values this device published
+		m.deviceClearRetainedAll(dState)
+
+		// Stop serving and making requests
+		m.deviceCloseRPC(dState)
 
 		// Delete device context
 		delete(m.devices, deviceID)
@@ -175,61 +300,227 @@ func (m *serviceManager) generateDeviceCtrl(dState *deviceState) *DeviceControl
 	}
 }
 
-// deviceUnsubscribe unsubscribes from topics within the device's subtopic space
+// deviceUnsubscribeAll unsubscribes from all topics within the device's
+// subtopic space
 func (m *serviceManager) deviceUnsubscribeAll(dState *deviceState) {
-	// Create a flat array of device subscribed topics
-	topics := make([]string, 0, len(dState.subs))
-	for topic := range dState.subs {
-		topics = append(topics, topic)
+	// Create a flat array of device subscription handlers
+	ids := make([]pubsub.SubscriptionID, 0, len(dState.subs))
+	for _, sub := range dState.subs {
+		ids = append(ids, sub.id)
 	}
 	// Unsubscribe from all device subscribed topics
-	m.c.Unsubscribe(topics...)
+	m.c.unsubscribeHandler(ids...)
 	// Reset device's subscription list
-	dState.subs = make(map[string]interface{})
+	dState.subs = make(map[string]deviceSubscription)
 }
 
 // deviceUnsubscribe unsubscribes from topics within the device's subtopic space
 func (m *serviceManager) deviceUnsubscribe(dState *deviceState, subtopics ...string) {
 	// Prepend the device endpoint and remove from device subscription list
-	for i, subtopic := range subtopics {
+	ids := make([]pubsub.SubscriptionID, 0, len(subtopics))
+	for _, subtopic := range subtopics {
 		topic := dState.topic + "/" + subtopic
-		subtopics[i] = topic
-		delete(dState.subs, topic)
+		if sub, ok := dState.subs[topic]; ok {
+			ids = append(ids, sub.id)
+			delete(dState.subs, topic)
+		}
 	}
 	// Unsubscribe from specified topics
-	m.c.Unsubscribe(subtopics...)
+	m.c.unsubscribeHandler(ids...)
 }
 
 // deviceSubscribe subscribes to a topic within the device's subtopic space.
-// Currently, only the first call to subscribe to a particular topic is used.
+// The subtopic may contain the + and # wildcards, but the resulting
+// subscription is always confined to the device's topic.
+// Only the first call to subscribe to a particular subtopic is used, so
+// subscribing again keeps the original subscription and key.
 //
 // Messages received on the subscribed topic will be sent to the device's
-// ProcessMessage handler with the specified key and subtopic.
-func (m *serviceManager) deviceSubscribe(dState *deviceState, subtopic string, key interface{}) {
+// ProcessMessage handler with the specified key and the subtopic the message
+// was actually received on. Subscriptions using wildcards do not receive the
+// device's RPC requests and responses.
+func (m *serviceManager) deviceSubscribe(dState *deviceState, subtopic string, key interface{}, qos pubsub.MQTTQoS) {
+	if err := validDeviceSubtopic(dState, subtopic); err != nil {
+		m.logf("Refusing to subscribe device %s to subtopic %q: %v", dState.id, subtopic, err)
+		return
+	}
 	stopic := dState.topic + "/" + subtopic
-	if _, ok := dState.subs[stopic]; !ok {
-		m.c.Subscribe(stopic, func(topic string, payload []byte) {
-			// Get the device level subtopic
-			subtopic := strings.TrimPrefix(topic, dState.topic+"/")
-			// Compose message for device message handler
-			msg := Message{
-				key:     key,
-				topic:   subtopic,
-				payload: payload,
-			}
+	if _, ok := dState.subs[stopic]; ok {
+		return
+	}
+	wildcard := strings.ContainsAny(subtopic, "+#")
+	id, err := m.subscribe(stopic, qos, func(topic string, payload []byte) {
+		// Get the device level subtopic
+		subtopic, ok := deviceSubtopic(dState, topic)
+		if !ok {
+			// Never deliver messages from outside the device's topic space
+			return
+		}
+		if wildcard && deviceRPCTopic(dState, topic) {
+			// RPC traffic is only delivered to the RPC helper
+			return
+		}
+		if !m.messages.add() {
+			// Shutting down
+			return
+		}
+		// Compose message for device message handler
+		msg := Message{
+			key:     key,
+			topic:   subtopic,
+			payload: payload,
+		}
+		process := func() {
+			defer m.messages.done()
 			// Fetch a device control object device message handler
 			dCtrl := m.deviceCtrlsCacheProvide(dState)
-			// Run device message handler
-			dState.userDevice.ProcessMessage(dCtrl, msg)
-		})
-		dState.subs[stopic] = key
+			// Run device message handler through the middlewares
+			if err := m.handler(dCtrl, msg); err != nil {
+				m.logf("Failed to process message for device %s on subtopic %s: %v", dState.id, subtopic, err)
+				m.deadLetter(dState, topic, msg, err)
+			}
+		}
+		deliver := func() {
+			m.dispatch(dState.id, process)
+		}
+		if dState.limiter != nil {
+			dState.limiter.submit(subtopic, deliver, m.messages.done)
+			return
+		}
+		deliver()
+	})
+	if err != nil {
+		m.logf("Failed to subscribe device %s to %s: %v", dState.id, stopic, err)
+		return
+	}
+	dState.subs[stopic] = deviceSubscription{key: key, id: id}
+}
+
+// processMessage is the innermost MessageHandler, which delivers the
+// message to the device
+func (m *serviceManager) processMessage(ctrl *DeviceControl, msg Message) error {
+	if device, ok := ctrl.dState.userDevice.(ErrorReportingDevice); ok {
+		return device.ProcessMessageErr(ctrl, msg)
 	}
+	ctrl.dState.userDevice.ProcessMessage(ctrl, msg)
+	return nil
+}
+
+// subscribe subscribes to a device topic, which is a shared subscription
+// when the manager was started with WithSharedSubscriptions
+func (m *serviceManager) subscribe(topic string, qos pubsub.MQTTQoS, callback ClientTopicHandler) (pubsub.SubscriptionID, error) {
+	if m.shareGroup != "" {
+		return m.c.subscribeShared(m.shareGroup, topic, qos, callback)
+	}
+	return m.c.subscribeHandler(topic, qos, callback)
+}
+
+// validDeviceSubtopic checks that subtopic is a valid topic filter that
+// cannot escape the device's topic space
+func validDeviceSubtopic(dState *deviceState, subtopic string) error {
+	// The device topic itself must be a concrete prefix
+	if dState.topic == "" || pubsub.ValidateTopicFilter(dState.topic) != nil ||
+		strings.ContainsAny(dState.topic, "+#") {
+		return fmt.Errorf("invalid device topic %q", dState.topic)
+	}
+	return pubsub.ValidateTopicFilter(subtopic)
+}
+
+// deviceSubtopic extracts the device level subtopic from a full topic.
+// A multi level wildcard subscription also matches the device topic itself,
+// which results in the blank subtopic.
+// If topic is not within the device's topic space, ok is false.
+func deviceSubtopic(dState *deviceState, topic string) (subtopic string, ok bool) {
+	if topic == dState.topic {
+		return "", true
+	}
+	prefix := dState.topic + "/"
+	if !strings.HasPrefix(topic, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(topic, prefix), true
+}
+
+// deviceRPCTopic reports whether topic carries the device's RPC traffic,
+// which is either a response under the device's reply prefix or a request on
+// a subtopic the device handles requests on
+func deviceRPCTopic(dState *deviceState, topic string) bool {
+	if strings.HasPrefix(topic, dState.topic+"/"+rpcSubtopic+"/") {
+		return true
+	}
+	dState.rpcTopicsLock.RLock()
+	defer dState.rpcTopicsLock.RUnlock()
+	return dState.rpcTopics[topic]
 }
 
 // devicePublish publishes to a topic within the device's subtopic space
-func (m *serviceManager) devicePublish(dState *deviceState, subtopic string, payload interface{}) {
+func (m *serviceManager) devicePublish(dState *deviceState, subtopic string, payload interface{}, qos pubsub.MQTTQoS, retained bool) {
 	topic := dState.topic + "/" + subtopic
-	m.c.Publish(topic, payload)
+	if err := m.c.PublishOpts(topic, payload, qos, retained); err != nil || !retained {
+		return
+	}
+	dState.retainedLock.Lock()
+	dState.retained[topic] = true
+	dState.retainedLock.Unlock()
+}
+
+// deviceClearRetained clears retained values within the device's subtopic space
+func (m *serviceManager) deviceClearRetained(dState *deviceState, subtopics ...string) {
+	topics := make([]string, len(subtopics))
+	dState.retainedLock.Lock()
+	for i, subtopic := range subtopics {
+		topics[i] = dState.topic + "/" + subtopic
+		delete(dState.retained, topics[i])
+	}
+	dState.retainedLock.Unlock()
+	if err := m.c.clearRetained(topics...); err != nil {
+		m.logf("Failed to clear retained values of device %s: %v", dState.id, err)
+	}
+}
+
+// deviceClearRetainedAll clears all retained values the device has published
+func (m *serviceManager) deviceClearRetainedAll(dState *deviceState) {
+	dState.retainedLock.Lock()
+	topics := make([]string, 0, len(dState.retained))
+	for topic := range dState.retained {
+		topics = append(topics, topic)
+	}
+	dState.retained = make(map[string]bool)
+	dState.retainedLock.Unlock()
+	if err := m.c.clearRetained(topics...); err != nil {
+		m.logf("Failed to clear retained values of device %s: %v", dState.id, err)
+	}
+}
+
+// deviceRPC returns the device's RPC helper, which is created on first use
+// and receives responses within the device's subtopic space
+func (m *serviceManager) deviceRPC(dState *deviceState) (*pubsub.RPC, error) {
+	dState.rpcLock.Lock()
+	defer dState.rpcLock.Unlock()
+
+	if dState.rpc == nil {
+		rpc, err := pubsub.NewRPC(m.c, dState.topic+"/"+rpcSubtopic)
+		if err != nil {
+			return nil, err
+		}
+		dState.rpc = rpc
+	}
+	return dState.rpc, nil
+}
+
+// deviceCloseRPC stops all of the device's request handlers and fails any
+// in flight requests
+func (m *serviceManager) deviceCloseRPC(dState *deviceState) {
+	dState.rpcLock.Lock()
+	defer dState.rpcLock.Unlock()
+
+	if dState.rpc != nil {
+		dState.rpc.Close()
+		dState.rpc = nil
+	}
+	dState.rpcTopicsLock.Lock()
+	dState.rpcTopics = nil
+	dState.rpcTopicsLock.Unlock()
 }
 
 type deviceState struct {
@@ -237,7 +528,75 @@ type deviceState struct {
 	id         string
 	topic      string
 	config     map[string]string
-	subs       map[string]interface{}
+	subs       map[string]deviceSubscription
+	rpcLock    sync.Mutex
+	rpc        *pubsub.RPC
+	// retainedLock guards retained, which is written by device handlers
+	retainedLock sync.Mutex
+	retained     map[string]bool // topics published with retained values
+	// rpcTopicsLock guards rpcTopics separately from rpcLock, since it is
+	// used by message callbacks
+	rpcTopicsLock sync.RWMutex
+	rpcTopics     map[string]bool // topics requests are handled on
+	limiter       *deviceLimiter  // nil unless WithRateLimits is used
+}
+
+// deviceSubscription associates a device's subscribed topic with the key
+// provided by the device and the handler registered with the pubsub client
+type deviceSubscription struct {
+	key interface{}
+	id  pubsub.SubscriptionID
+}
+
+// ManagedOption configures optional behavior of a managed service client.
+// See StartServiceClientManaged.
+type ManagedOption func(m *serviceManager)
+
+// WithSharedSubscriptions makes the device subtopic subscriptions of all
+// service replicas started with the same group into broker shared
+// subscriptions ($share/<group>/...). Each device message is then processed
+// by only one of the replicas.
+// Device link, update, and unlink events are still delivered to every
+// replica, so each replica tracks all devices and calls ProcessLink,
+// ProcessConfigChange, and ProcessUnlink for them.
+// If group is blank, the service's id is used.
+func WithSharedSubscriptions(group string) ManagedOption {
+	return func(m *serviceManager) {
+		if group == "" {
+			group = m.c.id
+		}
+		m.shareGroup = group
+	}
+}
+
+// newServiceManager creates a manager for c with opts applied, which must then
+// be started
+func newServiceManager(c *ServiceClient, newdevice func() Device, opts ...ManagedOption) (*serviceManager, error) {
+	manager := new(serviceManager)
+	manager.c = c
+	manager.newdevice = newdevice
+	manager.devices = make(map[string]*deviceState)
+	manager.shutdown = make(chan struct{})
+	manager.workersStop = make(chan struct{})
+	manager.cacheSize = deviceCtrlsCacheSize
+	manager.shutdownTimeout = defaultShutdownTimeout
+	manager.resyncs = make(chan resyncResult)
+	manager.updateSeqs = make(map[string]uint64)
+
+	for _, opt := range opts {
+		opt(manager)
+	}
+	if manager.err != nil {
+		manager.closeDeadLetterSinks()
+		return nil, manager.err
+	}
+	manager.deviceCtrls = lru.New(manager.cacheSize)
+	middlewares := manager.middlewares
+	if manager.metrics != nil {
+		middlewares = append([]Middleware{MetricsMiddleware(manager.metrics)}, middlewares...)
+	}
+	manager.handler = chainMiddleware(manager.processMessage, middlewares...)
+	return manager, nil
 }
 
 // StartServiceClientManaged starts the service client layer using the fully
@@ -249,24 +608,46 @@ func StartServiceClientManaged(
 	token,
 	statusmsg string,
 	newdevice func() Device,
+	opts ...ManagedOption,
 ) (*ServiceClient, error) {
+	return StartServiceClientManagedWithOptions(ManagedConfig{
+		FrameworkURI: frameworkURI,
+		BrokerURI:    brokerURI,
+		ID:           id,
+		Token:        token,
+		StatusMsg:    statusmsg,
+		NewDevice:    newdevice,
+	}, opts...)
+}
 
-	if newdevice == nil {
+// StartServiceClientManagedWithOptions starts the service client layer using
+// the fully managed mode. The runtime can be tuned with WithCacheSize,
+// WithUpdateBuffering, WithWorkers, WithLogger, WithMetrics,
+// WithResyncInterval, and WithShutdownTimeout, alongside the other
+// ManagedOptions.
+func StartServiceClientManagedWithOptions(cfg ManagedConfig, opts ...ManagedOption) (*ServiceClient, error) {
+
+	if cfg.NewDevice == nil {
 		return nil, fmt.Errorf("Error: newdevice cannot be nil")
 	}
 
-	c, err := StartServiceClientStatus(frameworkURI, brokerURI, id, token, statusmsg)
+	c, err := StartServiceClientStatus(cfg.FrameworkURI, cfg.BrokerURI, cfg.ID, cfg.Token, cfg.StatusMsg)
 	if err != nil {
 		return nil, err
 	}
 
-	manager := new(serviceManager)
-	manager.c = c
-	manager.newdevice = newdevice
-	manager.devices = make(map[string]*deviceState)
-	manager.shutdown = make(chan bool)
+	manager, err := newServiceManager(c, cfg.NewDevice, opts...)
+	if err != nil {
+		c.StopClient()
+		return nil, err
+	}
 
-	manager.deviceCtrls = lru.New(deviceCtrlsCacheSize)
+	if manager.sharded() {
+		if err := manager.startSharding(); err != nil {
+			c.StopClient()
+			return nil, err
+		}
+	}
 
 	updates, err := c.StartDeviceUpdatesSimple()
 	if err != nil {
@@ -275,6 +656,7 @@ func StartServiceClientManaged(
 	}
 	manager.updates = updates
 
+	manager.startWorkers()
 	manager.wg.Add(1)
 	c.manager = manager
 	go manager.runtime()
@@ -308,6 +690,8 @@ type Device interface {
 	// this device. Along with the standard DeviceControl object, the
 	// handler is provided a Message object, which contains the received
 	// message's payload, subtopic, and the provided Subscribe key.
+	// Messages pass through the middlewares given by WithMiddleware first.
+	// Implement ErrorReportingDevice to report processing failures.
 	ProcessMessage(ctrl *DeviceControl, msg Message)
 }
 
@@ -342,12 +726,25 @@ func (c *DeviceControl) Config() map[string]string {
 //
 // When receiving a message for this subtopic, the Device's
 // ProcessMessage handler will be invoked with the message
-// and the this key. See
+// and the this key.
+//
+// The subtopic may contain MQTT wildcards, like "transducer/+" or "#".
+// In this case, Message.Topic() will report the actual subtopic the message
+// was received on. Messages matching multiple subscriptions are delivered
+// once per matching subscription, each with its own key.
 func (c *DeviceControl) Subscribe(subtopic string, key interface{}) {
-	c.manager.deviceSubscribe(c.dState, subtopic, key)
+	c.manager.deviceSubscribe(c.dState, subtopic, key, mqttQoS)
+}
+
+// SubscribeQoS subscribes to a device's subtopic using the specified QoS
+// and associates it with key. See Subscribe.
+func (c *DeviceControl) SubscribeQoS(subtopic string, key interface{}, qos pubsub.MQTTQoS) {
+	c.manager.deviceSubscribe(c.dState, subtopic, key, qos)
 }
 
-// Unsubscribe unsubscribes from the specified device's subtopics
+// Unsubscribe unsubscribes from the specified device's subtopics.
+// Wildcard subscriptions must be unsubscribed using the same subtopic filter
+// they were subscribed with.
 func (c *DeviceControl) Unsubscribe(subtopics ...string) {
 	c.manager.deviceUnsubscribe(c.dState, subtopics...)
 }
@@ -359,7 +756,76 @@ func (c *DeviceControl) UnsubscribeAll() {
 
 // Publish publishes payload to this device's subtopic
 func (c *DeviceControl) Publish(subtopic string, payload interface{}) {
-	c.manager.devicePublish(c.dState, subtopic, payload)
+	c.manager.devicePublish(c.dState, subtopic, payload, mqttQoS, mqttRetained)
+}
+
+// PublishOpts publishes payload to this device's subtopic using the specified
+// QoS and retained flag
+func (c *DeviceControl) PublishOpts(subtopic string, payload interface{}, qos pubsub.MQTTQoS, retained bool) {
+	c.manager.devicePublish(c.dState, subtopic, payload, qos, retained)
+}
+
+// PublishRetained publishes payload to this device's subtopic and asks the
+// broker to retain it, so that late subscribers receive the last value.
+// Retained values are cleared automatically when the device is unlinked.
+func (c *DeviceControl) PublishRetained(subtopic string, payload interface{}) {
+	c.manager.devicePublish(c.dState, subtopic, payload, mqttQoS, true)
+}
+
+// ClearRetained clears the retained values for this device's subtopics
+func (c *DeviceControl) ClearRetained(subtopics ...string) {
+	c.manager.deviceClearRetained(c.dState, subtopics...)
+}
+
+// Request publishes payload as a request to this device's subtopic and waits
+// for the response. If ctx has no deadline, pubsub.DefaultRPCTimeout is used.
+// See pubsub.RPC for details.
+func (c *DeviceControl) Request(ctx context.Context, subtopic string, payload []byte) ([]byte, error) {
+	rpc, err := c.manager.deviceRPC(c.dState)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.Request(ctx, c.dState.topic+"/"+subtopic, payload)
+}
+
+// HandleRequests serves requests received on this device's subtopic using
+// handler. Handlers are stopped automatically when the device is unlinked.
+func (c *DeviceControl) HandleRequests(subtopic string, handler pubsub.RPCHandler) {
+	if err := validDeviceSubtopic(c.dState, subtopic); err != nil {
+		c.manager.logf("Refusing to handle requests for device %s on subtopic %q: %v", c.dState.id, subtopic, err)
+		return
+	}
+	topic := c.dState.topic + "/" + subtopic
+	rpc, err := c.manager.deviceRPC(c.dState)
+	if err == nil {
+		err = rpc.HandleRequests(topic, handler)
+	}
+	if err != nil {
+		c.manager.logf("Failed to handle requests for device %s on subtopic %q: %v", c.dState.id, subtopic, err)
+		return
+	}
+	c.dState.rpcTopicsLock.Lock()
+	if c.dState.rpcTopics == nil {
+		c.dState.rpcTopics = make(map[string]bool)
+	}
+	c.dState.rpcTopics[topic] = true
+	c.dState.rpcTopicsLock.Unlock()
+}
+
+// StopHandlingRequests stops serving requests on this device's subtopics
+func (c *DeviceControl) StopHandlingRequests(subtopics ...string) {
+	rpc, err := c.manager.deviceRPC(c.dState)
+	if err != nil {
+		return
+	}
+	topics := make([]string, len(subtopics))
+	c.dState.rpcTopicsLock.Lock()
+	for i, subtopic := range subtopics {
+		topics[i] = c.dState.topic + "/" + subtopic
+		delete(c.dState.rpcTopics, topics[i])
+	}
+	c.dState.rpcTopicsLock.Unlock()
+	rpc.StopHandlingRequests(topics...)
 }
 
 // Message holds a received pubsub payload and topic along with the
@@ -368,6 +834,7 @@ type Message struct {
 	key     interface{}
 	topic   string
 	payload []byte
+	value   interface{}
 }
 
 // String shows all parts of the message as a human readable string
@@ -380,7 +847,8 @@ func (t Message) Key() interface{} {
 	return t.key
 }
 
-// Topic returns the pubsub subtopic which received this message
+// Topic returns the pubsub subtopic which received this message.
+// This is the concrete subtopic, even if the subscription used wildcards.
 func (t Message) Topic() string {
 	return t.topic
 }
@@ -390,6 +858,19 @@ func (t Message) Payload() []byte {
 	return t.payload
 }
 
+// Value returns the decoded payload set by a decoding middleware, like
+// JSONMiddleware, or nil
+func (t Message) Value() interface{} {
+	return t.value
+}
+
+// WithValue returns a copy of the message carrying the decoded payload value.
+// This is meant for decoding middlewares.
+func (t Message) WithValue(value interface{}) Message {
+	t.value = value
+	return t
+}
+
 // configChanges returns a map of only the keys that changed.
 // If keys were deleted from the newer config, the return bool will be true.
 func configChanges(original, new map[string]string) (map[string]string, bool) {
@@ -0,0 +1,159 @@
+package framework
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/openchirp/framework/pubsub"
+)
+
+// routeMQTT is an mqttClient that synchronously delivers publishes to every
+// handler whose filter matches the topic and records the topics cleared of
+// retained values
+type routeMQTT struct {
+	mqttClient
+	lock     sync.Mutex
+	nextID   pubsub.SubscriptionID
+	handlers map[pubsub.SubscriptionID]routeMQTTHandler
+	cleared  []string
+}
+
+type routeMQTTHandler struct {
+	filter   string
+	callback func(topic string, payload []byte)
+}
+
+func newRouteMQTT() *routeMQTT {
+	return &routeMQTT{handlers: make(map[pubsub.SubscriptionID]routeMQTTHandler)}
+}
+
+func (c *routeMQTT) Subscribe(topic string, callback func(topic string, payload []byte)) error {
+	_, err := c.SubscribeHandlerQoS(topic, mqttQoS, callback)
+	return err
+}
+
+func (c *routeMQTT) Unsubscribe(topics ...string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for id, h := range c.handlers {
+		for _, topic := range topics {
+			if h.filter == topic {
+				delete(c.handlers, id)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *routeMQTT) SubscribeHandler(topic string, callback func(topic string, payload []byte)) (pubsub.SubscriptionID, error) {
+	return c.SubscribeHandlerQoS(topic, mqttQoS, callback)
+}
+
+func (c *routeMQTT) SubscribeHandlerQoS(topic string, qos pubsub.MQTTQoS, callback func(topic string, payload []byte)) (pubsub.SubscriptionID, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nextID++
+	c.handlers[c.nextID] = routeMQTTHandler{topic, callback}
+	return c.nextID, nil
+}
+
+func (c *routeMQTT) UnsubscribeHandler(ids ...pubsub.SubscriptionID) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, id := range ids {
+		delete(c.handlers, id)
+	}
+	return nil
+}
+
+func (c *routeMQTT) Publish(topic string, payload interface{}) error {
+	return c.PublishOpts(topic, payload, mqttQoS, mqttRetained)
+}
+
+func (c *routeMQTT) PublishOpts(topic string, payload interface{}, qos pubsub.MQTTQoS, retained bool) error {
+	var p []byte
+	switch v := payload.(type) {
+	case []byte:
+		p = v
+	case string:
+		p = []byte(v)
+	default:
+		return fmt.Errorf("unsupported payload type %T", payload)
+	}
+	c.lock.Lock()
+	var callbacks []func(topic string, payload []byte)
+	for _, h := range c.handlers {
+		if pubsub.TopicMatch(h.filter, topic) {
+			callbacks = append(callbacks, h.callback)
+		}
+	}
+	c.lock.Unlock()
+	for _, callback := range callbacks {
+		callback(topic, p)
+	}
+	return nil
+}
+
+func (c *routeMQTT) ClearRetained(topics ...string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cleared = append(c.cleared, topics...)
+	return nil
+}
+
+// wildcardDevice subscribes to all of its subtopics and serves echo requests
+type wildcardDevice struct {
+	lock     sync.Mutex
+	received []string
+}
+
+func (d *wildcardDevice) ProcessLink(ctrl *DeviceControl) string {
+	ctrl.Subscribe("#", "all")
+	ctrl.HandleRequests("echo", func(payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+	return "Linked"
+}
+
+func (d *wildcardDevice) ProcessUnlink(ctrl *DeviceControl) {}
+
+func (d *wildcardDevice) ProcessConfigChange(ctrl *DeviceControl, cchanges, coriginal map[string]string) (string, bool) {
+	return "", true
+}
+
+func (d *wildcardDevice) ProcessMessage(ctrl *DeviceControl, msg Message) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.received = append(d.received, msg.Topic())
+}
+
+func TestServiceManager_WildcardSkipsRPC(t *testing.T) {
+	mqtt := newRouteMQTT()
+	c := new(ServiceClient)
+	c.mqtt = mqtt
+	device := new(wildcardDevice)
+	m, err := newServiceManager(c, func() Device { return device })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.addUpdateDevice("dev1", "openchirp/device/dev1", map[string]string{})
+	ctrl := m.deviceCtrlsCacheProvide(m.devices["dev1"])
+	resp, err := ctrl.Request(context.Background(), "echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "hello" {
+		t.Fatalf("Unexpected response %q", resp)
+	}
+	mqtt.Publish("openchirp/device/dev1/temperature", "21.5")
+
+	// Neither the request nor the response reaches the wildcard subscription
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	if !equalStringSlices(device.received, []string{"temperature"}) {
+		t.Fatalf("Expected only the temperature message, got %v", device.received)
+	}
+}
@@ -0,0 +1,176 @@
+package framework
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrPayloadTooLarge = errors.New("Message payload exceeds the size limit")
+
+// MessageHandler processes a single message received for a managed device.
+// A returned error indicates that the message could not be processed.
+type MessageHandler func(ctrl *DeviceControl, msg Message) error
+
+// Middleware wraps a MessageHandler in order to add behavior before and
+// after the next handler, or to stop delivery by not calling it.
+type Middleware func(next MessageHandler) MessageHandler
+
+// WithMiddleware wraps the delivery of device messages into
+// Device.ProcessMessage with the given middlewares.
+// The first middleware is the outermost, so it sees each message first.
+// Calling WithMiddleware multiple times appends to the chain.
+func WithMiddleware(middlewares ...Middleware) ManagedOption {
+	return func(m *serviceManager) {
+		m.middlewares = append(m.middlewares, middlewares...)
+	}
+}
+
+// chainMiddleware wraps handler with middlewares, so that the first
+// middleware is the outermost
+func chainMiddleware(handler MessageHandler, middlewares ...Middleware) MessageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// LoggingMiddleware logs every message and how long it took to process at the
+// debug level and failures at the error level.
+// If log is nil, the logrus standard logger is used.
+func LoggingMiddleware(log *logrus.Logger) Middleware {
+	if log == nil {
+		log = logrus.StandardLogger()
+	}
+	return func(next MessageHandler) MessageHandler {
+		return func(ctrl *DeviceControl, msg Message) error {
+			start := time.Now()
+			err := next(ctrl, msg)
+			logitem := log.WithFields(logrus.Fields{
+				"deviceid": ctrl.Id(),
+				"subtopic": msg.Topic(),
+				"size":     len(msg.Payload()),
+				"duration": time.Since(start),
+			})
+			if err != nil {
+				logitem.Errorf("Failed to process message: %v", err)
+			} else {
+				logitem.Debug("Processed message")
+			}
+			return err
+		}
+	}
+}
+
+// MessageMetrics accumulates counts about processed messages.
+// It is safe to read while messages are being processed.
+type MessageMetrics struct {
+	received uint64
+	failed   uint64
+	bytes    uint64
+	nanos    uint64
+}
+
+// Received returns the number of messages processed
+func (m *MessageMetrics) Received() uint64 {
+	return atomic.LoadUint64(&m.received)
+}
+
+// Failed returns the number of messages whose processing returned an error
+func (m *MessageMetrics) Failed() uint64 {
+	return atomic.LoadUint64(&m.failed)
+}
+
+// Bytes returns the total payload size of the messages processed
+func (m *MessageMetrics) Bytes() uint64 {
+	return atomic.LoadUint64(&m.bytes)
+}
+
+// AverageDuration returns the average time spent processing a message
+func (m *MessageMetrics) AverageDuration() time.Duration {
+	received := m.Received()
+	if received == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadUint64(&m.nanos) / received)
+}
+
+// String shows the metrics as a human readable string
+func (m *MessageMetrics) String() string {
+	return fmt.Sprintf("received: %d, failed: %d, bytes: %d, average duration: %v",
+		m.Received(), m.Failed(), m.Bytes(), m.AverageDuration())
+}
+
+// MetricsMiddleware counts messages, failures, payload bytes, and processing
+// time into metrics
+func MetricsMiddleware(metrics *MessageMetrics) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctrl *DeviceControl, msg Message) error {
+			start := time.Now()
+			err := next(ctrl, msg)
+			atomic.AddUint64(&metrics.nanos, uint64(time.Since(start)))
+			atomic.AddUint64(&metrics.bytes, uint64(len(msg.Payload())))
+			atomic.AddUint64(&metrics.received, 1)
+			if err != nil {
+				atomic.AddUint64(&metrics.failed, 1)
+			}
+			return err
+		}
+	}
+}
+
+// RecoverMiddleware turns a panic in the next handlers into an error, which
+// includes the panic value and stack trace, instead of crashing the service
+func RecoverMiddleware() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctrl *DeviceControl, msg Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic while processing message: %v\n%s", r, debug.Stack())
+				}
+			}()
+			return next(ctrl, msg)
+		}
+	}
+}
+
+// MaxPayloadMiddleware refuses messages whose payload is larger than size
+// bytes with ErrPayloadTooLarge
+func MaxPayloadMiddleware(size int) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctrl *DeviceControl, msg Message) error {
+			if len(msg.Payload()) > size {
+				return ErrPayloadTooLarge
+			}
+			return next(ctrl, msg)
+		}
+	}
+}
+
+// JSONMiddleware decodes JSON payloads, so that the next handlers can use
+// the decoded value from Message.Value.
+// If newValue is nil, payloads are decoded into an interface{}, otherwise
+// they are decoded into the pointer returned by newValue, like
+// func() interface{} { return new(MyReading) }.
+// Messages that fail to decode are refused with the decoding error.
+func JSONMiddleware(newValue func() interface{}) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctrl *DeviceControl, msg Message) error {
+			var value interface{}
+			if newValue != nil {
+				value = newValue()
+				if err := json.Unmarshal(msg.Payload(), value); err != nil {
+					return err
+				}
+			} else if err := json.Unmarshal(msg.Payload(), &value); err != nil {
+				return err
+			}
+			return next(ctrl, msg.WithValue(value))
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package framework
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testDeviceCtrl(id string) *DeviceControl {
+	return &DeviceControl{dState: &deviceState{id: id}}
+}
+
+func TestChainMiddleware_Order(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(ctrl *DeviceControl, msg Message) error {
+				calls = append(calls, name+" before")
+				err := next(ctrl, msg)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+	handler := chainMiddleware(func(ctrl *DeviceControl, msg Message) error {
+		calls = append(calls, "handler")
+		return nil
+	}, trace("outer"), trace("inner"))
+
+	if err := handler(testDeviceCtrl("dev"), Message{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"outer before", "inner before", "handler", "inner after", "outer after"}
+	if !equalStringSlices(calls, expected) {
+		t.Fatalf("Expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestMiddleware_Builtins(t *testing.T) {
+	var metrics MessageMetrics
+	var received []Message
+	failure := errors.New("bad reading")
+	handler := chainMiddleware(func(ctrl *DeviceControl, msg Message) error {
+		if msg.Topic() == "panic" {
+			panic("device handler bug")
+		}
+		if msg.Topic() == "fail" {
+			return failure
+		}
+		received = append(received, msg)
+		return nil
+	},
+		MetricsMiddleware(&metrics),
+		RecoverMiddleware(),
+		MaxPayloadMiddleware(16),
+		JSONMiddleware(nil),
+	)
+	ctrl := testDeviceCtrl("dev")
+
+	if err := handler(ctrl, Message{topic: "rawrx", payload: []byte(`{"temp": 21}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 delivered message, got %d", len(received))
+	}
+	if value, ok := received[0].Value().(map[string]interface{}); !ok || value["temp"] != 21.0 {
+		t.Fatalf("Expected decoded JSON value, got %#v", received[0].Value())
+	}
+
+	if err := handler(ctrl, Message{topic: "rawrx", payload: []byte(`{"temp": 21, "humidity": 40}`)}); err != ErrPayloadTooLarge {
+		t.Fatalf("Expected ErrPayloadTooLarge, got %v", err)
+	}
+	if err := handler(ctrl, Message{topic: "rawrx", payload: []byte(`{temp`)}); err == nil {
+		t.Fatal("Expected invalid JSON to be refused")
+	}
+	if err := handler(ctrl, Message{topic: "fail", payload: []byte(`1`)}); err != failure {
+		t.Fatalf("Expected handler error, got %v", err)
+	}
+	if err := handler(ctrl, Message{topic: "panic", payload: []byte(`1`)}); err == nil || !strings.Contains(err.Error(), "device handler bug") {
+		t.Fatalf("Expected panic to be recovered as an error, got %v", err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("Expected refused messages to not be delivered, got %d", len(received))
+	}
+
+	if metrics.Received() != 5 || metrics.Failed() != 4 {
+		t.Fatalf("Unexpected metrics: %v", &metrics)
+	}
+	if expected := uint64(12 + 28 + 5 + 1 + 1); metrics.Bytes() != expected {
+		t.Fatalf("Expected %d bytes, got %d", expected, metrics.Bytes())
+	}
+}
+
+func TestJSONMiddleware_Typed(t *testing.T) {
+	type reading struct {
+		Temp float64 `json:"temp"`
+	}
+	var got *reading
+	handler := JSONMiddleware(func() interface{} { return new(reading) })(func(ctrl *DeviceControl, msg Message) error {
+		got = msg.Value().(*reading)
+		return nil
+	})
+	if err := handler(testDeviceCtrl("dev"), Message{payload: []byte(`{"temp": 21.5}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Temp != 21.5 {
+		t.Fatalf("Expected typed reading, got %+v", got)
+	}
+}
+
+func equalStringSlices(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,207 @@
+package framework
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultShutdownTimeout = 10 * time.Second
+	workerQueueSize        = 16
+)
+
+// ManagedConfig identifies the service to start with
+// StartServiceClientManagedWithOptions
+type ManagedConfig struct {
+	FrameworkURI string
+	BrokerURI    string
+	ID           string
+	Token        string
+	// StatusMsg is the service status published if the service disconnects
+	// improperly
+	StatusMsg string
+	// NewDevice creates the Device for each newly linked device
+	NewDevice func() Device
+}
+
+// WithCacheSize sets how many DeviceControls are cached, which defaults to 100
+func WithCacheSize(size int) ManagedOption {
+	return func(m *serviceManager) {
+		if size < 1 {
+			m.err = fmt.Errorf("Error: cache size must be positive, got %d", size)
+			return
+		}
+		m.cacheSize = size
+	}
+}
+
+// WithUpdateBuffering sets how many device link, update, and unlink events
+// are buffered before the event subscription blocks, which defaults to 10
+func WithUpdateBuffering(size int) ManagedOption {
+	return func(m *serviceManager) {
+		if size < 1 {
+			m.err = fmt.Errorf("Error: update buffering must be positive, got %d", size)
+			return
+		}
+		m.c.updatesBuffering = size
+	}
+}
+
+// WithWorkers processes device messages on count worker routines, instead of
+// on the pubsub client's receive routine. Each device is assigned to a single
+// worker, so its messages are still processed in order, but slow devices only
+// hold up the other devices assigned to the same worker.
+func WithWorkers(count int) ManagedOption {
+	return func(m *serviceManager) {
+		if count < 0 {
+			m.err = fmt.Errorf("Error: worker count must not be negative, got %d", count)
+			return
+		}
+		m.workerCount = count
+	}
+}
+
+// WithLogger sets the logger the service client, including the managed
+// runtime and leader election, reports problems to, which defaults to the
+// logrus standard logger. See Client.SetLogger.
+func WithLogger(logger *logrus.Logger) ManagedOption {
+	return func(m *serviceManager) {
+		m.c.SetLogger(logger)
+	}
+}
+
+// WithMetrics counts all device messages, and their processing time, into
+// metrics. The metrics are gathered before any other middleware.
+func WithMetrics(metrics *MessageMetrics) ManagedOption {
+	return func(m *serviceManager) {
+		m.metrics = metrics
+	}
+}
+
+// WithResyncInterval refetches the service's linked devices every interval
+// and links, updates, or unlinks devices to match, in order to recover from
+// missed device events
+func WithResyncInterval(interval time.Duration) ManagedOption {
+	return func(m *serviceManager) {
+		if interval < 0 {
+			m.err = fmt.Errorf("Error: resync interval must not be negative, got %v", interval)
+			return
+		}
+		m.resyncInterval = interval
+	}
+}
+
+// WithShutdownTimeout sets how long StopClient may take to gracefully shut
+// down the managed runtime, which includes draining received device messages
+// and flushing publishes, before disconnecting anyway. It defaults to 10
+// seconds. A zero timeout waits indefinitely.
+func WithShutdownTimeout(timeout time.Duration) ManagedOption {
+	return func(m *serviceManager) {
+		if timeout < 0 {
+			m.err = fmt.Errorf("Error: shutdown timeout must not be negative, got %v", timeout)
+			return
+		}
+		m.shutdownTimeout = timeout
+	}
+}
+
+// logf reports to the client's logger
+func (m *serviceManager) logf(format string, v ...interface{}) {
+	m.c.logger().Printf(format, v...)
+}
+
+// startWorkers starts the worker routines requested by WithWorkers
+func (m *serviceManager) startWorkers() {
+	m.workers = make([]chan func(), m.workerCount)
+	for i := range m.workers {
+		work := make(chan func(), workerQueueSize)
+		m.workers[i] = work
+		m.workersWg.Add(1)
+		go func() {
+			defer m.workersWg.Done()
+			for {
+				select {
+				case process := <-work:
+					process()
+				case <-m.workersStop:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// dispatch runs process on the worker assigned to the device, or immediately
+// if there are no workers. It blocks while the worker is busy, which holds
+// back the pubsub client instead of buffering without bound.
+func (m *serviceManager) dispatch(deviceID string, process func()) {
+	if len(m.workers) == 0 {
+		process()
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(deviceID))
+	select {
+	case m.workers[h.Sum32()%uint32(len(m.workers))] <- process:
+	case <-m.workersStop:
+	}
+}
+
+// resyncResult is a device list fetched for a resync, along with the update
+// sequence number at the time the fetch began
+type resyncResult struct {
+	seq     uint64
+	updates []DeviceUpdate
+}
+
+// startResync fetches the device list in the background, so that the runtime
+// is not held up by the request
+func (m *serviceManager) startResync() {
+	seq := m.updateSeq
+	go func() {
+		updates, err := m.c.FetchDeviceConfigsAsUpdates()
+		if err != nil {
+			m.logf("Failed to fetch device list for resync: %v", err)
+			return
+		}
+		select {
+		case m.resyncs <- resyncResult{seq, updates}:
+		case <-m.shutdown:
+		}
+	}()
+}
+
+// resync links, updates, and unlinks devices to match a fetched device list.
+// Devices that received events after the fetch began are left alone, since the
+// events may be newer than the list.
+// Must only be called from the runtime.
+func (m *serviceManager) resync(result resyncResult) {
+	listed := make(map[string]bool, len(result.updates))
+	for _, update := range result.updates {
+		listed[update.Id] = true
+		if m.updateSeqs[update.Id] > result.seq {
+			continue
+		}
+		m.applyUpdate(update)
+	}
+
+	// Devices tracked by the runtime, which includes other shards' devices
+	tracked := make([]string, 0, len(m.devices))
+	if m.sharded() {
+		for deviceID := range m.known {
+			tracked = append(tracked, deviceID)
+		}
+	} else {
+		for deviceID := range m.devices {
+			tracked = append(tracked, deviceID)
+		}
+	}
+	for _, deviceID := range tracked {
+		if !listed[deviceID] && m.updateSeqs[deviceID] <= result.seq {
+			m.applyUpdate(DeviceUpdate{Type: DeviceUpdateTypeRem, Id: deviceID})
+		}
+	}
+}
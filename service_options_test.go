@@ -0,0 +1,123 @@
+package framework
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestServiceManager_Resync(t *testing.T) {
+	// Track devices owned by another shard, so that only the known device
+	// list is reconciled
+	var ids []string
+	for _, id := range testDeviceIDs(100) {
+		if DeviceShard(id, 2) == 1 {
+			ids = append(ids, id)
+		}
+	}
+	m := &serviceManager{
+		devices:    make(map[string]*deviceState),
+		known:      make(map[string]DeviceUpdate),
+		updateSeqs: make(map[string]uint64),
+		shard:      shardConfig{0, 2},
+		shardWant:  shardConfig{0, 2},
+	}
+	event := func(update DeviceUpdate) {
+		m.updateSeq++
+		m.updateSeqs[update.Id] = m.updateSeq
+		m.applyUpdate(update)
+	}
+	event(DeviceUpdate{Type: DeviceUpdateTypeAdd, Id: ids[0]})
+	event(DeviceUpdate{Type: DeviceUpdateTypeAdd, Id: ids[1]})
+	seq := m.updateSeq
+
+	// Events received while the device list is being fetched are newer
+	event(DeviceUpdate{Type: DeviceUpdateTypeAdd, Id: ids[2]})
+	event(DeviceUpdate{Type: DeviceUpdateTypeRem, Id: ids[3]})
+
+	// The fetched list missed the ids[0] unlink event and ids[4] link event
+	m.resync(resyncResult{seq, []DeviceUpdate{
+		{Type: DeviceUpdateTypeAdd, Id: ids[1]},
+		{Type: DeviceUpdateTypeAdd, Id: ids[3]},
+		{Type: DeviceUpdateTypeAdd, Id: ids[4]},
+	}})
+
+	var known []string
+	for id := range m.known {
+		known = append(known, id)
+	}
+	sort.Strings(known)
+	expected := []string{ids[1], ids[2], ids[4]}
+	if !equalStringSlices(known, expected) {
+		t.Fatalf("Expected known devices %v, got %v", expected, known)
+	}
+}
+
+func TestServiceManager_WorkersKeepDeviceOrder(t *testing.T) {
+	m := &serviceManager{
+		workersStop: make(chan struct{}),
+		workerCount: 4,
+	}
+	m.startWorkers()
+	defer func() {
+		close(m.workersStop)
+		if !waitDeadline(waitGroupDone(&m.workersWg), time.Now().Add(5*time.Second)) {
+			t.Error("Timed out stopping workers")
+		}
+	}()
+
+	const messages = 100
+	devices := testDeviceIDs(8)
+	var lock sync.Mutex
+	var done sync.WaitGroup
+	received := make(map[string][]int)
+	done.Add(messages * len(devices))
+	for i := 0; i < messages; i++ {
+		for _, id := range devices {
+			id, i := id, i
+			m.dispatch(id, func() {
+				defer done.Done()
+				lock.Lock()
+				defer lock.Unlock()
+				received[id] = append(received[id], i)
+			})
+		}
+	}
+	done.Wait()
+
+	for _, id := range devices {
+		for i, n := range received[id] {
+			if n != i {
+				t.Fatalf("Expected device %s messages in order, got %v", id, received[id])
+			}
+		}
+	}
+}
+
+func TestServiceManager_WithLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	mqtt := newRouteMQTT()
+	c := new(ServiceClient)
+	c.mqtt = mqtt
+	m, err := newServiceManager(c, func() Device { return new(wildcardDevice) }, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.addUpdateDevice("dev1", "openchirp/device/dev1", map[string]string{})
+	ctrl := m.deviceCtrlsCacheProvide(m.devices["dev1"])
+	ctrl.Subscribe("a/#/b", nil)
+	if !strings.Contains(out.String(), "Refusing to subscribe device dev1") {
+		t.Fatalf("Expected the runtime to log to the given logger, got %q", out.String())
+	}
+	if c.logger() != logger {
+		t.Fatal("Expected the client to use the given logger")
+	}
+}
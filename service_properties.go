@@ -0,0 +1,130 @@
+package framework
+
+import (
+	"errors"
+	"reflect"
+	"time"
+)
+
+const (
+	// DefaultPropertiesPollInterval is the interval used by
+	// StartPropertiesWatch when none is given
+	DefaultPropertiesPollInterval = time.Minute
+)
+
+var ErrPropertiesWatchAlreadyStarted = errors.New("Properties watch already started")
+var ErrPropertiesWatchNotStarted = errors.New("Properties watch not started")
+
+// propertiesWatch is a running poll of the service's properties
+type propertiesWatch struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartPropertiesWatch starts polling the framework for changes to the
+// service's properties every interval, so that GetProperties reflects edits
+// made while the service runs. Use OnPropertiesChanged to be notified of
+// changes.
+// An interval of zero uses DefaultPropertiesPollInterval.
+func (c *ServiceClient) StartPropertiesWatch(interval time.Duration) error {
+	c.propertiesWatchLock.Lock()
+	defer c.propertiesWatchLock.Unlock()
+
+	if c.propertiesWatch != nil {
+		return ErrPropertiesWatchAlreadyStarted
+	}
+	if interval <= 0 {
+		interval = DefaultPropertiesPollInterval
+	}
+
+	watch := &propertiesWatch{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(watch.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.refreshProperties(); err != nil {
+					c.logger().Printf("Failed to refresh service properties: %v", err)
+				}
+			case <-watch.stop:
+				return
+			}
+		}
+	}()
+	c.propertiesWatch = watch
+	return nil
+}
+
+// StopPropertiesWatch stops polling for property changes. It waits for a
+// running OnPropertiesChanged callback to return.
+func (c *ServiceClient) StopPropertiesWatch() error {
+	c.propertiesWatchLock.Lock()
+	watch := c.propertiesWatch
+	c.propertiesWatch = nil
+	c.propertiesWatchLock.Unlock()
+
+	if watch == nil {
+		return ErrPropertiesWatchNotStarted
+	}
+	close(watch.stop)
+	<-watch.done
+	return nil
+}
+
+// OnPropertiesChanged sets the callback that is called with the previous and
+// new properties when the watch detects a change. Callbacks are never called
+// concurrently and must not modify the given maps.
+func (c *ServiceClient) OnPropertiesChanged(callback func(old, new map[string]string)) {
+	c.propertiesWatchLock.Lock()
+	defer c.propertiesWatchLock.Unlock()
+	c.onPropertiesChanged = callback
+}
+
+// refreshProperties fetches the service's properties and updates the cached
+// properties if they changed, calling the OnPropertiesChanged callback.
+// A fetch that raced with SetProperties is discarded, since it may be older
+// than the properties that were set.
+func (c *ServiceClient) refreshProperties() error {
+	c.propertiesLock.RLock()
+	version := c.propertiesVersion
+	c.propertiesLock.RUnlock()
+
+	node, err := c.host.RequestServiceInfo(c.id)
+	if err != nil {
+		return err
+	}
+	if node.Properties == nil {
+		node.Properties = map[string]string{}
+	}
+
+	c.propertiesLock.Lock()
+	if c.propertiesVersion != version {
+		c.propertiesLock.Unlock()
+		return nil
+	}
+	old := c.node.Properties
+	if old == nil {
+		old = map[string]string{}
+	}
+	changed := !reflect.DeepEqual(old, node.Properties)
+	if changed {
+		c.node.Properties = node.Properties
+	}
+	c.propertiesLock.Unlock()
+
+	if !changed {
+		return nil
+	}
+	c.propertiesWatchLock.Lock()
+	callback := c.onPropertiesChanged
+	c.propertiesWatchLock.Unlock()
+	if callback != nil {
+		callback(old, node.Properties)
+	}
+	return nil
+}
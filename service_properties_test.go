@@ -0,0 +1,134 @@
+package framework
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openchirp/framework/rest"
+)
+
+func TestServiceClient_PropertiesWatch(t *testing.T) {
+	var lock sync.Mutex
+	properties := map[string]string{"region": "us"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method+" "+r.URL.Path != "GET /apiv1/service/svc1" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		json.NewEncoder(w).Encode(rest.ServiceNode{Properties: properties})
+	}))
+	defer server.Close()
+
+	c := new(ServiceClient)
+	c.id = "svc1"
+	c.host = rest.NewHost(server.URL)
+	c.node.Properties = map[string]string{"region": "us"}
+
+	type change struct{ old, new map[string]string }
+	changes := make(chan change, 10)
+	c.OnPropertiesChanged(func(old, new map[string]string) {
+		changes <- change{old, new}
+	})
+	if err := c.StartPropertiesWatch(5 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartPropertiesWatch(0); err != ErrPropertiesWatchAlreadyStarted {
+		t.Fatalf("Expected ErrPropertiesWatchAlreadyStarted, got %v", err)
+	}
+
+	lock.Lock()
+	properties = map[string]string{"region": "eu"}
+	lock.Unlock()
+
+	select {
+	case ch := <-changes:
+		if ch.old["region"] != "us" || ch.new["region"] != "eu" {
+			t.Fatalf("Unexpected change from %v to %v", ch.old, ch.new)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the properties change")
+	}
+	if props := c.GetProperties(); !reflect.DeepEqual(props, properties) {
+		t.Fatalf("Expected cached properties %v, got %v", properties, props)
+	}
+
+	if err := c.StopPropertiesWatch(); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged properties must not be reported
+	if len(changes) != 0 {
+		t.Fatalf("Expected a single change, got %d more", len(changes))
+	}
+	if err := c.StopPropertiesWatch(); err != ErrPropertiesWatchNotStarted {
+		t.Fatalf("Expected ErrPropertiesWatchNotStarted, got %v", err)
+	}
+}
+
+func TestServiceClient_RefreshPropertiesStale(t *testing.T) {
+	var lock sync.Mutex
+	var gets int
+	stored := map[string]string{"region": "us"}
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		properties := stored
+		switch r.Method + " " + r.URL.Path {
+		case "GET /apiv1/service/svc1":
+			gets++
+			if gets == 1 {
+				// Hold the refresh's fetch until SetProperties is done
+				lock.Unlock()
+				close(fetching)
+				<-release
+				json.NewEncoder(w).Encode(rest.ServiceNode{Properties: properties})
+				return
+			}
+		case "PUT /apiv1/service/svc1":
+			var body struct {
+				Properties map[string]string `json:"properties"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			stored = body.Properties
+			properties = stored
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+		lock.Unlock()
+		json.NewEncoder(w).Encode(rest.ServiceNode{Properties: properties})
+	}))
+	defer server.Close()
+
+	c := new(ServiceClient)
+	c.id = "svc1"
+	c.host = rest.NewHost(server.URL)
+	c.node.Properties = map[string]string{"region": "us"}
+
+	refreshed := make(chan error)
+	go func() {
+		refreshed <- c.refreshProperties()
+	}()
+	<-fetching
+	if err := c.SetProperty("cursor", "42"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-refreshed; err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale fetch must not overwrite the properties that were set
+	expected := map[string]string{"region": "us", "cursor": "42"}
+	if props := c.GetProperties(); !reflect.DeepEqual(props, expected) {
+		t.Fatalf("Expected properties %v, got %v", expected, props)
+	}
+}
@@ -0,0 +1,384 @@
+package framework
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultThrottledStatus    = "Throttled: messages exceed the rate limit"
+	defaultThrottleStatusHold = 10 * time.Second
+	defaultMaxSubtopics       = 256
+)
+
+// RateLimit is a token bucket limit of Rate messages per second, which allows
+// bursts of up to Burst messages. A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits configures inbound message limits for each managed device.
+// A message must be within both the Device and Subtopic limits.
+type RateLimits struct {
+	// Device limits all messages received for a single device
+	Device RateLimit
+	// Subtopic limits messages received on each subtopic of a single device
+	Subtopic RateLimit
+	// MaxSubtopics is the number of subtopics of a single device that are
+	// limited separately, which defaults to 256. Once a device has used this
+	// many subtopics, messages on further subtopics share a single Subtopic
+	// limit. Subtopics are only forgotten while their limit is unused.
+	MaxSubtopics int
+	// QueueSize selects what happens to messages over the limits.
+	// If zero, the messages are dropped. Otherwise, up to QueueSize messages
+	// wait in a per device queue until they are within the limits and only
+	// messages that overflow the queue are dropped.
+	QueueSize int
+	// ThrottledStatus is the device status set while a device is throttled
+	ThrottledStatus string
+	// StatusHold is how long a device must stay within its limits before
+	// its previous status is restored
+	StatusHold time.Duration
+}
+
+// WithRateLimits applies limits to the messages received for each device,
+// so that a single flooding device cannot starve the service.
+// Messages over the limits are delayed or dropped, as selected by
+// limits.QueueSize, and counted by DeviceControl.DroppedMessages and
+// ServiceClient.DroppedMessages.
+// While a device is being throttled its status is set to
+// limits.ThrottledStatus, until it stays within its limits for
+// limits.StatusHold.
+func WithRateLimits(limits RateLimits) ManagedOption {
+	return func(m *serviceManager) {
+		if limits.ThrottledStatus == "" {
+			limits.ThrottledStatus = defaultThrottledStatus
+		}
+		if limits.StatusHold <= 0 {
+			limits.StatusHold = defaultThrottleStatusHold
+		}
+		m.limits = &limits
+	}
+}
+
+// tokenBucket implements a single RateLimit
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket for limit, or nil if limit is disabled
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: limit.Rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// available reports whether a token can be taken now
+func (b *tokenBucket) available(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+// take removes one token
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// reserve takes a token and returns how long to wait until it is available
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limitedMessage is a message waiting in a device's queue
+type limitedMessage struct {
+	subtopic string
+	deliver  func()
+	discard  func()
+}
+
+// deviceLimiter applies the rate limits to a single device's messages
+type deviceLimiter struct {
+	dropped   uint64 // accessed atomically, so keep 64 bit aligned
+	total     *uint64
+	limits    RateLimits
+	setStatus func(status string)
+
+	lock      sync.Mutex
+	device    *tokenBucket
+	subtopics map[string]*tokenBucket
+	overflow  *tokenBucket // shared by subtopics beyond limits.MaxSubtopics
+	throttled bool
+	lastLimit time.Time // when a message was last delayed or dropped
+	status    string    // the status to restore after throttling
+	stopped   bool
+	queue     chan limitedMessage
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// newDeviceLimiter creates a limiter, which counts dropped messages into
+// total and reports throttling using setStatus, which must not block
+func newDeviceLimiter(limits RateLimits, total *uint64, setStatus func(status string)) *deviceLimiter {
+	if limits.MaxSubtopics <= 0 {
+		limits.MaxSubtopics = defaultMaxSubtopics
+	}
+	l := &deviceLimiter{
+		total:     total,
+		limits:    limits,
+		setStatus: setStatus,
+		device:    newTokenBucket(limits.Device, time.Now()),
+		subtopics: make(map[string]*tokenBucket),
+		done:      make(chan struct{}),
+	}
+	if limits.QueueSize > 0 {
+		l.queue = make(chan limitedMessage, limits.QueueSize)
+		l.wg.Add(1)
+		go l.run()
+	}
+	return l
+}
+
+// subtopicBucket returns the bucket for subtopic, which is nil if subtopics
+// are not limited. Must be called with l.lock held.
+func (l *deviceLimiter) subtopicBucket(subtopic string, now time.Time) *tokenBucket {
+	if bucket, ok := l.subtopics[subtopic]; ok {
+		return bucket
+	}
+	if l.limits.Subtopic.Rate <= 0 {
+		return nil
+	}
+	if len(l.subtopics) >= l.limits.MaxSubtopics {
+		l.evictFullBuckets(now)
+	}
+	if len(l.subtopics) >= l.limits.MaxSubtopics {
+		if l.overflow == nil {
+			l.overflow = newTokenBucket(l.limits.Subtopic, now)
+		}
+		return l.overflow
+	}
+	bucket := newTokenBucket(l.limits.Subtopic, now)
+	l.subtopics[subtopic] = bucket
+	return bucket
+}
+
+// evictFullBuckets forgets the subtopics whose buckets have refilled, which
+// are no different from new buckets. Must be called with l.lock held.
+func (l *deviceLimiter) evictFullBuckets(now time.Time) {
+	for subtopic, bucket := range l.subtopics {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(l.subtopics, subtopic)
+		}
+	}
+}
+
+// submit delivers, delays, or drops a message received on subtopic.
+// Either deliver or discard is called for each message. Messages submitted
+// after stop are discarded.
+func (l *deviceLimiter) submit(subtopic string, deliver, discard func()) {
+	l.lock.Lock()
+	if l.stopped {
+		l.lock.Unlock()
+		discard()
+		return
+	}
+	if l.queue != nil {
+		// Queue while holding the lock, so that stop drains the message
+		var queued bool
+		select {
+		case l.queue <- limitedMessage{subtopic, deliver, discard}:
+			queued = true
+		default:
+		}
+		l.lock.Unlock()
+		if !queued {
+			l.drop()
+			discard()
+		}
+		return
+	}
+
+	now := time.Now()
+	device, sub := l.device, l.subtopicBucket(subtopic, now)
+	ok := (device == nil || device.available(now)) && (sub == nil || sub.available(now))
+	if ok {
+		if device != nil {
+			device.take()
+		}
+		if sub != nil {
+			sub.take()
+		}
+	}
+	l.lock.Unlock()
+
+	if ok {
+		deliver()
+	} else {
+		l.drop()
+		discard()
+	}
+}
+
+// run delivers queued messages in order, as the limits allow
+func (l *deviceLimiter) run() {
+	defer l.wg.Done()
+
+	for {
+		var msg limitedMessage
+		select {
+		case msg = <-l.queue:
+		case <-l.done:
+			return
+		}
+
+		now := time.Now()
+		var wait time.Duration
+		l.lock.Lock()
+		for _, bucket := range []*tokenBucket{l.device, l.subtopicBucket(msg.subtopic, now)} {
+			if bucket != nil {
+				if w := bucket.reserve(now); w > wait {
+					wait = w
+				}
+			}
+		}
+		l.lock.Unlock()
+
+		if wait > 0 {
+			l.throttle()
+			select {
+			case <-time.After(wait):
+			case <-l.done:
+				msg.discard()
+				return
+			}
+		}
+		msg.deliver()
+	}
+}
+
+func (l *deviceLimiter) drop() {
+	atomic.AddUint64(&l.dropped, 1)
+	if l.total != nil {
+		atomic.AddUint64(l.total, 1)
+	}
+	l.throttle()
+}
+
+func (l *deviceLimiter) droppedMessages() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// throttle marks the device as throttled and sets the throttled status
+func (l *deviceLimiter) throttle() {
+	l.lock.Lock()
+	l.lastLimit = time.Now()
+	if l.throttled || l.stopped {
+		l.lock.Unlock()
+		return
+	}
+	l.throttled = true
+	l.lock.Unlock()
+
+	l.setStatus(l.limits.ThrottledStatus)
+	time.AfterFunc(l.limits.StatusHold, l.checkRecovered)
+}
+
+// checkRecovered restores the device's status once it has stayed within its
+// limits for the status hold time
+func (l *deviceLimiter) checkRecovered() {
+	l.lock.Lock()
+	if l.stopped {
+		l.lock.Unlock()
+		return
+	}
+	if since := time.Since(l.lastLimit); since < l.limits.StatusHold {
+		time.AfterFunc(l.limits.StatusHold-since, l.checkRecovered)
+		l.lock.Unlock()
+		return
+	}
+	l.throttled = false
+	status := l.status
+	l.lock.Unlock()
+
+	l.setStatus(status)
+}
+
+// linkStatus records the device's status, which is restored after throttling
+func (l *deviceLimiter) linkStatus(status string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.status = status
+}
+
+// stop discards queued messages and waits for a message being delivered
+func (l *deviceLimiter) stop() {
+	l.lock.Lock()
+	l.stopped = true
+	l.lock.Unlock()
+	close(l.done)
+	l.wg.Wait()
+	for {
+		select {
+		case msg := <-l.queue:
+			msg.discard()
+		default:
+			return
+		}
+	}
+}
+
+// setDeviceStatus publishes a device's status, which is restored after the
+// device is no longer throttled
+func (m *serviceManager) setDeviceStatus(dState *deviceState, status string) {
+	if dState.limiter != nil {
+		dState.limiter.linkStatus(status)
+	}
+	m.c.SetDeviceStatus(dState.id, status)
+}
+
+func (m *serviceManager) droppedMessages() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+// DroppedMessages returns the number of this device's messages that were
+// dropped for exceeding the limits set by WithRateLimits
+func (c *DeviceControl) DroppedMessages() uint64 {
+	if c.dState.limiter == nil {
+		return 0
+	}
+	return c.dState.limiter.droppedMessages()
+}
+
+// DroppedMessages returns the number of messages, for all devices, that were
+// dropped for exceeding the limits set by WithRateLimits
+func (c *ServiceClient) DroppedMessages() uint64 {
+	if c.manager == nil {
+		return 0
+	}
+	return c.manager.droppedMessages()
+}
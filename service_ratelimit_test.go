@@ -0,0 +1,218 @@
+package framework
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	if newTokenBucket(RateLimit{}, now) != nil {
+		t.Fatal("Expected a zero rate to disable the bucket")
+	}
+
+	b := newTokenBucket(RateLimit{Rate: 2, Burst: 3}, now)
+	for i := 0; i < 3; i++ {
+		if !b.available(now) {
+			t.Fatalf("Expected burst token %d to be available", i)
+		}
+		b.take()
+	}
+	if b.available(now) {
+		t.Fatal("Expected the burst to be exhausted")
+	}
+	if !b.available(now.Add(500 * time.Millisecond)) {
+		t.Fatal("Expected a token after refilling for 500ms at 2/s")
+	}
+	if b.available(now.Add(time.Hour)); b.tokens != 3 {
+		t.Fatalf("Expected refill to be capped at the burst, got %v", b.tokens)
+	}
+
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		b.reserve(later)
+	}
+	if wait := b.reserve(later); wait != 500*time.Millisecond {
+		t.Fatalf("Expected to wait 500ms for a reserved token, got %v", wait)
+	}
+}
+
+// statusRecorder records the statuses set by a deviceLimiter
+type statusRecorder struct {
+	lock     sync.Mutex
+	statuses []string
+}
+
+func (r *statusRecorder) set(status string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.statuses = append(r.statuses, status)
+}
+
+// wait returns the recorded statuses once there are at least n of them, or
+// after a timeout
+func (r *statusRecorder) wait(n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.lock.Lock()
+		statuses := append([]string(nil), r.statuses...)
+		r.lock.Unlock()
+		if len(statuses) >= n || time.Now().After(deadline) {
+			return statuses
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeviceLimiter_Drop(t *testing.T) {
+	var total uint64
+	var statuses statusRecorder
+	l := newDeviceLimiter(RateLimits{
+		Device:          RateLimit{Rate: 0.001, Burst: 3},
+		Subtopic:        RateLimit{Rate: 0.001, Burst: 2},
+		ThrottledStatus: "throttled",
+		StatusHold:      50 * time.Millisecond,
+	}, &total, statuses.set)
+	defer l.stop()
+	l.linkStatus("linked")
+
+	var delivered []string
+	for _, subtopic := range []string{"rawrx", "rawrx", "rawrx", "config", "config"} {
+		subtopic := subtopic
+		l.submit(subtopic, func() { delivered = append(delivered, subtopic) }, func() {})
+	}
+
+	// The third rawrx exceeds the subtopic limit and the second config
+	// exceeds the device limit
+	expected := []string{"rawrx", "rawrx", "config"}
+	if !equalStringSlices(delivered, expected) {
+		t.Fatalf("Expected delivered %v, got %v", expected, delivered)
+	}
+	if l.droppedMessages() != 2 || total != 2 {
+		t.Fatalf("Expected 2 dropped messages, got %d device and %d total", l.droppedMessages(), total)
+	}
+
+	if got := statuses.wait(2); !equalStringSlices(got, []string{"throttled", "linked"}) {
+		t.Fatalf("Expected throttled status to be set then restored, got %v", got)
+	}
+}
+
+func TestDeviceLimiter_MaxSubtopics(t *testing.T) {
+	l := newDeviceLimiter(RateLimits{
+		Subtopic:     RateLimit{Rate: 10, Burst: 1},
+		MaxSubtopics: 2,
+	}, nil, func(status string) {})
+	defer l.stop()
+
+	var delivered []string
+	submit := func(subtopic string) {
+		l.submit(subtopic, func() { delivered = append(delivered, subtopic) }, func() {})
+	}
+	for _, subtopic := range []string{"a", "b", "c", "d"} {
+		submit(subtopic)
+	}
+
+	// Subtopics beyond the maximum share a single limit
+	expected := []string{"a", "b", "c"}
+	if !equalStringSlices(delivered, expected) {
+		t.Fatalf("Expected delivered %v, got %v", expected, delivered)
+	}
+	l.lock.Lock()
+	tracked := len(l.subtopics)
+	l.lock.Unlock()
+	if tracked != 2 {
+		t.Fatalf("Expected 2 tracked subtopics, got %d", tracked)
+	}
+
+	// Once the tracked limits refill, they are forgotten to make room
+	time.Sleep(150 * time.Millisecond)
+	delivered = nil
+	submit("e")
+	submit("e")
+	if !equalStringSlices(delivered, []string{"e"}) {
+		t.Fatalf("Expected e to be limited separately, got %v", delivered)
+	}
+	l.lock.Lock()
+	_, ok := l.subtopics["e"]
+	tracked = len(l.subtopics)
+	l.lock.Unlock()
+	if !ok || tracked != 1 {
+		t.Fatalf("Expected only e to be tracked, got %d subtopics", tracked)
+	}
+}
+
+func TestDeviceLimiter_Queue(t *testing.T) {
+	var total uint64
+	var statuses statusRecorder
+	l := newDeviceLimiter(RateLimits{
+		Device:          RateLimit{Rate: 100, Burst: 1},
+		QueueSize:       4,
+		ThrottledStatus: "throttled",
+		StatusHold:      time.Hour,
+	}, &total, statuses.set)
+	defer l.stop()
+
+	// Block delivery so that the queue fills up
+	started := make(chan struct{})
+	release := make(chan struct{})
+	delivered := make(chan int, 10)
+	start := time.Now()
+	l.submit("rawrx", func() {
+		close(started)
+		<-release
+		delivered <- 0
+	}, func() {})
+	<-started
+	for i := 1; i <= 5; i++ {
+		i := i
+		l.submit("rawrx", func() { delivered <- i }, func() {})
+	}
+	close(release)
+
+	// Messages 1 to 4 fill the queue and message 5 overflows
+	var got []int
+	timeout := time.After(5 * time.Second)
+	for len(got) < 5 {
+		select {
+		case i := <-delivered:
+			got = append(got, i)
+		case <-timeout:
+			t.Fatalf("Timed out with delivered %v", got)
+		}
+	}
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("Expected queued messages in order, got %v", got)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Fatalf("Expected queued messages to be delayed by the limit, took %v", elapsed)
+	}
+	if l.droppedMessages() != 1 || total != 1 {
+		t.Fatalf("Expected 1 dropped message, got %d device and %d total", l.droppedMessages(), total)
+	}
+	if got := statuses.wait(1); !equalStringSlices(got, []string{"throttled"}) {
+		t.Fatalf("Expected throttled status, got %q", got)
+	}
+}
+
+func TestDeviceLimiter_SubmitAfterStop(t *testing.T) {
+	for _, queueSize := range []int{0, 4} {
+		var total uint64
+		var statuses statusRecorder
+		l := newDeviceLimiter(RateLimits{
+			Device:    RateLimit{Rate: 100, Burst: 10},
+			QueueSize: queueSize,
+		}, &total, statuses.set)
+		l.stop()
+
+		// Messages racing with the device's removal are discarded, so that
+		// they are neither delivered nor left pending
+		var delivered, discarded int
+		l.submit("rawrx", func() { delivered++ }, func() { discarded++ })
+		if delivered != 0 || discarded != 1 {
+			t.Fatalf("Expected the message to be discarded with queue size %d, got %d delivered and %d discarded", queueSize, delivered, discarded)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package framework
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// shardSubtopic is the service subtopic that carries the retained
+	// shard count announcement
+	shardSubtopic = "shards"
+	// envShardIndex and envShardCount are the environment variables read
+	// by ShardFromEnv
+	envShardIndex = "OC_SHARD_INDEX"
+	envShardCount = "OC_SHARD_COUNT"
+)
+
+var ErrInvalidShard = errors.New("Invalid shard index or count")
+var ErrNotSharded = errors.New("Managed service was not started with sharding")
+
+/*
+Shard count announcements are published retained to the service's
+shards subtopic and look like the following:
+openchirp/service/592880c57d6ec25f901d9668/shards:
+{
+	"count": 4
+}
+*/
+
+// serviceShardAnnouncement describes the JSON blob used to announce the
+// shard count
+type serviceShardAnnouncement struct {
+	Count int `json:"count"`
+}
+
+// shardConfig is the portion of the device id space owned by an instance.
+// A zero count means that sharding is disabled and all devices are owned.
+type shardConfig struct {
+	index int
+	count int
+}
+
+// owns reports whether the device with deviceID belongs to this shard
+func (s shardConfig) owns(deviceID string) bool {
+	return s.count == 0 || DeviceShard(deviceID, s.count) == s.index
+}
+
+func validShard(index, count int) error {
+	if index < 0 || count < 1 || index >= count {
+		return ErrInvalidShard
+	}
+	return nil
+}
+
+// DeviceShard returns the shard, from 0 to count-1, that owns deviceID when
+// the service's devices are split across count shards.
+// Ownership is decided using rendezvous hashing, so changing the shard count
+// moves as few devices as possible. Growing from N to N+1 shards moves about
+// 1/(N+1) of the devices, all to the new shard.
+func DeviceShard(deviceID string, count int) int {
+	var best int
+	var bestScore uint64
+	for shard := 0; shard < count; shard++ {
+		if score := shardScore(deviceID, shard); shard == 0 || score > bestScore {
+			best, bestScore = shard, score
+		}
+	}
+	return best
+}
+
+// shardScore is the rendezvous hashing weight of deviceID on shard
+func shardScore(deviceID string, shard int) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(deviceID))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(shard)))
+	// FNV alone mixes similar inputs poorly, so finish with the
+	// MurmurHash3 finalizer
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// ShardFromEnv discovers this instance's shard index and the shard count.
+// The count is read from the OC_SHARD_COUNT environment variable.
+// The index is read from OC_SHARD_INDEX or, if that is not set, from the
+// ordinal suffix of the hostname, like the 2 in "myservice-2", which is how
+// Kubernetes StatefulSets name their pods.
+func ShardFromEnv() (index, count int, err error) {
+	count, err = strconv.Atoi(os.Getenv(envShardCount))
+	if err != nil {
+		return 0, 0, ErrInvalidShard
+	}
+	if value, ok := os.LookupEnv(envShardIndex); ok {
+		index, err = strconv.Atoi(value)
+	} else {
+		var hostname string
+		hostname, err = os.Hostname()
+		if err == nil {
+			index, err = hostnameOrdinal(hostname)
+		}
+	}
+	if err != nil {
+		return 0, 0, ErrInvalidShard
+	}
+	return index, count, validShard(index, count)
+}
+
+// hostnameOrdinal parses the ordinal suffix of a hostname like "myservice-2"
+func hostnameOrdinal(hostname string) (int, error) {
+	i := strings.LastIndex(hostname, "-")
+	if i < 0 {
+		return 0, ErrInvalidShard
+	}
+	return strconv.Atoi(hostname[i+1:])
+}
+
+// WithSharding splits ownership of the service's devices across count
+// instances, where this instance is shard index. Every instance tracks all
+// linked devices, but only calls ProcessLink, ProcessConfigChange, and
+// ProcessUnlink for, and subscribes on behalf of, the devices it owns.
+// See DeviceShard for how devices are assigned.
+//
+// The shard count can be changed at runtime using ServiceClient.SetShard or
+// for all instances at once using ServiceClient.PublishShardCount.
+// Devices an instance no longer owns are still linked, so they are handed
+// off instead of unlinked. A ShutdownAwareDevice is notified through
+// ProcessShutdown and its retained values are left for the new owner.
+// Newly owned devices are linked.
+// Use ShardFromEnv to discover index and count from the environment.
+func WithSharding(index, count int) ManagedOption {
+	return func(m *serviceManager) {
+		if err := validShard(index, count); err != nil {
+			m.err = err
+			return
+		}
+		m.shard = shardConfig{index, count}
+		m.shardWant = m.shard
+	}
+}
+
+// sharded reports whether the manager was started with sharding
+func (m *serviceManager) sharded() bool {
+	m.shardLock.Lock()
+	defer m.shardLock.Unlock()
+	return m.shardWant.count > 0
+}
+
+// shardTopic returns the topic shard count announcements are published on
+func (c *ServiceClient) shardTopic() string {
+	return c.node.Pubsub.Topic + "/" + shardSubtopic
+}
+
+// startSharding begins listening for shard count announcements
+func (m *serviceManager) startSharding() error {
+	m.known = make(map[string]DeviceUpdate)
+	m.shardSignal = make(chan struct{}, 1)
+	return m.c.subscribe(m.c.shardTopic(), m.onShardAnnouncement)
+}
+
+// stopSharding stops listening for shard count announcements
+func (m *serviceManager) stopSharding() {
+	m.c.unsubscribe(m.c.shardTopic())
+}
+
+// onShardAnnouncement receives shard count announcements, which keep this
+// instance's index but change the shard count
+func (m *serviceManager) onShardAnnouncement(topic string, payload []byte) {
+	if len(payload) == 0 {
+		// cleared announcement
+		return
+	}
+	var announcement serviceShardAnnouncement
+	if err := json.Unmarshal(payload, &announcement); err != nil || announcement.Count < 1 {
+		m.logf("Ignoring invalid shard count announcement: %s", payload)
+		return
+	}
+	m.shardLock.Lock()
+	index := m.shardWant.index
+	m.shardLock.Unlock()
+	if index >= announcement.Count {
+		// This instance is expected to be scaled away
+		m.logf("Shard index %d is beyond the announced count %d, handing off all devices", index, announcement.Count)
+	}
+	m.requestShard(shardConfig{index, announcement.Count})
+}
+
+// requestShard asks the runtime to rebalance to s.
+// It never blocks, so that it may be called from pubsub callbacks and
+// device handlers. Only the latest request is applied.
+func (m *serviceManager) requestShard(s shardConfig) {
+	m.shardLock.Lock()
+	m.shardWant = s
+	m.shardLock.Unlock()
+	select {
+	case m.shardSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (m *serviceManager) setShard(index, count int) error {
+	if !m.sharded() {
+		return ErrNotSharded
+	}
+	if err := validShard(index, count); err != nil {
+		return err
+	}
+	m.requestShard(shardConfig{index, count})
+	return nil
+}
+
+// shardUpdate records a device update and reports whether the update is for
+// a device this instance owns and should be processed.
+// Must only be called from the runtime.
+func (m *serviceManager) shardUpdate(update DeviceUpdate) bool {
+	switch update.Type {
+	case DeviceUpdateTypeAdd, DeviceUpdateTypeUpd:
+		m.known[update.Id] = update
+		return m.shard.owns(update.Id)
+	case DeviceUpdateTypeRem:
+		delete(m.known, update.Id)
+	}
+	return true
+}
+
+// rebalance switches to the latest requested shard config by handing off
+// devices that are no longer owned and linking newly owned devices.
+// Must only be called from the runtime.
+func (m *serviceManager) rebalance() {
+	m.shardLock.Lock()
+	s := m.shardWant
+	m.shardLock.Unlock()
+	if s == m.shard {
+		return
+	}
+	m.shard = s
+
+	for deviceID, dState := range m.devices {
+		if !s.owns(deviceID) {
+			m.handoffDevice(dState)
+		}
+	}
+	for deviceID, update := range m.known {
+		if _, linked := m.devices[deviceID]; !linked && s.owns(deviceID) {
+			m.addUpdateDevice(deviceID, update.Topic, update.Config)
+		}
+	}
+	m.logf("Rebalanced to shard %d of %d, owning %d of %d devices", s.index, s.count, len(m.devices), len(m.known))
+}
+
+// handoffDevice stops handling a device that is still linked, but is now
+// owned by another instance. Like a service shutdown, the device is notified
+// through ShutdownAwareDevice instead of ProcessUnlink and the new owner takes
+// over its retained values. Must only be called from the runtime.
+func (m *serviceManager) handoffDevice(dState *deviceState) {
+	m.deviceUnsubscribeAll(dState)
+	// Discard rate limited messages still waiting for delivery
+	if dState.limiter != nil {
+		dState.limiter.stop()
+	}
+	if device, ok := dState.userDevice.(ShutdownAwareDevice); ok {
+		device.ProcessShutdown(m.deviceCtrlsCacheProvide(dState))
+	}
+	m.deviceCloseRPC(dState)
+	delete(m.devices, dState.id)
+	m.deviceCtrlsCacheRemove(dState.id)
+}
+
+// SetShard changes this instance's shard index and the shard count of a
+// managed service started with WithSharding. The devices are rebalanced
+// asynchronously.
+func (c *ServiceClient) SetShard(index, count int) error {
+	if c.manager == nil {
+		return ErrNotSharded
+	}
+	return c.manager.setShard(index, count)
+}
+
+// PublishShardCount announces a new shard count to all sharded instances of
+// this service, which will each rebalance while keeping their shard index.
+// The announcement is retained, so instances started later also use count.
+func (c *ServiceClient) PublishShardCount(count int) error {
+	if err := validShard(0, count); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(&serviceShardAnnouncement{Count: count})
+	if err != nil {
+		return err
+	}
+	return c.PublishOpts(c.shardTopic(), payload, mqttQoS, true)
+}
@@ -0,0 +1,226 @@
+package framework
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDeviceIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		// Look like the sequential ObjectIds the framework hands out
+		ids[i] = fmt.Sprintf("5930aaf27d6ec25f%08x", i)
+	}
+	return ids
+}
+
+func TestDeviceShard_Distribution(t *testing.T) {
+	const devices = 20000
+	for _, count := range []int{1, 2, 3, 8} {
+		perShard := make([]int, count)
+		for _, id := range testDeviceIDs(devices) {
+			shard := DeviceShard(id, count)
+			if shard < 0 || shard >= count {
+				t.Fatalf("Device %s assigned to shard %d of %d", id, shard, count)
+			}
+			perShard[shard]++
+		}
+		expected := devices / count
+		for shard, n := range perShard {
+			if n < expected*9/10 || n > expected*11/10 {
+				t.Errorf("Shard %d of %d owns %d devices, expected about %d", shard, count, n, expected)
+			}
+		}
+	}
+}
+
+func TestDeviceShard_Rebalance(t *testing.T) {
+	const devices = 20000
+	for count := 1; count < 8; count++ {
+		var moved int
+		for _, id := range testDeviceIDs(devices) {
+			before, after := DeviceShard(id, count), DeviceShard(id, count+1)
+			if before != after {
+				if after != count {
+					t.Fatalf("Device %s moved from shard %d to existing shard %d", id, before, after)
+				}
+				moved++
+			}
+		}
+		expected := devices / (count + 1)
+		if moved < expected*9/10 || moved > expected*11/10 {
+			t.Errorf("Growing to %d shards moved %d devices, expected about %d", count+1, moved, expected)
+		}
+	}
+}
+
+func TestShardConfig_Owns(t *testing.T) {
+	ids := testDeviceIDs(100)
+	for _, id := range ids {
+		if !(shardConfig{}).owns(id) {
+			t.Fatalf("Unsharded config must own device %s", id)
+		}
+		var owners int
+		for index := 0; index < 4; index++ {
+			if (shardConfig{index, 4}).owns(id) {
+				owners++
+			}
+		}
+		if owners != 1 {
+			t.Fatalf("Device %s owned by %d shards", id, owners)
+		}
+	}
+	// An index beyond the count is rejected
+	if err := validShard(4, 4); err != ErrInvalidShard {
+		t.Fatalf("Expected ErrInvalidShard for an out of range index, got %v", err)
+	}
+	if _, err := newServiceManager(new(ServiceClient), nil, WithSharding(4, 4)); err != ErrInvalidShard {
+		t.Fatalf("Expected WithSharding to reject an out of range index, got %v", err)
+	}
+}
+
+func TestShardFromEnv(t *testing.T) {
+	defer os.Unsetenv(envShardIndex)
+	defer os.Unsetenv(envShardCount)
+
+	os.Setenv(envShardCount, "4")
+	os.Setenv(envShardIndex, "3")
+	if index, count, err := ShardFromEnv(); err != nil || index != 3 || count != 4 {
+		t.Fatalf("Expected shard 3 of 4, got %d of %d: %v", index, count, err)
+	}
+
+	os.Setenv(envShardCount, "0")
+	if _, _, err := ShardFromEnv(); err != ErrInvalidShard {
+		t.Fatalf("Expected invalid shard count, got %v", err)
+	}
+
+	ordinals := map[string]int{
+		"myservice-0":          0,
+		"my-service-12":        12,
+		"myservice-7.internal": -1,
+		"myservice":            -1,
+	}
+	for hostname, expected := range ordinals {
+		index, err := hostnameOrdinal(hostname)
+		if expected < 0 {
+			if err == nil {
+				t.Errorf("Expected no ordinal for hostname %q, got %d", hostname, index)
+			}
+		} else if err != nil || index != expected {
+			t.Errorf("Expected ordinal %d for hostname %q, got %d: %v", expected, hostname, index, err)
+		}
+	}
+}
+
+// shardDevice publishes a retained value when linked and records its events
+type shardDevice struct {
+	log *eventLog
+}
+
+func (d *shardDevice) ProcessLink(ctrl *DeviceControl) string {
+	d.log.add("link " + ctrl.Id())
+	ctrl.PublishRetained("state", "on")
+	return "Linked"
+}
+
+func (d *shardDevice) ProcessUnlink(ctrl *DeviceControl) {
+	d.log.add("unlink " + ctrl.Id())
+}
+
+func (d *shardDevice) ProcessConfigChange(ctrl *DeviceControl, cchanges, coriginal map[string]string) (string, bool) {
+	return "", true
+}
+
+func (d *shardDevice) ProcessMessage(ctrl *DeviceControl, msg Message) {}
+
+func (d *shardDevice) ProcessShutdown(ctrl *DeviceControl) {
+	d.log.add("shutdown " + ctrl.Id())
+}
+
+// countEvents returns the number of events that start with prefix
+func countEvents(events []string, prefix string) int {
+	var n int
+	for _, event := range events {
+		if strings.HasPrefix(event, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// waitEvents waits for the log to hold count events that start with prefix
+func waitEvents(t *testing.T, log *eventLog, prefix string, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for countEvents(log.get(), prefix) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d %q events, got %v", count, prefix, log.get())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServiceManager_RebalanceHandsOff(t *testing.T) {
+	var events eventLog
+	mqtt := newRouteMQTT()
+	c := new(ServiceClient)
+	c.mqtt = mqtt
+	c.node.Pubsub.Topic = "openchirp/service/svc"
+	m, err := newServiceManager(c, func() Device { return &shardDevice{&events} }, WithSharding(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.startSharding(); err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan DeviceUpdate)
+	m.updates = updates
+	m.startWorkers()
+	m.wg.Add(1)
+	c.manager = m
+	go m.runtime()
+	defer func() {
+		close(m.shutdown)
+		m.wg.Wait()
+	}()
+
+	ids := testDeviceIDs(20)
+	var moved []string
+	for _, id := range ids {
+		updates <- DeviceUpdate{Type: DeviceUpdateTypeAdd, Id: id, Topic: "openchirp/device/" + id, Config: map[string]string{}}
+		if DeviceShard(id, 2) == 1 {
+			moved = append(moved, id)
+		}
+	}
+	waitEvents(t, &events, "link ", len(ids))
+
+	// Devices moving to the new shard are handed off, not unlinked
+	if err := c.PublishShardCount(2); err != nil {
+		t.Fatal(err)
+	}
+	waitEvents(t, &events, "shutdown ", len(moved))
+	for _, id := range moved {
+		if countEvents(events.get(), "shutdown "+id) != 1 {
+			t.Errorf("Expected device %s to be handed off", id)
+		}
+	}
+	if n := countEvents(events.get(), "unlink "); n != 0 {
+		t.Fatalf("Expected no devices to be unlinked, got %d: %v", n, events.get())
+	}
+	mqtt.lock.Lock()
+	if len(mqtt.cleared) != 0 {
+		t.Errorf("Expected the retained values to be left for the new owner, got cleared %v", mqtt.cleared)
+	}
+	mqtt.lock.Unlock()
+
+	// Shrinking back links the devices again
+	if err := c.SetShard(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	waitEvents(t, &events, "link ", len(ids)+len(moved))
+	if n := countEvents(events.get(), "unlink "); n != 0 {
+		t.Fatalf("Expected no devices to be unlinked, got %d: %v", n, events.get())
+	}
+}
@@ -0,0 +1,122 @@
+package framework
+
+import (
+	"sync"
+	"time"
+)
+
+// ShutdownAwareDevice may be implemented by a Device in order to be notified
+// when the service is stopping. Unlike ProcessUnlink, the device is still
+// linked and will be linked again when the service restarts, so the device
+// should only release its local resources and keep any published state.
+// ProcessShutdown is called after the device's received messages have been
+// drained. It is also called when a sharded service hands the device off to
+// another instance, see WithSharding.
+type ShutdownAwareDevice interface {
+	ProcessShutdown(ctrl *DeviceControl)
+}
+
+// WithShutdownStatus sets the service status published as StopClient
+// finishes a graceful shutdown. By default, or if status is blank, no final
+// status is published.
+func WithShutdownStatus(status string) ManagedOption {
+	return func(m *serviceManager) {
+		m.shutdownStatus = status
+	}
+}
+
+// pendingGroup counts pending work like a sync.WaitGroup, but refuses new
+// work once closed, so that it can be drained while work is still arriving
+type pendingGroup struct {
+	lock    sync.Mutex
+	pending int
+	closed  bool
+	idle    chan struct{}
+}
+
+// add reports whether new work is accepted, which must be followed by done
+func (g *pendingGroup) add() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closed {
+		return false
+	}
+	g.pending++
+	return true
+}
+
+// done marks accepted work as finished
+func (g *pendingGroup) done() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.pending--
+	if g.closed && g.pending == 0 {
+		close(g.idle)
+	}
+}
+
+// close refuses new work and returns a channel that is closed once all
+// accepted work is done. Must only be called once.
+func (g *pendingGroup) close() <-chan struct{} {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.closed = true
+	g.idle = make(chan struct{})
+	if g.pending == 0 {
+		close(g.idle)
+	}
+	return g.idle
+}
+
+// publishAsync runs publish in the background, tracked so that it is flushed
+// before the client disconnects
+func (m *serviceManager) publishAsync(publish func()) {
+	if !m.publishes.add() {
+		// Already flushed for shutdown
+		return
+	}
+	go func() {
+		defer m.publishes.done()
+		publish()
+	}()
+}
+
+// shutdownDevices notifies each ShutdownAwareDevice that the service is
+// stopping. Must only be called after the runtime stopped.
+func (m *serviceManager) shutdownDevices() {
+	for _, dState := range m.devices {
+		if dState.limiter != nil {
+			dState.limiter.stop()
+		}
+		if device, ok := dState.userDevice.(ShutdownAwareDevice); ok {
+			device.ProcessShutdown(m.deviceCtrlsCacheProvide(dState))
+		}
+	}
+}
+
+// waitGroupDone returns a channel that is closed once wg is done
+func waitGroupDone(wg *sync.WaitGroup) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// waitDeadline waits for done to be closed and reports whether that happened
+// before deadline. A zero deadline waits indefinitely.
+func waitDeadline(done <-chan struct{}, deadline time.Time) bool {
+	if deadline.IsZero() {
+		<-done
+		return true
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
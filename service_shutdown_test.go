@@ -0,0 +1,202 @@
+package framework
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openchirp/framework/pubsub"
+)
+
+// eventLog records events from multiple routines
+type eventLog struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(event string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *eventLog) get() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+// shutdownMQTT is an mqttClient that records publishes and lets the test
+// deliver messages to subscriptions
+type shutdownMQTT struct {
+	mqttClient
+	log       *eventLog
+	lock      sync.Mutex
+	callbacks map[string]func(topic string, payload []byte)
+}
+
+func (c *shutdownMQTT) SubscribeHandlerQoS(topic string, qos pubsub.MQTTQoS, callback func(topic string, payload []byte)) (pubsub.SubscriptionID, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.callbacks[topic] = callback
+	return pubsub.SubscriptionID(len(c.callbacks)), nil
+}
+
+func (c *shutdownMQTT) UnsubscribeHandler(ids ...pubsub.SubscriptionID) error {
+	return nil
+}
+
+func (c *shutdownMQTT) Publish(topic string, payload interface{}) error {
+	c.log.add("publish " + string(payload.([]byte)))
+	return nil
+}
+
+func (c *shutdownMQTT) Disconnect() {
+	c.log.add("disconnect")
+}
+
+func (c *shutdownMQTT) deliver(topic string, payload string) {
+	c.lock.Lock()
+	callback := c.callbacks[topic]
+	c.lock.Unlock()
+	callback(topic, []byte(payload))
+}
+
+// shutdownDevice processes messages slowly and records its events
+type shutdownDevice struct {
+	log *eventLog
+}
+
+func (d *shutdownDevice) ProcessLink(ctrl *DeviceControl) string {
+	ctrl.Subscribe("rawrx", nil)
+	return "Linked"
+}
+
+func (d *shutdownDevice) ProcessUnlink(ctrl *DeviceControl) {
+	d.log.add("unlink")
+}
+
+func (d *shutdownDevice) ProcessConfigChange(ctrl *DeviceControl, cchanges, coriginal map[string]string) (string, bool) {
+	return "", true
+}
+
+func (d *shutdownDevice) ProcessMessage(ctrl *DeviceControl, msg Message) {
+	time.Sleep(20 * time.Millisecond)
+	d.log.add("message " + string(msg.Payload()))
+}
+
+func (d *shutdownDevice) ProcessShutdown(ctrl *DeviceControl) {
+	d.log.add("shutdown")
+}
+
+func TestServiceManager_GracefulStop(t *testing.T) {
+	var events eventLog
+	mqtt := &shutdownMQTT{log: &events, callbacks: make(map[string]func(string, []byte))}
+	c := new(ServiceClient)
+	c.mqtt = mqtt
+	m, err := newServiceManager(c, func() Device { return &shutdownDevice{&events} },
+		WithWorkers(1),
+		WithShutdownStatus("Stopped for upgrade"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan DeviceUpdate)
+	m.updates = updates
+	m.startWorkers()
+	m.wg.Add(1)
+	c.manager = m
+	go m.runtime()
+
+	topic := "openchirp/device/dev1"
+	updates <- DeviceUpdate{Type: DeviceUpdateTypeAdd, Id: "dev1", Topic: topic, Config: map[string]string{}}
+	// Wait for the runtime to finish linking
+	updates <- DeviceUpdate{Type: DeviceUpdateTypeUpd, Id: "dev1", Topic: topic, Config: map[string]string{}}
+
+	for _, payload := range []string{"1", "2", "3"} {
+		mqtt.deliver(topic+"/rawrx", payload)
+	}
+	c.StopClient()
+	mqtt.deliver(topic+"/rawrx", "late")
+
+	got := events.get()
+	expected := []string{
+		`publish {"thing":{"id":"dev1","message":"Linked"}}`,
+		"message 1",
+		"message 2",
+		"message 3",
+		"shutdown",
+		`publish {"message":"Stopped for upgrade"}`,
+		"disconnect",
+	}
+	if !equalStringSlices(got, expected) {
+		t.Fatalf("Expected events:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// blockedDevice blocks processing messages until release is closed
+type blockedDevice struct {
+	shutdownDevice
+	release chan struct{}
+}
+
+func (d *blockedDevice) ProcessMessage(ctrl *DeviceControl, msg Message) {
+	<-d.release
+}
+
+// closerSink records whether it was closed
+type closerSink struct {
+	lock   sync.Mutex
+	closed bool
+}
+
+func (s *closerSink) WriteDeadLetter(letter DeadLetter) error {
+	return nil
+}
+
+func (s *closerSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestServiceManager_StopTimeoutKeepsSinks(t *testing.T) {
+	var events eventLog
+	mqtt := &shutdownMQTT{log: &events, callbacks: make(map[string]func(string, []byte))}
+	c := new(ServiceClient)
+	c.mqtt = mqtt
+	device := &blockedDevice{shutdownDevice{&events}, make(chan struct{})}
+	defer close(device.release)
+	sink := new(closerSink)
+	m, err := newServiceManager(c, func() Device { return device },
+		WithWorkers(1),
+		WithShutdownTimeout(20*time.Millisecond),
+		WithDeadLetterSink(sink),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan DeviceUpdate)
+	m.updates = updates
+	m.startWorkers()
+	m.wg.Add(1)
+	c.manager = m
+	go m.runtime()
+
+	topic := "openchirp/device/dev1"
+	updates <- DeviceUpdate{Type: DeviceUpdateTypeAdd, Id: "dev1", Topic: topic, Config: map[string]string{}}
+	// Wait for the runtime to finish linking
+	updates <- DeviceUpdate{Type: DeviceUpdateTypeUpd, Id: "dev1", Topic: topic, Config: map[string]string{}}
+
+	mqtt.deliver(topic+"/rawrx", "stuck")
+	c.StopClient()
+
+	// The stuck message may still be dead lettered
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.closed {
+		t.Fatal("Expected the dead letter sink to be left open after timing out")
+	}
+}
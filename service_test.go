@@ -0,0 +1,122 @@
+package framework
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openchirp/framework/rest"
+)
+
+func TestServiceClient_SetProperties(t *testing.T) {
+	var sent []map[string]interface{}
+	// The properties held by the server, which were edited since the client
+	// cached them
+	stored := map[string]string{"region": "eu", "owner": "ops"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /apiv1/service/svc1":
+		case "PUT /apiv1/service/svc1":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			sent = append(sent, body)
+			stored = make(map[string]string)
+			for key, value := range body["properties"].(map[string]interface{}) {
+				stored[key] = value.(string)
+			}
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(rest.ServiceNode{Properties: stored})
+	}))
+	defer server.Close()
+
+	c := new(ServiceClient)
+	c.id = "svc1"
+	c.host = rest.NewHost(server.URL)
+	c.node.Properties = map[string]string{"region": "us"}
+
+	if err := c.SetProperty("cursor", "42"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetProperties(map[string]string{"cursor": "43", "mode": "fast"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Properties edited on the server are kept instead of the stale cache
+	expected := map[string]string{"region": "eu", "owner": "ops", "cursor": "43", "mode": "fast"}
+	if props := c.GetProperties(); !reflect.DeepEqual(props, expected) {
+		t.Fatalf("Expected properties %v, got %v", expected, props)
+	}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Fatalf("Expected stored properties %v, got %v", expected, stored)
+	}
+	// Only the properties are updated
+	for _, body := range sent {
+		if len(body) != 1 {
+			t.Fatalf("Expected only properties to be sent, got %v", body)
+		}
+	}
+}
+
+func TestServiceClient_SetPropertiesUnlocked(t *testing.T) {
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /apiv1/service/svc1":
+			// Hold the fetch until the cached properties were read
+			close(fetching)
+			<-release
+			json.NewEncoder(w).Encode(rest.ServiceNode{Properties: map[string]string{"region": "us"}})
+		case "PUT /apiv1/service/svc1":
+			var body rest.ServiceNode
+			json.NewDecoder(r.Body).Decode(&body)
+			json.NewEncoder(w).Encode(rest.ServiceNode{Properties: body.Properties})
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := new(ServiceClient)
+	c.id = "svc1"
+	c.host = rest.NewHost(server.URL)
+	c.node.Properties = map[string]string{"region": "us"}
+
+	set := make(chan error)
+	go func() {
+		set <- c.SetProperty("cursor", "42")
+	}()
+	<-fetching
+
+	// Readers are not blocked by the requests of SetProperties
+	read := make(chan string)
+	go func() {
+		read <- c.GetProperty("region")
+	}()
+	select {
+	case region := <-read:
+		if region != "us" {
+			t.Fatalf("Expected cached region us, got %q", region)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("GetProperty blocked while SetProperties was fetching")
+	}
+	close(release)
+	if err := <-set; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"region": "us", "cursor": "42"}
+	if props := c.GetProperties(); !reflect.DeepEqual(props, expected) {
+		t.Fatalf("Expected properties %v, got %v", expected, props)
+	}
+}
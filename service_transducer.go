@@ -0,0 +1,40 @@
+package framework
+
+import (
+	"strings"
+
+	"github.com/openchirp/framework/rest"
+)
+
+// EnsureTransducers makes sure that the device has each of the given
+// transducers, so that the values the service publishes on them are recorded.
+// Transducers are matched by name, ignoring case, and missing ones are
+// created. Existing transducers are left unchanged.
+// This makes REST requests, so it should be called from ProcessLink rather
+// than for every message.
+func (c *DeviceControl) EnsureTransducers(transducers ...rest.TransducerInfo) error {
+	host := c.manager.c.host
+	node, err := host.RequestDeviceInfo(c.dState.id)
+	if err != nil {
+		return err
+	}
+
+	for _, transducer := range transducers {
+		exists := false
+		for _, existing := range node.Transducers {
+			if strings.EqualFold(existing.Name, transducer.Name) {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+		created, err := host.DeviceTransducerCreate(c.dState.id, transducer)
+		if err != nil {
+			return err
+		}
+		node.Transducers = append(node.Transducers, created)
+	}
+	return nil
+}
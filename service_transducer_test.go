@@ -0,0 +1,47 @@
+package framework
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openchirp/framework/rest"
+)
+
+func TestDeviceControl_EnsureTransducers(t *testing.T) {
+	var created []rest.TransducerInfo
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /apiv1/device/dev1":
+			json.NewEncoder(w).Encode(rest.DeviceNode{
+				Transducers: []rest.TransducerInfo{{ID: "t1", Name: "Temperature", Unit: "C"}},
+			})
+		case "POST /apiv1/device/dev1/transducer":
+			var transducer rest.TransducerInfo
+			json.NewDecoder(r.Body).Decode(&transducer)
+			created = append(created, transducer)
+			transducer.ID = "t2"
+			json.NewEncoder(w).Encode(transducer)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := new(ServiceClient)
+	c.host = rest.NewHost(server.URL)
+	ctrl := &DeviceControl{manager: &serviceManager{c: c}, dState: &deviceState{id: "dev1"}}
+	err := ctrl.EnsureTransducers(
+		rest.TransducerInfo{Name: "temperature", Unit: "C"},
+		rest.TransducerInfo{Name: "relay", IsActuable: true},
+		rest.TransducerInfo{Name: "Relay", IsActuable: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || created[0].Name != "relay" || !created[0].IsActuable {
+		t.Fatalf("Expected only the missing relay transducer to be created, got %+v", created)
+	}
+}
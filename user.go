@@ -1,5 +1,11 @@
 package framework
 
+import (
+	"fmt"
+
+	"github.com/openchirp/framework/pubsub"
+)
+
 // UserClient represents the context for a single user client session
 type UserClient struct {
 	Client
@@ -27,6 +33,14 @@ func (c *UserClient) Subscribe(topic string, callback UserClientTopicHandler) er
 	})
 }
 
+// SubscribeQoS registers a callback for a receiving a given mqtt topic payload
+// using the specified QoS
+func (c *UserClient) SubscribeQoS(topic string, qos pubsub.MQTTQoS, callback UserClientTopicHandler) error {
+	return c.subscribeQoS(topic, qos, func(topic string, payload []byte) {
+		callback(c, topic, payload)
+	})
+}
+
 // Unsubscribe deregisters a callback for a given mqtt topics
 func (c *UserClient) Unsubscribe(topics ...string) error {
 	return c.unsubscribe(topics...)
@@ -36,3 +50,29 @@ func (c *UserClient) Unsubscribe(topics ...string) error {
 func (c *UserClient) Publish(topic string, payload interface{}) error {
 	return c.publish(topic, payload)
 }
+
+// PublishOpts publishes a payload to a given mqtt topic using the specified
+// QoS and retained flag
+func (c *UserClient) PublishOpts(topic string, payload interface{}, qos pubsub.MQTTQoS, retained bool) error {
+	return c.publishOpts(topic, payload, qos, retained)
+}
+
+// CreateDevice creates a device owned by the user and generates its security
+// token, which the device uses with its ID to connect to the broker.
+// The locationID and properties are optional and can be blank and nil.
+// If the token cannot be generated, the device is deleted again and a failure
+// to delete it is reported along with the token error.
+func (c *UserClient) CreateDevice(name, locationID string, properties map[string]string) (id, token string, err error) {
+	node, err := c.host.DeviceCreate(name, locationID, properties)
+	if err != nil {
+		return "", "", err
+	}
+	token, err = c.host.DeviceTokenGenerate(node.ID)
+	if err != nil {
+		if derr := c.host.DeviceDelete(node.ID); derr != nil {
+			return "", "", fmt.Errorf("%v, and failed to delete device %s: %v", err, node.ID, derr)
+		}
+		return "", "", err
+	}
+	return node.ID, token, nil
+}
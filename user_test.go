@@ -0,0 +1,71 @@
+package framework
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openchirp/framework/rest"
+)
+
+func TestUserClient_CreateDevice(t *testing.T) {
+	var deleted []string
+	failToken := false
+	failDelete := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /apiv1/device":
+			json.NewEncoder(w).Encode(rest.DeviceNode{NodeDescriptor: rest.NodeDescriptor{ID: "dev1"}})
+		case "POST /apiv1/device/dev1/token":
+			if failToken {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"error": map[string]string{"message": "Not allowed"},
+				})
+				return
+			}
+			json.NewEncoder(w).Encode("Zxkq8vDbLEMzZ9b1tQ2wH7Rk")
+		case "DELETE /apiv1/device/dev1":
+			if failDelete {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"error": map[string]string{"message": "Database unavailable"},
+				})
+				return
+			}
+			deleted = append(deleted, "dev1")
+			json.NewEncoder(w).Encode(map[string]string{})
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := new(UserClient)
+	c.host = rest.NewHost(server.URL)
+
+	id, token, err := c.CreateDevice("Sensor 1", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "dev1" || token != "Zxkq8vDbLEMzZ9b1tQ2wH7Rk" {
+		t.Fatalf("Unexpected device id %q and token %q", id, token)
+	}
+
+	failToken = true
+	if _, _, err := c.CreateDevice("Sensor 2", "", nil); err == nil || err.Error() != "Not allowed" {
+		t.Fatalf("Expected token error, got %v", err)
+	}
+	if !equalStringSlices(deleted, []string{"dev1"}) {
+		t.Fatalf("Expected the device to be deleted after the token failed, got %v", deleted)
+	}
+
+	// An orphaned device must be reported
+	failDelete = true
+	_, _, err = c.CreateDevice("Sensor 3", "", nil)
+	if expected := "Not allowed, and failed to delete device dev1: Database unavailable"; err == nil || err.Error() != expected {
+		t.Fatalf("Expected %q, got %v", expected, err)
+	}
+}